@@ -7,21 +7,65 @@ import (
 	"google.golang.org/grpc"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
 )
 
 func main() {
+	cfg := service.DefaultConfig()
 	port := flag.String("port", "50051", "Port to listen on")
+	flag.Int64Var(&cfg.CacheSize, "cache-size", cfg.CacheSize, "Memory in bytes to cache recently used chunks in, 0 to disable")
+	flag.Int64Var(&cfg.ScrubRate, "scrub-rate", cfg.ScrubRate, "Bytes per second to verify stored chunks at, 0 to disable scrubbing")
+	flag.DurationVar(&cfg.ScrubInterval, "scrub-interval", cfg.ScrubInterval, "Time between the starts of scrub passes")
+	metadata := flag.String("metadata", "", "Addresses of the metadata services to register with, separated by commas")
+	flag.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", cfg.HeartbeatInterval, "Time between heartbeats to the metadata services")
+	flag.DurationVar(&cfg.BlockReportInterval, "block-report-interval", cfg.BlockReportInterval, "Time between incremental block reports to the metadata services")
+	advertise := flag.String("advertise", "", "Address the metadata services reach the data node on, localhost:<port> by default")
+	flag.Int64Var(&cfg.Capacity, "capacity", 0, "Bytes the data node may store, 0 if unlimited")
+	labels := flag.String("labels", "", "Labels of the data node as key=value pairs separated by commas, such as rack=r1")
+	flag.BoolVar(&cfg.SHA256, "sha256", false, "Store and verify a SHA-256 of every chunk in addition to its CRC32C")
 	flag.Parse()
 
+	if *metadata != "" {
+		cfg.Metadata = strings.Split(*metadata, ",")
+	}
+
+	var err error
+	if cfg.Labels, err = service.ParseLabels(*labels); err != nil {
+		log.Fatalf("Invalid labels: %v", err)
+	}
+
+	cfg.Address = *advertise
+	if cfg.Address == "" {
+		cfg.Address = "localhost:" + *port
+	}
+
 	// Start the data node
 	lis, err := net.Listen("tcp", ":"+*port)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	s := service.NewDataNode("localhost:" + *port)
+	s, err := service.NewDataNode(cfg)
+	if err != nil {
+		log.Fatalf("Failed to start data node: %v", err)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+
+	go func() {
+		<-c
+		log.Println("Shutting down data node...")
+		s.Shutdown()
+		if err := lis.Close(); err != nil {
+			log.Fatalf("Error closing listener: %v", err)
+		}
+	}()
 
-	grpcServer := grpc.NewServer()
+	// Leave headroom over the largest chunk for the rest of the message
+	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(service.MaxChunkSize + 1024*1024))
 
 	dataGrpc.RegisterDataNodeServiceServer(grpcServer, s)
 
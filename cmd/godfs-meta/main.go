@@ -0,0 +1,394 @@
+// Entry point for the godfs-meta metadata maintenance tool
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	client "github.com/apolyeti/godfs/internal/metadata/client"
+	p "github.com/apolyeti/godfs/internal/metadata/genproto"
+	service "github.com/apolyeti/godfs/internal/metadata/service"
+	rp "github.com/apolyeti/godfs/internal/raft/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const usage = `Usage: godfs-meta [flags] <command> [args]
+
+Inspects and repairs the metadata of a metadata service. dump and load work
+on the files of a stopped service, the other commands ask a running one.
+
+Commands:
+  dump [file]                         Write the namespace as JSON lines to file, or stdout
+  load [-force] [file]                Replace the namespace with a dump read from file, or stdin
+  fsck [-addr a] [-repair] [-chunks]  Check the namespace and print findings as JSON lines
+  nodes [-addr a]                     Print the registered data nodes and their health as JSON lines
+  reconcile [-addr a] [-refresh]      Print chunks the data nodes hold that disagree with the namespace
+  command [-addr a] <node> delete|verify <chunk>...
+                                      Queue a command for the data node to delete or verify chunks
+  command [-addr a] <node> replicate <target> <chunk>...
+                                      Queue a command for the data node to copy chunks to target
+  command [-addr a] <node> report     Queue a command for the data node to send a full block report
+  raft [-addr a] status               Print the raft state of a replica
+  raft [-addr a] add <id> <address>   Add a replica to the group of the leader at addr
+  raft [-addr a] remove <id>          Remove a replica from the group of the leader at addr
+  promote [-addr a] [-force]          Make the standby at addr take over from its primary
+
+Flags:
+`
+
+func main() {
+	cfg := service.DefaultConfig()
+	dir := flag.String("dir", ".", "Working directory of the metadata service")
+	flag.StringVar(&cfg.Store, "store", cfg.Store, "Metadata store, memory or disk")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// The service keeps its state relative to its working directory
+	if err := os.Chdir(*dir); err != nil {
+		log.Fatalf("Failed to enter %v: %v", *dir, err)
+	}
+
+	switch flag.Arg(0) {
+	case "dump":
+		dump(cfg, flag.Args()[1:])
+	case "load":
+		load(cfg, flag.Args()[1:])
+	case "fsck":
+		fsck(flag.Args()[1:])
+	case "nodes":
+		nodes(flag.Args()[1:])
+	case "reconcile":
+		reconcile(flag.Args()[1:])
+	case "command":
+		queueCommand(flag.Args()[1:])
+	case "raft":
+		raftAdmin(flag.Args()[1:])
+	case "promote":
+		promote(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func dump(cfg service.Config, args []string) {
+	var out io.Writer = os.Stdout
+	if len(args) > 0 {
+		file, err := os.Create(args[0])
+		if err != nil {
+			log.Fatalf("Failed to create dump: %v", err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				log.Fatalf("Failed to close dump: %v", err)
+			}
+		}()
+		out = file
+	}
+
+	if err := service.Dump(cfg, out); err != nil {
+		log.Fatalf("Failed to dump metadata: %v", err)
+	}
+}
+
+func load(cfg service.Config, args []string) {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	force := flags.Bool("force", false, "Replace a namespace that is not empty")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	var in io.Reader = os.Stdin
+	if flags.NArg() > 0 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to open dump: %v", err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				log.Printf("Failed to close dump: %v", err)
+			}
+		}()
+		in = file
+	}
+
+	if err := service.Load(cfg, in, *force); err != nil {
+		log.Fatalf("Failed to load metadata: %v", err)
+	}
+	log.Printf("Metadata loaded")
+}
+
+func fsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8080", "Address of the metadata service")
+	repair := flags.Bool("repair", false, "Repair the findings that can be repaired")
+	chunks := flags.Bool("chunks", false, "Check the chunks of every file against the data nodes")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	conn, err := grpc.NewClient(
+		*addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close connection: %v", err)
+		}
+	}()
+
+	c := client.NewClient(p.NewMetadataServiceClient(conn))
+	res, err := c.Fsck(context.Background(), *repair, *chunks)
+	if err != nil {
+		log.Fatalf("Failed to check metadata: %v", err)
+	}
+
+	for _, finding := range res.Findings {
+		line, err := protojson.Marshal(finding)
+		if err != nil {
+			log.Fatalf("Failed to encode finding: %v", err)
+		}
+		fmt.Println(string(line))
+	}
+	log.Printf("Checked %d inodes and %d chunks, %d findings", res.InodesChecked, res.ChunksChecked, len(res.Findings))
+
+	if len(res.Findings) > 0 && !*repair {
+		os.Exit(1)
+	}
+}
+
+func nodes(args []string) {
+	flags := flag.NewFlagSet("nodes", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8080", "Address of the metadata service")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	conn, err := grpc.NewClient(
+		*addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close connection: %v", err)
+		}
+	}()
+
+	c := client.NewClient(p.NewMetadataServiceClient(conn))
+	res, err := c.ListNodes(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to list data nodes: %v", err)
+	}
+
+	for _, node := range res.Nodes {
+		line, err := protojson.Marshal(node)
+		if err != nil {
+			log.Fatalf("Failed to encode data node: %v", err)
+		}
+		fmt.Println(string(line))
+	}
+}
+
+func reconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8080", "Address of the metadata service")
+	refresh := flags.Bool("refresh", false, "Reconcile the block reports now instead of printing the last reconciliation")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	conn, err := grpc.NewClient(
+		*addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close connection: %v", err)
+		}
+	}()
+
+	c := client.NewClient(p.NewMetadataServiceClient(conn))
+	res, err := c.GetReconciliation(context.Background(), *refresh)
+	if err != nil {
+		log.Fatalf("Failed to get reconciliation: %v", err)
+	}
+	if res.ReconciledAt == 0 {
+		log.Fatalf("Block reports were not reconciled yet, try -refresh")
+	}
+
+	for _, discrepancy := range res.Discrepancies {
+		line, err := protojson.Marshal(discrepancy)
+		if err != nil {
+			log.Fatalf("Failed to encode discrepancy: %v", err)
+		}
+		fmt.Println(string(line))
+	}
+	for _, node := range res.Unreported {
+		log.Printf("Data node %s sent no full block report yet", node)
+	}
+	log.Printf("Reconciled %d chunks at %v, %d discrepancies",
+		res.ChunksChecked, time.Unix(0, res.ReconciledAt).Format(time.RFC3339), len(res.Discrepancies))
+
+	if len(res.Discrepancies) > 0 {
+		os.Exit(1)
+	}
+}
+
+func queueCommand(args []string) {
+	flags := flag.NewFlagSet("command", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8080", "Address of the metadata service")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if flags.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	command := &p.DataNodeCommand{ChunkIds: flags.Args()[2:]}
+	switch flags.Arg(1) {
+	case "delete":
+		command.Kind = p.CommandKind_COMMAND_KIND_DELETE
+	case "verify":
+		command.Kind = p.CommandKind_COMMAND_KIND_VERIFY
+	case "replicate":
+		if flags.NArg() < 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		command.Kind = p.CommandKind_COMMAND_KIND_REPLICATE
+		command.Target = flags.Arg(2)
+		command.ChunkIds = flags.Args()[3:]
+	case "report":
+		command.Kind = p.CommandKind_COMMAND_KIND_REPORT
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := grpc.NewClient(
+		*addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close connection: %v", err)
+		}
+	}()
+
+	c := client.NewClient(p.NewMetadataServiceClient(conn))
+	res, err := c.QueueCommand(context.Background(), flags.Arg(0), command)
+	if err != nil {
+		log.Fatalf("Failed to queue command: %v", err)
+	}
+	log.Printf("Queued command %d", res.Id)
+}
+
+func raftAdmin(args []string) {
+	flags := flag.NewFlagSet("raft", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8080", "Address of the replica")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+	if flags.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := grpc.NewClient(
+		*addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close connection: %v", err)
+		}
+	}()
+
+	c := rp.NewRaftServiceClient(conn)
+	ctx := context.Background()
+
+	var res proto.Message
+	switch {
+	case flags.Arg(0) == "status" && flags.NArg() == 1:
+		res, err = c.Status(ctx, &rp.StatusRequest{})
+	case flags.Arg(0) == "add" && flags.NArg() == 3:
+		res, err = c.AddServer(ctx, &rp.AddServerRequest{
+			Server: &rp.Server{Id: flags.Arg(1), Address: flags.Arg(2)},
+		})
+	case flags.Arg(0) == "remove" && flags.NArg() == 2:
+		res, err = c.RemoveServer(ctx, &rp.RemoveServerRequest{Id: flags.Arg(1)})
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("Failed to %s: %v", flags.Arg(0), err)
+	}
+
+	line, err := protojson.Marshal(res)
+	if err != nil {
+		log.Fatalf("Failed to encode response: %v", err)
+	}
+	fmt.Println(string(line))
+}
+
+func promote(args []string) {
+	flags := flag.NewFlagSet("promote", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8080", "Address of the standby")
+	force := flags.Bool("force", false, "Promote while the primary still streams its journal")
+	if err := flags.Parse(args); err != nil {
+		log.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	conn, err := grpc.NewClient(
+		*addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close connection: %v", err)
+		}
+	}()
+
+	c := client.NewClient(p.NewMetadataServiceClient(conn))
+	res, err := c.Promote(context.Background(), *force)
+	if err != nil {
+		log.Fatalf("Failed to promote: %v", err)
+	}
+	log.Printf("Promoted, continuing the journal after entry %d", res.Seq)
+}
@@ -0,0 +1,195 @@
+// Entry point for the metadata benchmark, measuring the throughput of
+// metadata requests while large files are written
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	client "github.com/apolyeti/godfs/internal/metadata/client"
+	"github.com/google/uuid"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// result is what one run of the benchmark measured.
+// ops: metadata requests completed
+// latencies: duration of every metadata request
+// written: bytes written by the writers
+type result struct {
+	ops       int
+	latencies []time.Duration
+	written   int64
+	elapsed   time.Duration
+}
+
+func main() {
+	addrs := flag.String("addrs", "localhost:8080", "Addresses of the metadata services, separated by commas")
+	workers := flag.Int("workers", 8, "Number of clients sending metadata requests")
+	writers := flag.Int("writers", 2, "Number of clients writing large files")
+	size := flag.Int("size", 100<<20, "Size in bytes of every file written, a 100 MB upload by default")
+	duration := flag.Duration("duration", 10*time.Second, "Time every run of the benchmark takes")
+	flag.Parse()
+
+	addresses := strings.Split(*addrs, ",")
+
+	// Every run works in a directory of its own, so runs do not disturb each other
+	dir := "bench-" + uuid.New().String()[:8]
+	c, err := client.Dial(addresses)
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer func() {
+		if err := c.Disconnect(); err != nil {
+			log.Printf("Failed to close connection: %v", err)
+		}
+	}()
+	if _, err := c.Mkdir(context.Background(), dir); err != nil {
+		log.Fatalf("Error creating directory: %v", err)
+	}
+
+	baseline := run(addresses, dir, *workers, 0, *size, *duration)
+	report("metadata only", baseline)
+
+	loaded := run(addresses, dir, *workers, *writers, *size, *duration)
+	report(fmt.Sprintf("with %d writers", *writers), loaded)
+
+	if baseline.ops > 0 {
+		fmt.Printf("throughput during writes: %.1f%% of baseline\n",
+			100*rate(loaded)/rate(baseline))
+	}
+}
+
+// run sends metadata requests from workers clients for duration, while
+// writers clients write files of size bytes over and over.
+func run(addresses []string, dir string, workers, writers, size int, duration time.Duration) result {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		res     result
+		written atomic.Int64
+		wg      sync.WaitGroup
+	)
+
+	data := make([]byte, size)
+	for i := 0; i < writers; i++ {
+		c := connect(addresses, dir)
+		name := fmt.Sprintf("large-%d", i)
+		if _, err := c.CreateFile(ctx, name); err != nil {
+			log.Fatalf("Error creating file: %v", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer disconnect(c)
+			for ctx.Err() == nil {
+				if _, err := c.WriteFile(ctx, name, data); err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Error writing file: %v", err)
+					}
+					continue
+				}
+				written.Add(int64(size))
+			}
+		}()
+	}
+
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		c := connect(addresses, dir)
+		name := fmt.Sprintf("small-%s", uuid.New().String()[:8])
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer disconnect(c)
+
+			var latencies []time.Duration
+			for op := 0; ctx.Err() == nil; op++ {
+				began := time.Now()
+				if err := metadataOp(ctx, c, name, op); err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Error sending metadata request: %v", err)
+					}
+					continue
+				}
+				latencies = append(latencies, time.Since(began))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			res.ops += len(latencies)
+			res.latencies = append(res.latencies, latencies...)
+		}()
+	}
+
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	res.written = written.Load()
+	return res
+}
+
+// metadataOp sends the op-th request of a worker: creating its file,
+// looking it up, listing the directory and removing the file again.
+func metadataOp(ctx context.Context, c *client.Client, name string, op int) error {
+	var err error
+	switch op % 4 {
+	case 0:
+		_, err = c.CreateFile(ctx, name)
+	case 1:
+		_, err = c.Stat(ctx, name)
+	case 2:
+		_, err = c.ListDir(ctx)
+	case 3:
+		_, err = c.Remove(ctx, name)
+	}
+	return err
+}
+
+func connect(addresses []string, dir string) *client.Client {
+	c, err := client.Dial(addresses)
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	if err := c.ChangeDir(dir); err != nil {
+		log.Fatalf("Error changing directory: %v", err)
+	}
+	return c
+}
+
+func disconnect(c *client.Client) {
+	if err := c.Disconnect(); err != nil {
+		log.Printf("Failed to close connection: %v", err)
+	}
+}
+
+// rate returns the metadata requests completed per second.
+func rate(res result) float64 {
+	return float64(res.ops) / res.elapsed.Seconds()
+}
+
+func report(name string, res result) {
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+
+	var p50, p99, max time.Duration
+	if n := len(res.latencies); n > 0 {
+		p50 = res.latencies[n/2]
+		p99 = res.latencies[n*99/100]
+		max = res.latencies[n-1]
+	}
+
+	fmt.Printf("%s: %d ops in %v, %.0f ops/s, p50 %v, p99 %v, max %v",
+		name, res.ops, res.elapsed.Round(time.Millisecond), rate(res), p50, p99, max)
+	if res.written > 0 {
+		fmt.Printf(", %.1f MB/s written", float64(res.written)/(1<<20)/res.elapsed.Seconds())
+	}
+	fmt.Println()
+}
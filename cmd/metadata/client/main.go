@@ -2,34 +2,38 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	client "github.com/apolyeti/godfs/internal/metadata/client"
-	service "github.com/apolyeti/godfs/internal/metadata/genproto"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"log"
+	"strings"
 )
 
 func main() {
-	var conn *grpc.ClientConn
+	addrs := flag.String("addrs", "localhost:8080", "Addresses of the metadata services, separated by commas")
+	table := flag.String("mounts", "", "Mount table of prefix=addresses entries separated by semicolons, instead of -addrs")
+	flag.Parse()
+
+	mounts := []client.Mount{{Prefix: "/", Addresses: strings.Split(*addrs, ",")}}
+	if *table != "" {
+		var err error
+		if mounts, err = client.ParseMounts(*table); err != nil {
+			log.Fatalf("Invalid mount table: %v", err)
+		}
+	}
 
-	conn, err := grpc.NewClient(
-		"localhost:8080",
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
+	// Initialize the client, failing over between the metadata services of every mount
+	c, err := client.NewFederation(mounts)
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
 
 	defer func() {
-		if err := conn.Close(); err != nil {
+		if err := c.Disconnect(); err != nil {
 			log.Fatalf("Failed to close connection: %v", err)
 		}
 	}()
 
-	// Initialize the client
-	c := client.NewClient(service.NewMetadataServiceClient(conn))
-
 	res, err := c.CreateFile(context.Background(), "file1")
 
 	if err != nil {
@@ -3,23 +3,70 @@
 package main
 
 import (
+	"flag"
 	p "github.com/apolyeti/godfs/internal/metadata/genproto"
 	service "github.com/apolyeti/godfs/internal/metadata/service"
+	"github.com/apolyeti/godfs/internal/raft"
+	rp "github.com/apolyeti/godfs/internal/raft/genproto"
 	"google.golang.org/grpc"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 )
 
 func main() {
-	lis, err := net.Listen("tcp", ":8080")
+	cfg := service.DefaultConfig()
+	flag.Int64Var(&cfg.ChunkSize, "chunk-size", cfg.ChunkSize, "Default chunk size in bytes for new files")
+	flag.DurationVar(&cfg.CheckpointInterval, "checkpoint-interval", cfg.CheckpointInterval, "Time between metadata checkpoints")
+	flag.IntVar(&cfg.CheckpointRetain, "checkpoints", cfg.CheckpointRetain, "Number of metadata checkpoints to keep")
+	flag.StringVar(&cfg.Store, "store", cfg.Store, "Metadata store, memory or disk")
+	addr := flag.String("addr", ":8080", "Address to serve on")
+	flag.StringVar(&cfg.RaftID, "raft-id", "", "ID of this replica, to replicate the metadata with raft")
+	flag.StringVar(&cfg.RaftDir, "raft-dir", cfg.RaftDir, "Directory the raft log and snapshots are kept in")
+	servers := flag.String("raft-servers", "", "Replicas of a new group as id=address pairs separated by commas, including this one")
+	flag.StringVar(&cfg.Standby, "standby-of", "", "Address of the primary to follow as a warm standby, in a working directory of its own")
+	flag.DurationVar(&cfg.SuspectTimeout, "suspect-timeout", cfg.SuspectTimeout, "Time without a heartbeat after which no chunks are placed on a data node")
+	flag.DurationVar(&cfg.DeadTimeout, "dead-timeout", cfg.DeadTimeout, "Time without a heartbeat after which a data node is considered dead")
+	flag.DurationVar(&cfg.ReconcileInterval, "reconcile-interval", cfg.ReconcileInterval, "Time between reconciliations of the block reports of the data nodes")
+	legacyNodes := flag.String("data-nodes", "", "Data nodes separated by commas that chunks of files written before data nodes registered are kept on, and new chunks placed on while none has")
+	flag.Parse()
+
+	if *legacyNodes != "" {
+		cfg.LegacyDataNodes = strings.Split(*legacyNodes, ",")
+	}
+
+	if cfg.RaftID != "" && cfg.Standby != "" {
+		log.Fatalf("A replica cannot be a standby as well")
+	}
+
+	if cfg.ChunkSize <= 0 || cfg.ChunkSize > service.MaxChunkSize {
+		log.Fatalf("Chunk size must be between 1 and %d bytes", service.MaxChunkSize)
+	}
+
+	if cfg.CheckpointInterval <= 0 || cfg.CheckpointRetain < 1 {
+		log.Fatalf("Checkpoint interval must be positive and at least one checkpoint kept")
+	}
+
+	if cfg.SuspectTimeout <= 0 || cfg.DeadTimeout < cfg.SuspectTimeout {
+		log.Fatalf("Suspect timeout must be positive and the dead timeout at least as long")
+	}
+
+	if *servers != "" {
+		var err error
+		if cfg.RaftServers, err = raft.ParseServers(*servers); err != nil {
+			log.Fatalf("Invalid raft servers: %v", err)
+		}
+	}
+
+	lis, err := net.Listen("tcp", *addr)
 
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	s := service.NewMetadataService()
+	s := service.NewMetadataService(cfg)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -34,16 +81,21 @@ func main() {
 		}
 	}()
 
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(
+		grpc.MaxRecvMsgSize(service.MaxMsgSize),
+		grpc.MaxSendMsgSize(service.MaxMsgSize),
+	)
 
 	p.RegisterMetadataServiceServer(grpcServer, s)
+	if node := s.RaftNode(); node != nil {
+		rp.RegisterRaftServiceServer(grpcServer, node)
+	}
 
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
 
 	// occasionally log that the server is still running
-	// and also send heartbeats tell metadata service to send heartbeats to data nodes
 
-	log.Printf("Serving on :8080")
+	log.Printf("Serving on %s", *addr)
 }
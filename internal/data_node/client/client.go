@@ -4,7 +4,9 @@ import (
 	ctx "context"
 	dataGrpc "github.com/apolyeti/godfs/internal/data_node/genproto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"log"
 )
 
@@ -89,3 +91,35 @@ func (c *Client) SendHeartbeat() error {
 
 	return nil
 }
+
+func (c *Client) ListChunks() ([]string, error) {
+	req := &dataGrpc.ListChunksRequest{}
+
+	res, err := c.DataNodeClient.ListChunks(ctx.Background(),
+		req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res.ChunkIds, nil
+}
+
+// ScrubStatus returns the progress of the scrubber of the data node and the
+// corrupt chunks it found recently.
+func (c *Client) ScrubStatus() (*dataGrpc.ScrubStatusResponse, error) {
+	req := &dataGrpc.ScrubStatusRequest{}
+
+	return c.DataNodeClient.ScrubStatus(ctx.Background(),
+		req)
+}
+
+// ChunkLost reports whether err, as returned by a data node, means the data
+// node cannot serve the chunk because it is missing or corrupt.
+func ChunkLost(err error) bool {
+	switch status.Code(err) {
+	case codes.NotFound, codes.DataLoss:
+		return true
+	}
+	return false
+}
@@ -2,8 +2,31 @@ package data_node
 
 import (
 	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
-	ErrChunkNotFound = errors.New("chunk not found")
+	ErrChunkNotFound  = &codeError{codes.NotFound, "chunk not found"}
+	ErrChunkTooLarge  = errors.New("chunk too large")
+	ErrChunkCorrupt   = &codeError{codes.DataLoss, "chunk corrupt"}
+	ErrInvalidChunkID = errors.New("invalid chunk ID")
+	ErrInvalidNodeID  = errors.New("invalid data node ID")
+	ErrInvalidLabels  = errors.New("labels must be key=value pairs separated by commas")
+	ErrUnknownCommand = errors.New("unknown data node command")
 )
+
+// codeError is an error that reaches callers with its own status code, so
+// that they can tell a missing chunk from a corrupt one.
+type codeError struct {
+	code codes.Code
+	msg  string
+}
+
+func (e *codeError) Error() string {
+	return e.msg
+}
+
+func (e *codeError) GRPCStatus() *status.Status {
+	return status.New(e.code, e.msg)
+}
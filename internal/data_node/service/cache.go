@@ -0,0 +1,108 @@
+package data_service
+
+import (
+	"container/list"
+	"hash/crc32"
+	"log"
+	"sync"
+)
+
+// chunkCache holds recently used chunks in memory, up to capacity bytes,
+// dropping the least recently used ones to make room. Chunks are read from
+// disk when they are not cached. Cached chunks are checked against the
+// CRC32C they were cached with on every hit, so that memory corruption is
+// never served.
+// entries: chunks by ID, most recently used at the front of order
+// size: total size of the cached chunks
+// hits, misses: lookups that found their chunk cached, or did not
+type chunkCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	entries  map[string]*list.Element
+	order    *list.List
+	hits     uint64
+	misses   uint64
+}
+
+// cacheEntry is a cached chunk and the CRC32C of its data.
+type cacheEntry struct {
+	id   string
+	data []byte
+	crc  uint32
+}
+
+func newChunkCache(capacity int64) *chunkCache {
+	return &chunkCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the chunk with the given ID if it is cached and still matches
+// its checksum. A chunk that does not is dropped, and read from disk again.
+func (c *chunkCache) get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if crc32.Checksum(entry.data, crc32c) != entry.crc {
+		log.Printf("Cached chunk %s does not match its checksum, dropping it", id)
+		c.removeLocked(id)
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return entry.data, true
+}
+
+// put caches a chunk, replacing the cached one with the same ID. Only data
+// that was verified or just written is cached. Chunks larger than the whole
+// cache are not cached.
+func (c *chunkCache) put(id string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(id)
+	if int64(len(data)) > c.capacity {
+		return
+	}
+
+	for c.size+int64(len(data)) > c.capacity {
+		c.removeLocked(c.order.Back().Value.(*cacheEntry).id)
+	}
+	c.entries[id] = c.order.PushFront(&cacheEntry{id: id, data: data, crc: crc32.Checksum(data, crc32c)})
+	c.size += int64(len(data))
+}
+
+// remove drops the chunk with the given ID from the cache.
+func (c *chunkCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(id)
+}
+
+func (c *chunkCache) removeLocked(id string) {
+	e, ok := c.entries[id]
+	if !ok {
+		return
+	}
+	c.order.Remove(e)
+	delete(c.entries, id)
+	c.size -= int64(len(e.Value.(*cacheEntry).data))
+}
+
+// stats returns the number of hits and misses so far, and the size of the
+// cached chunks.
+func (c *chunkCache) stats() (hits, misses uint64, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.size
+}
@@ -0,0 +1,127 @@
+package data_service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	dn "github.com/apolyeti/godfs/internal/data_node"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Every chunk file starts with a header holding the checksums of the chunk:
+//
+//	magic    [4]byte  "GDCK"
+//	version  uint8    chunkVersion
+//	flags    uint8    flagSHA256 if a SHA-256 follows the CRC
+//	crc      uint32   CRC32C of the data, big endian
+//	sha256   [32]byte SHA-256 of the data, if flagSHA256 is set
+//
+// followed by the data of the chunk.
+const (
+	chunkVersion = 1
+	flagSHA256   = 1 << 0
+	// chunkHeaderSize is the size of a header without a SHA-256.
+	chunkHeaderSize = 10
+	// maxChunkHeaderSize is the size of a header with a SHA-256.
+	maxChunkHeaderSize = chunkHeaderSize + sha256.Size
+)
+
+var chunkMagic = []byte("GDCK")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkHeader returns the header of a chunk file holding data, with its
+// SHA-256 if withSHA256 is set.
+func chunkHeader(data []byte, withSHA256 bool) []byte {
+	header := make([]byte, chunkHeaderSize, maxChunkHeaderSize)
+	copy(header, chunkMagic)
+	header[4] = chunkVersion
+	binary.BigEndian.PutUint32(header[6:], crc32.Checksum(data, crc32c))
+
+	if withSHA256 {
+		header[5] |= flagSHA256
+		sum := sha256.Sum256(data)
+		header = append(header, sum[:]...)
+	}
+	return header
+}
+
+// headerSize returns the size of the header at the start of a chunk file,
+// or ErrChunkCorrupt if it does not start with one.
+func headerSize(file []byte) (int, error) {
+	if len(file) < chunkHeaderSize || !bytes.Equal(file[:4], chunkMagic) || file[4] != chunkVersion {
+		return 0, dn.ErrChunkCorrupt
+	}
+	size := chunkHeaderSize
+	if file[5]&flagSHA256 != 0 {
+		size = maxChunkHeaderSize
+	}
+	if len(file) < size {
+		return 0, dn.ErrChunkCorrupt
+	}
+	return size, nil
+}
+
+// verifyChunk returns the data of a chunk file, or ErrChunkCorrupt if it
+// does not match its checksums.
+func verifyChunk(file []byte) ([]byte, error) {
+	size, err := headerSize(file)
+	if err != nil {
+		return nil, err
+	}
+	data := file[size:]
+
+	if crc32.Checksum(data, crc32c) != binary.BigEndian.Uint32(file[6:]) {
+		return nil, dn.ErrChunkCorrupt
+	}
+	if size == maxChunkHeaderSize {
+		sum := sha256.Sum256(data)
+		if !bytes.Equal(sum[:], file[chunkHeaderSize:size]) {
+			return nil, dn.ErrChunkCorrupt
+		}
+	}
+	return data, nil
+}
+
+// readChunkFile reads the chunk file at path and verifies its checksums.
+func readChunkFile(path string) ([]byte, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return verifyChunk(file)
+}
+
+// chunkFileSize returns the size of the data in the chunk file at path,
+// and whether it starts with a header. Chunk files written before checksums
+// were stored do not.
+func chunkFileSize(path string) (int64, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+
+	header := make([]byte, chunkHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, false, err
+	}
+	if n < len(chunkMagic) || !bytes.Equal(header[:len(chunkMagic)], chunkMagic) {
+		return info.Size(), false, nil
+	}
+
+	// A corrupt header is left for reads to report
+	size := info.Size() - chunkHeaderSize
+	if n == chunkHeaderSize && header[5]&flagSHA256 != 0 {
+		size -= sha256.Size
+	}
+	return max(size, 0), true, nil
+}
@@ -0,0 +1,178 @@
+package data_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	dn "github.com/apolyeti/godfs/internal/data_node"
+	p "github.com/apolyeti/godfs/internal/data_node/genproto"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"io/fs"
+	"log"
+)
+
+// commandBacklog is the number of commands waiting to be carried out, beyond
+// which new ones are left for the metadata service to send again.
+const commandBacklog = 1000
+
+// command is a command from the metadata service peer.
+type command struct {
+	peer *metadataPeer
+	*metadata.DataNodeCommand
+}
+
+// receive queues the commands sent by the metadata service on work, skipping
+// those already in progress. Full block reports are requested right away.
+func (d *DataNode) receive(peer *metadataPeer, commands []*metadata.DataNodeCommand, work chan<- command) {
+	for _, cmd := range commands {
+		if peer.active[cmd.Id] {
+			continue
+		}
+
+		if cmd.Kind == metadata.CommandKind_COMMAND_KIND_REPORT {
+			peer.active[cmd.Id] = true
+			peer.reported = nil
+			peer.complete(cmd.Id, nil)
+			continue
+		}
+
+		select {
+		case work <- command{peer: peer, DataNodeCommand: cmd}:
+			peer.active[cmd.Id] = true
+		default:
+			log.Printf("Too many commands waiting, leaving command %d for later", cmd.Id)
+		}
+	}
+}
+
+// runCommands carries out the commands queued on work until it is closed,
+// then closes done. Commands interrupted by Shutdown are not acknowledged,
+// so that they are sent again.
+func (d *DataNode) runCommands(work <-chan command, done chan<- struct{}) {
+	defer close(done)
+	for cmd := range work {
+		finished, err := d.execute(cmd.DataNodeCommand)
+		if !finished {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error carrying out command %d: %v", cmd.Id, err)
+		}
+		cmd.peer.complete(cmd.Id, err)
+	}
+}
+
+// execute carries out a command on each of its chunks, and reports whether
+// it finished before Shutdown.
+func (d *DataNode) execute(cmd *metadata.DataNodeCommand) (bool, error) {
+	var target p.DataNodeServiceClient
+	switch cmd.Kind {
+	case metadata.CommandKind_COMMAND_KIND_DELETE, metadata.CommandKind_COMMAND_KIND_VERIFY:
+	case metadata.CommandKind_COMMAND_KIND_REPLICATE:
+		conn, err := grpc.NewClient(
+			cmd.Target,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		if err != nil {
+			return true, err
+		}
+		defer func() {
+			if err := conn.Close(); err != nil {
+				log.Printf("Failed to close connection: %v", err)
+			}
+		}()
+		target = p.NewDataNodeServiceClient(conn)
+	default:
+		return true, dn.ErrUnknownCommand
+	}
+
+	var errs []error
+	for _, chunkId := range cmd.ChunkIds {
+		select {
+		case <-d.stop:
+			return false, nil
+		default:
+		}
+
+		var err error
+		switch cmd.Kind {
+		case metadata.CommandKind_COMMAND_KIND_DELETE:
+			err = d.deleteChunk(chunkId)
+		case metadata.CommandKind_COMMAND_KIND_REPLICATE:
+			err = d.replicateChunk(chunkId, target)
+		case metadata.CommandKind_COMMAND_KIND_VERIFY:
+			err = d.verifyChunk(chunkId)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", chunkId, err))
+		}
+	}
+	return true, errors.Join(errs...)
+}
+
+// deleteChunk deletes a chunk, which may have been deleted already.
+func (d *DataNode) deleteChunk(chunkId string) error {
+	_, err := d.DeleteChunk(context.Background(), &p.DeleteChunkRequest{ChunkId: chunkId})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// replicateChunk copies a chunk to the data node target.
+func (d *DataNode) replicateChunk(chunkId string, target p.DataNodeServiceClient) error {
+	res, err := d.ReadChunk(context.Background(), &p.ReadChunkRequest{ChunkId: chunkId})
+	if err != nil {
+		return err
+	}
+	_, err = target.WriteChunk(context.Background(), &p.WriteChunkRequest{
+		ChunkId: chunkId,
+		Data:    res.Data,
+	})
+	return err
+}
+
+// verifyChunk checks a chunk against its checksums, bypassing the cache. A
+// corrupt chunk is quarantined and reported like the scrubber does.
+func (d *DataNode) verifyChunk(chunkId string) error {
+	if err := validateChunkID(chunkId); err != nil {
+		return err
+	}
+
+	_, err := readChunkFile(chunkPath(chunkId))
+	if errors.Is(err, dn.ErrChunkCorrupt) {
+		d.scrubber.quarantine(chunkId)
+		d.scrubber.report()
+	}
+	return err
+}
+
+// takeCompleted returns the results of the commands carried out since the
+// last heartbeat.
+func (peer *metadataPeer) takeCompleted() []*metadata.CommandResult {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	completed := peer.completed
+	peer.completed = nil
+	return completed
+}
+
+// putCompleted keeps results for the next heartbeat after one failed.
+func (peer *metadataPeer) putCompleted(completed []*metadata.CommandResult) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.completed = append(completed, peer.completed...)
+}
+
+func (peer *metadataPeer) complete(id uint64, err error) {
+	result := &metadata.CommandResult{Id: id}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.completed = append(peer.completed, result)
+}
@@ -0,0 +1,96 @@
+package data_service
+
+import (
+	dn "github.com/apolyeti/godfs/internal/data_node"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultCacheSize is the memory in bytes chunks are cached in when none
+	// is configured.
+	DefaultCacheSize = 256 * 1024 * 1024
+	// DefaultScrubRate is the number of bytes per second the scrubber reads.
+	DefaultScrubRate = 8 * 1024 * 1024
+	// DefaultScrubInterval is the time between the starts of scrub passes.
+	DefaultScrubInterval = 24 * time.Hour
+	// DefaultHeartbeatInterval is the time between heartbeats to the
+	// metadata services.
+	DefaultHeartbeatInterval = 3 * time.Second
+	// DefaultBlockReportInterval is the time between incremental block
+	// reports to the metadata services.
+	DefaultBlockReportInterval = 10 * time.Second
+)
+
+// Config holds the settings of a data node.
+// Address: Address the data node serves chunks on, registered with the metadata services
+// Capacity: Bytes the data node may store, 0 if unlimited
+// Labels: Labels registered with the metadata services, such as the rack of the data node
+// CacheSize: Memory in bytes recently used chunks are cached in, 0 to read every chunk from disk
+// SHA256: Store and verify a SHA-256 of every chunk written, in addition to its CRC32C
+// ScrubRate: Bytes per second the scrubber verifies, 0 to disable scrubbing
+// ScrubInterval: Time between the starts of scrub passes
+// Metadata: Addresses of the metadata services to register with and report corrupt chunks to, empty to run on its own
+// HeartbeatInterval: Time between heartbeats to the metadata services
+// BlockReportInterval: Time between incremental block reports to the metadata services
+type Config struct {
+	Address       string
+	Capacity      int64
+	Labels        map[string]string
+	CacheSize     int64
+	SHA256        bool
+	ScrubRate     int64
+	ScrubInterval time.Duration
+	Metadata      []string
+
+	HeartbeatInterval   time.Duration
+	BlockReportInterval time.Duration
+}
+
+// DefaultConfig returns the configuration used when no flags are given.
+func DefaultConfig() Config {
+	return Config{
+		CacheSize:     DefaultCacheSize,
+		ScrubRate:     DefaultScrubRate,
+		ScrubInterval: DefaultScrubInterval,
+
+		HeartbeatInterval:   DefaultHeartbeatInterval,
+		BlockReportInterval: DefaultBlockReportInterval,
+	}
+}
+
+// withDefaults replaces the settings that are out of range with defaults.
+func (cfg Config) withDefaults() Config {
+	if cfg.CacheSize < 0 {
+		cfg.CacheSize = DefaultCacheSize
+	}
+	if cfg.ScrubRate < 0 {
+		cfg.ScrubRate = DefaultScrubRate
+	}
+	if cfg.ScrubInterval <= 0 {
+		cfg.ScrubInterval = DefaultScrubInterval
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if cfg.BlockReportInterval <= 0 {
+		cfg.BlockReportInterval = DefaultBlockReportInterval
+	}
+	return cfg
+}
+
+// ParseLabels parses labels given as key=value pairs separated by commas.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if s == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, dn.ErrInvalidLabels
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
@@ -5,35 +5,204 @@ package data_service
 
 import (
 	"context"
+	"errors"
+	dn "github.com/apolyeti/godfs/internal/data_node"
 	p "github.com/apolyeti/godfs/internal/data_node/genproto"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
-const chunkSize = 4 * 1024 * 1024
+// MaxChunkSize is the largest chunk a data node accepts.
+// Chunk sizes themselves are chosen per file by the metadata service.
+const MaxChunkSize = 64 * 1024 * 1024
 const chunkDir = ".storage/chunks/"
 
+// checksumMarker exists once the chunks stored before checksums were have
+// been given a header. From then on, a chunk without one is corrupt.
+const checksumMarker = ".storage/checksummed"
+
+// tmpDir holds chunks being written, which are renamed into chunkDir once
+// complete, so a crash never leaves a partial chunk behind in chunkDir.
+const tmpDir = ".storage/tmp/"
+
 // DataNode represents a node that stores file data chunks.
 type DataNode struct {
 	p.UnimplementedDataNodeServiceServer
-	// ID of the data node, generated by the metadata service to
+	// ID of the data node, generated on its first start and kept in nodeIDFile
 	// Keep track of which data nodes have which chunks
 	// This ID will be used by the metadata service to determine which data nodes to send read requests to
 	ID string
-	// Map of chunk IDs to chunk data
+	// Address the data node serves chunks on, as registered with the metadata service
+	Address string
+	// capacity, labels: what the data node registers with besides its address
+	capacity int64
+	labels   map[string]string
+	// metadata: addresses of the metadata services the data node registers with
+	metadata []string
+	// heartbeatInterval: time between heartbeats to the metadata services
+	// blockReportInterval: time between incremental block reports
+	heartbeatInterval   time.Duration
+	blockReportInterval time.Duration
+	// stop, done: stop the heartbeat loop, and tell it stopped
+	stop chan struct{}
+	done chan struct{}
+	// Chunks are stored on disk, cache holds the recently used ones in memory.
 	// For context, the chunk ID for files would be stored in the metadata service
 	// When the client wants to read a file, it would get the chunk IDs from the metadata service
 	// From there, it would request the chunk data from the data nodes
-	Chunks map[string][]byte
+	cache *chunkCache
+	// sha256 stores a SHA-256 of every chunk written next to its CRC32C
+	sha256 bool
+	// scrubber verifies stored chunks in the background
+	scrubber *scrubber
+
+	// mu guards index
+	mu sync.RWMutex
+	// index maps the ID of every chunk stored in chunkDir to its size,
+	// including chunks written before the data node was last started
+	index map[string]int64
 }
 
-// NewDataNode creates a new DataNode
-func NewDataNode(id string) *DataNode {
-	return &DataNode{
-		ID:     id,
-		Chunks: make(map[string][]byte),
+// NewDataNode creates a new DataNode, serving the chunks already stored in
+// its chunk directory.
+func NewDataNode(cfg Config) (*DataNode, error) {
+	cfg = cfg.withDefaults()
+	id, err := loadNodeID()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DataNode{
+		ID:       id,
+		Address:  cfg.Address,
+		capacity: cfg.Capacity,
+		labels:   cfg.Labels,
+		metadata: cfg.Metadata,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		cache:    newChunkCache(cfg.CacheSize),
+		sha256:   cfg.SHA256,
+		index:    make(map[string]int64),
+
+		heartbeatInterval:   cfg.HeartbeatInterval,
+		blockReportInterval: cfg.BlockReportInterval,
+	}
+
+	if err := d.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	if len(d.metadata) > 0 {
+		go d.heartbeatLoop()
+	} else {
+		close(d.done)
+	}
+
+	d.scrubber = newScrubber(d, cfg)
+	if d.scrubber.enabled() {
+		go d.scrubber.run()
 	}
+	return d, nil
+}
+
+// Shutdown stops the background work of the data node.
+func (d *DataNode) Shutdown() {
+	close(d.stop)
+	<-d.done
+	d.scrubber.close()
 }
+
+// loadIndex scans chunkDir for the chunks stored on disk, and removes the
+// partial chunks left in tmpDir by writes that did not complete. Chunks
+// stored before checksums were are given a header on the first start that
+// finds them, and quarantined if found on a later one.
+func (d *DataNode) loadIndex() error {
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+
+	_, err := os.Stat(checksumMarker)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	checksummed := err == nil
+
+	err = migrateFlatLayout()
+	if errors.Is(err, fs.ErrNotExist) {
+		// A new data node has no chunks from before checksums were stored
+		if !checksummed {
+			return markChecksummed()
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(chunkDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		chunkId := entry.Name()
+		if validateChunkID(chunkId) != nil || path != chunkPath(chunkId) {
+			log.Printf("Ignoring %s, not a chunk", path)
+			return nil
+		}
+
+		size, ok, err := chunkFileSize(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !ok && checksummed:
+			// Its header was damaged, rewriting it would hide that
+			if err := quarantineChunk(chunkId); err != nil {
+				return err
+			}
+			log.Printf("Chunk %s has no header, moved to %s", chunkId, quarantineDir)
+			return nil
+		case !ok:
+			if err := d.addChecksums(chunkId); err != nil {
+				return err
+			}
+		}
+		d.index[chunkId] = size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Loaded %d chunks from %s", len(d.index), chunkDir)
+	if !checksummed {
+		return markChecksummed()
+	}
+	return nil
+}
+
+// markChecksummed creates checksumMarker.
+func markChecksummed() error {
+	if err := os.MkdirAll(filepath.Dir(checksumMarker), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(checksumMarker, nil, 0644)
+}
+
+// addChecksums rewrites a chunk stored before checksums were, with a header
+// holding the checksums of its data as it is now.
+func (d *DataNode) addChecksums(chunkId string) error {
+	data, err := os.ReadFile(chunkPath(chunkId))
+	if err != nil {
+		return err
+	}
+	log.Printf("Adding checksums to chunk %s", chunkId)
+	return d.writeChunkFile(chunkId, data)
+}
+
 func (d *DataNode) WriteChunk(
 	ctx context.Context,
 	req *p.WriteChunkRequest,
@@ -41,29 +210,61 @@ func (d *DataNode) WriteChunk(
 	*p.WriteChunkResponse, error,
 ) {
 
-	log.Printf("WRITECHUNK\t%v", req)
-	err := os.MkdirAll(chunkDir, os.ModePerm)
-	if err != nil {
+	log.Printf("WRITECHUNK\tchunk_id:%q data:%d", req.ChunkId, len(req.Data))
+	if err := validateChunkID(req.ChunkId); err != nil {
 		return nil, err
 	}
+	if len(req.Data) > MaxChunkSize {
+		return nil, dn.ErrChunkTooLarge
+	}
 
-	file, err := os.Create(chunkDir + req.ChunkId)
-	if err != nil {
+	if err := d.writeChunkFile(req.ChunkId, req.Data); err != nil {
 		return nil, err
 	}
 
-	_, err = file.Write(req.Data)
-	if err != nil {
-		return nil, err
+	d.cache.put(req.ChunkId, req.Data)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.index[req.ChunkId] = int64(len(req.Data))
+	return &p.WriteChunkResponse{}, nil
+}
+
+// writeChunkFile stores a chunk in chunkDir, after a header holding its
+// checksums. It is written to tmpDir and synced first, so the chunk is
+// either stored whole or not at all.
+func (d *DataNode) writeChunkFile(chunkId string, data []byte) error {
+	path := chunkPath(chunkId)
+	for _, dir := range []string{filepath.Dir(path), tmpDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
 	}
 
-	err = file.Close()
+	file, err := os.CreateTemp(tmpDir, "chunk-")
 	if err != nil {
-		return nil, err
+		return err
 	}
+	tmp := file.Name()
 
-	d.Chunks[req.ChunkId] = req.Data
-	return &p.WriteChunkResponse{}, nil
+	_, err = file.Write(chunkHeader(data, d.sha256))
+	if err == nil {
+		_, err = file.Write(data)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
 }
 
 func (d *DataNode) ReadChunk(
@@ -73,11 +274,35 @@ func (d *DataNode) ReadChunk(
 	*p.ReadChunkResponse, error,
 ) {
 	log.Printf("READCHUNK\t%v", req)
-	data, ok := d.Chunks[req.ChunkId]
+	if err := validateChunkID(req.ChunkId); err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	_, ok := d.index[req.ChunkId]
+	d.mu.RUnlock()
+
 	if !ok {
-		return nil, os.ErrNotExist
+		return nil, dn.ErrChunkNotFound
+	}
+
+	if data, ok := d.cache.get(req.ChunkId); ok {
+		return &p.ReadChunkResponse{Data: data}, nil
 	}
 
+	data, err := readChunkFile(chunkPath(req.ChunkId))
+	if errors.Is(err, dn.ErrChunkCorrupt) {
+		log.Printf("Chunk %s does not match its checksums", req.ChunkId)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// Deleted since it was looked up
+		return nil, dn.ErrChunkNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.cache.put(req.ChunkId, data)
+
 	return &p.ReadChunkResponse{Data: data}, nil
 }
 
@@ -88,12 +313,20 @@ func (d *DataNode) DeleteChunk(
 	*p.DeleteChunkResponse, error,
 ) {
 	log.Printf("DELETECHUNK\t%v", req)
-	err := os.Remove(chunkDir + req.ChunkId)
+	if err := validateChunkID(req.ChunkId); err != nil {
+		return nil, err
+	}
+
+	err := os.Remove(chunkPath(req.ChunkId))
 	if err != nil {
 		return nil, err
 	}
 
-	delete(d.Chunks, req.ChunkId)
+	d.cache.remove(req.ChunkId)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.index, req.ChunkId)
 	return &p.DeleteChunkResponse{}, nil
 }
 
@@ -106,3 +339,44 @@ func (d *DataNode) SendHeartbeat(
 	log.Printf("SENDHEARTBEAT\t%v", req)
 	return &p.HeartbeatResponse{}, nil
 }
+
+// ListChunks reports the IDs of every chunk held by the data node.
+func (d *DataNode) ListChunks(
+	ctx context.Context,
+	req *p.ListChunksRequest,
+) (
+	*p.ListChunksResponse, error,
+) {
+	log.Printf("LISTCHUNKS\t%v", req)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	chunkIDs := make([]string, 0, len(d.index))
+	for id := range d.index {
+		chunkIDs = append(chunkIDs, id)
+	}
+
+	return &p.ListChunksResponse{ChunkIds: chunkIDs}, nil
+}
+
+// Stats reports the number of chunks held by the data node and how well
+// its chunk cache serves reads.
+func (d *DataNode) Stats(
+	ctx context.Context,
+	req *p.StatsRequest,
+) (
+	*p.StatsResponse, error,
+) {
+	log.Printf("STATS\t%v", req)
+	d.mu.RLock()
+	chunks := len(d.index)
+	d.mu.RUnlock()
+
+	hits, misses, size := d.cache.stats()
+	return &p.StatsResponse{
+		Chunks:        int64(chunks),
+		CacheHits:     hits,
+		CacheMisses:   misses,
+		CacheBytes:    size,
+		CacheCapacity: d.cache.capacity,
+	}, nil
+}
@@ -0,0 +1,103 @@
+package data_service
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// inTempDir runs the test in a new directory, as the data node keeps its
+// chunks under the working directory.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatalf("Chdir: %v", err)
+		}
+	})
+}
+
+func writeRawChunk(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+// TestLoadIndexChecksums checks that chunks stored before checksums were are
+// given a header on the first start only, and that a chunk found without a
+// header later is quarantined rather than given a new one.
+func TestLoadIndexChecksums(t *testing.T) {
+	inTempDir(t)
+
+	legacy := []byte("stored before checksums")
+	writeRawChunk(t, chunkPath("legacy"), legacy)
+
+	d := &DataNode{index: make(map[string]int64)}
+	if err := d.loadIndex(); err != nil {
+		t.Fatalf("loadIndex: %v", err)
+	}
+	if d.index["legacy"] != int64(len(legacy)) {
+		t.Fatalf("index = %v, want legacy of size %d", d.index, len(legacy))
+	}
+	data, err := readChunkFile(chunkPath("legacy"))
+	if err != nil || !bytes.Equal(data, legacy) {
+		t.Fatalf("readChunkFile = %q, %v, want %q", data, err, legacy)
+	}
+	if _, err := os.Stat(checksumMarker); err != nil {
+		t.Fatalf("Stat(%s): %v", checksumMarker, err)
+	}
+
+	// A chunk whose magic was damaged no longer looks like it has a header
+	file, err := os.ReadFile(chunkPath("legacy"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	file[0] ^= 0xff
+	writeRawChunk(t, chunkPath("legacy"), file)
+
+	d = &DataNode{index: make(map[string]int64)}
+	if err := d.loadIndex(); err != nil {
+		t.Fatalf("loadIndex: %v", err)
+	}
+	if _, ok := d.index["legacy"]; ok {
+		t.Fatalf("Chunk with a damaged header was indexed")
+	}
+	if _, err := os.Stat(chunkPath("legacy")); !os.IsNotExist(err) {
+		t.Fatalf("Stat = %v, want the chunk moved out of %s", err, chunkDir)
+	}
+	quarantined, err := os.ReadFile(quarantineDir + "legacy")
+	if err != nil || !bytes.Equal(quarantined, file) {
+		t.Fatalf("Quarantined chunk = %q, %v, want it unchanged", quarantined, err)
+	}
+}
+
+// TestChunkCacheVerify checks that a cached chunk that no longer matches its
+// checksum is not served.
+func TestChunkCacheVerify(t *testing.T) {
+	c := newChunkCache(1024)
+	c.put("chunk", []byte("data"))
+
+	if data, ok := c.get("chunk"); !ok || string(data) != "data" {
+		t.Fatalf("get = %q, %v, want data", data, ok)
+	}
+
+	c.entries["chunk"].Value.(*cacheEntry).data[0] = 'x'
+	if data, ok := c.get("chunk"); ok {
+		t.Fatalf("get = %q, want the damaged chunk dropped", data)
+	}
+	if _, _, size := c.stats(); size != 0 {
+		t.Fatalf("size = %d, want 0", size)
+	}
+}
@@ -0,0 +1,73 @@
+package data_service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	dn "github.com/apolyeti/godfs/internal/data_node"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// maxChunkIDLength is the longest chunk ID accepted, short enough to be a
+// file name on any file system.
+const maxChunkIDLength = 200
+
+// validateChunkID returns ErrInvalidChunkID unless id only holds letters,
+// digits, '-' and '_', so that it can only ever name a file in chunkDir.
+func validateChunkID(id string) error {
+	if len(id) == 0 || len(id) > maxChunkIDLength {
+		return dn.ErrInvalidChunkID
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return dn.ErrInvalidChunkID
+		}
+	}
+	return nil
+}
+
+// chunkPath returns the path of the file a chunk is stored in. Chunks are
+// spread over two levels of directories named after the hash of their ID,
+// such as ab/cd/<id>, so that no directory grows too large.
+func chunkPath(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	h := hex.EncodeToString(sum[:2])
+	return filepath.Join(chunkDir, h[:2], h[2:], id)
+}
+
+// migrateFlatLayout moves the chunks stored in chunkDir itself, from before
+// chunks were spread over directories, to their place in the layout.
+func migrateFlatLayout() error {
+	entries, err := os.ReadDir(chunkDir)
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		// Files that are not chunks are left alone, loadIndex reports them
+		if validateChunkID(entry.Name()) != nil {
+			continue
+		}
+
+		path := chunkPath(entry.Name())
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(chunkDir, entry.Name()), path); err != nil {
+			return err
+		}
+		moved++
+	}
+
+	if moved > 0 {
+		log.Printf("Moved %d chunks from %s into its subdirectories", moved, chunkDir)
+	}
+	return nil
+}
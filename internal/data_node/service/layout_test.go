@@ -0,0 +1,87 @@
+package data_service
+
+import (
+	dn "github.com/apolyeti/godfs/internal/data_node"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateChunkID(t *testing.T) {
+	tests := []struct {
+		id  string
+		err error
+	}{
+		{id: "inode-write-0", err: nil},
+		{id: "A_z-09", err: nil},
+		{id: strings.Repeat("a", maxChunkIDLength), err: nil},
+		{id: "", err: dn.ErrInvalidChunkID},
+		{id: strings.Repeat("a", maxChunkIDLength+1), err: dn.ErrInvalidChunkID},
+		{id: ".", err: dn.ErrInvalidChunkID},
+		{id: "..", err: dn.ErrInvalidChunkID},
+		{id: "../chunk", err: dn.ErrInvalidChunkID},
+		{id: "ab/cd", err: dn.ErrInvalidChunkID},
+		{id: "/chunk", err: dn.ErrInvalidChunkID},
+		{id: `ab\cd`, err: dn.ErrInvalidChunkID},
+		{id: "chunk.tmp", err: dn.ErrInvalidChunkID},
+		{id: "chunk\x00", err: dn.ErrInvalidChunkID},
+		{id: "chünk", err: dn.ErrInvalidChunkID},
+	}
+	for _, tt := range tests {
+		if err := validateChunkID(tt.id); err != tt.err {
+			t.Errorf("validateChunkID(%q) = %v, want %v", tt.id, err, tt.err)
+		}
+	}
+}
+
+// TestMigrateFlatLayout checks that chunks stored in chunkDir itself are
+// moved into the layout, including when a migration was interrupted and
+// some of them already were, and that other files are left alone.
+func TestMigrateFlatLayout(t *testing.T) {
+	inTempDir(t)
+
+	chunks := map[string]string{
+		"flat-0":  "first",
+		"flat-1":  "second",
+		"moved-0": "already moved",
+	}
+	for id, data := range chunks {
+		path := filepath.Join(chunkDir, id)
+		if strings.HasPrefix(id, "moved") {
+			// Moved by the interrupted migration
+			path = chunkPath(id)
+		}
+		writeRawChunk(t, path, []byte(data))
+	}
+	// The interrupted migration created the directory of the next chunk
+	if err := os.MkdirAll(filepath.Dir(chunkPath("flat-1")), os.ModePerm); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	writeRawChunk(t, filepath.Join(chunkDir, "notes.txt"), []byte("not a chunk"))
+
+	for run := 0; run < 2; run++ {
+		if err := migrateFlatLayout(); err != nil {
+			t.Fatalf("migrateFlatLayout: %v", err)
+		}
+		for id, want := range chunks {
+			data, err := os.ReadFile(chunkPath(id))
+			if err != nil || string(data) != want {
+				t.Errorf("Chunk %s = %q, %v, want %q", id, data, err, want)
+			}
+			if _, err := os.Stat(filepath.Join(chunkDir, id)); !os.IsNotExist(err) {
+				t.Errorf("Stat = %v, want chunk %s gone from %s", err, id, chunkDir)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(chunkDir, "notes.txt")); err != nil {
+			t.Errorf("File that is not a chunk was moved: %v", err)
+		}
+	}
+}
+
+func TestMigrateFlatLayoutNoChunkDir(t *testing.T) {
+	inTempDir(t)
+	if err := migrateFlatLayout(); !os.IsNotExist(err) {
+		t.Fatalf("migrateFlatLayout = %v, want a missing directory reported", err)
+	}
+}
@@ -0,0 +1,190 @@
+package data_service
+
+import (
+	"context"
+	"errors"
+	dn "github.com/apolyeti/godfs/internal/data_node"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// nodeIDFile holds the ID of the data node, kept across restarts.
+	nodeIDFile = ".storage/node_id"
+	// metadataTimeout is the time a metadata service has to answer a
+	// registration or heartbeat.
+	metadataTimeout = 2 * time.Second
+)
+
+// loadNodeID returns the ID of the data node, generating it on first start.
+func loadNodeID() (string, error) {
+	data, err := os.ReadFile(nodeIDFile)
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		if _, err := uuid.Parse(id); err != nil {
+			return "", dn.ErrInvalidNodeID
+		}
+		return id, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	id := uuid.New().String()
+	if err := os.MkdirAll(filepath.Dir(nodeIDFile), os.ModePerm); err != nil {
+		return "", err
+	}
+	tmp := nodeIDFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(id+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, nodeIDFile); err != nil {
+		return "", err
+	}
+
+	log.Printf("Generated data node ID %s", id)
+	return id, nil
+}
+
+// metadataPeer is a metadata service the data node sends heartbeats to.
+// registered: whether the data node registered with it since it last
+// answered that it does not know the data node
+// reported: chunks held as of the last block report, nil until a full report
+// was sent since registering
+// lastReport: time of the last block report
+// active: commands received and not acknowledged yet, so that commands sent
+// again while still in progress are carried out once
+// completed: results of the commands carried out since the last heartbeat,
+// guarded by mu
+type metadataPeer struct {
+	address    string
+	conn       *grpc.ClientConn
+	client     metadata.MetadataServiceClient
+	registered bool
+	reported   map[string]bool
+	lastReport time.Time
+	active     map[uint64]bool
+
+	mu        sync.Mutex
+	completed []*metadata.CommandResult
+}
+
+// heartbeatLoop registers the data node with every metadata service, replicas
+// and standbys alike as each keeps its own set of data nodes, then sends them
+// heartbeats and block reports until Shutdown. The commands they send back
+// are carried out one at a time in the background.
+func (d *DataNode) heartbeatLoop() {
+	defer close(d.done)
+
+	work := make(chan command, commandBacklog)
+	workDone := make(chan struct{})
+	go d.runCommands(work, workDone)
+	defer func() {
+		close(work)
+		<-workDone
+	}()
+
+	var peers []*metadataPeer
+	for _, address := range d.metadata {
+		conn, err := grpc.NewClient(
+			address,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		if err != nil {
+			log.Printf("Invalid metadata service address %s: %v", address, err)
+			continue
+		}
+		peers = append(peers, &metadataPeer{
+			address: address,
+			conn:    conn,
+			client:  metadata.NewMetadataServiceClient(conn),
+			active:  make(map[uint64]bool),
+		})
+	}
+	defer func() {
+		for _, peer := range peers {
+			if err := peer.conn.Close(); err != nil {
+				log.Printf("Failed to close connection: %v", err)
+			}
+		}
+	}()
+
+	for {
+		for _, peer := range peers {
+			d.heartbeat(peer, work)
+			d.blockReport(peer)
+		}
+
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(d.heartbeatInterval):
+		}
+	}
+}
+
+// heartbeat sends a heartbeat to the metadata service, registering first if
+// it does not know the data node, such as after it restarted. The commands
+// in the response are queued on work.
+func (d *DataNode) heartbeat(peer *metadataPeer, work chan<- command) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+
+	if peer.registered {
+		completed := peer.takeCompleted()
+		res, err := peer.client.Heartbeat(ctx, &metadata.HeartbeatRequest{
+			NodeId:    d.ID,
+			Used:      d.used(),
+			Completed: completed,
+		})
+		if err != nil {
+			log.Printf("Error sending heartbeat to %s: %v", peer.address, err)
+			peer.putCompleted(completed)
+			return
+		}
+		for _, result := range completed {
+			delete(peer.active, result.Id)
+		}
+		if !res.Register {
+			d.receive(peer, res.Commands, work)
+			return
+		}
+		log.Printf("Metadata service at %s does not know the data node, registering again", peer.address)
+		peer.registered = false
+	}
+
+	_, err := peer.client.Register(ctx, &metadata.RegisterRequest{
+		NodeId:   d.ID,
+		Address:  d.Address,
+		Capacity: d.capacity,
+		Used:     d.used(),
+		Labels:   d.labels,
+	})
+	if err != nil {
+		log.Printf("Error registering with the metadata service at %s: %v", peer.address, err)
+		return
+	}
+	peer.registered = true
+	peer.reported = nil
+}
+
+// used returns the number of bytes of the stored chunks.
+func (d *DataNode) used() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var used int64
+	for _, size := range d.index {
+		used += size
+	}
+	return used
+}
@@ -0,0 +1,124 @@
+package data_service
+
+import (
+	"context"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"log"
+	"time"
+)
+
+// maxReportChunks is the number of chunk IDs sent in a single block report
+// request, keeping requests well below the message size limit.
+const maxReportChunks = 10000
+
+// blockReport sends a block report to the metadata service if one is due: a
+// full report if it has none since the data node registered, otherwise the
+// chunks added and removed since the last report, every blockReportInterval.
+func (d *DataNode) blockReport(peer *metadataPeer) {
+	if !peer.registered {
+		return
+	}
+	if peer.reported != nil && time.Since(peer.lastReport) < d.blockReportInterval {
+		return
+	}
+
+	var err error
+	if peer.reported == nil {
+		err = d.fullReport(peer)
+	} else {
+		err = d.incrementalReport(peer)
+	}
+	if err != nil {
+		log.Printf("Error sending block report to %s: %v", peer.address, err)
+		return
+	}
+	peer.lastReport = time.Now()
+}
+
+// fullReport reports every chunk held to the metadata service, split into
+// parts of maxReportChunks.
+func (d *DataNode) fullReport(peer *metadataPeer) error {
+	chunkIDs := d.chunkIDs()
+	held := heldChunks(chunkIDs)
+
+	for part := uint32(0); ; part++ {
+		n := min(len(chunkIDs), maxReportChunks)
+		_, err := d.sendReport(peer, &metadata.BlockReportRequest{
+			NodeId: d.ID,
+			Full:   true,
+			Part:   part,
+			More:   n < len(chunkIDs),
+			Added:  chunkIDs[:n],
+		})
+		if err != nil {
+			return err
+		}
+
+		chunkIDs = chunkIDs[n:]
+		if len(chunkIDs) == 0 {
+			break
+		}
+	}
+
+	peer.reported = held
+	return nil
+}
+
+// incrementalReport reports the chunks added and removed since the last
+// report to the metadata service, falling back to a full report if it asks
+// for one.
+func (d *DataNode) incrementalReport(peer *metadataPeer) error {
+	held := heldChunks(d.chunkIDs())
+	var added, removed []string
+	for chunkId := range held {
+		if !peer.reported[chunkId] {
+			added = append(added, chunkId)
+		}
+	}
+	for chunkId := range peer.reported {
+		if !held[chunkId] {
+			removed = append(removed, chunkId)
+		}
+	}
+
+	for len(added) > 0 || len(removed) > 0 {
+		nAdded := min(len(added), maxReportChunks)
+		nRemoved := min(len(removed), maxReportChunks-nAdded)
+		res, err := d.sendReport(peer, &metadata.BlockReportRequest{
+			NodeId:  d.ID,
+			Added:   added[:nAdded],
+			Removed: removed[:nRemoved],
+		})
+		if err != nil {
+			return err
+		}
+		if res.FullReport {
+			peer.reported = nil
+			return d.fullReport(peer)
+		}
+
+		for _, chunkId := range added[:nAdded] {
+			peer.reported[chunkId] = true
+		}
+		for _, chunkId := range removed[:nRemoved] {
+			delete(peer.reported, chunkId)
+		}
+		added = added[nAdded:]
+		removed = removed[nRemoved:]
+	}
+	return nil
+}
+
+func heldChunks(chunkIDs []string) map[string]bool {
+	held := make(map[string]bool, len(chunkIDs))
+	for _, chunkId := range chunkIDs {
+		held[chunkId] = true
+	}
+	return held
+}
+
+func (d *DataNode) sendReport(peer *metadataPeer, req *metadata.BlockReportRequest) (*metadata.BlockReportResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	return peer.client.BlockReport(ctx, req)
+}
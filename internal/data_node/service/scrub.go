@@ -0,0 +1,315 @@
+package data_service
+
+import (
+	"context"
+	"errors"
+	dn "github.com/apolyeti/godfs/internal/data_node"
+	p "github.com/apolyeti/godfs/internal/data_node/genproto"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// quarantineDir holds the chunks the scrubber found corrupt, kept for
+	// inspection but no longer served.
+	quarantineDir = ".storage/quarantine/"
+	// maxScrubFindings is the number of recent findings kept for ScrubStatus.
+	maxScrubFindings = 100
+)
+
+// scrubber verifies the checksums of every stored chunk in the background,
+// reading at most rate bytes per second, and starting a pass every interval.
+// Corrupt chunks are moved to quarantineDir and reported to the metadata
+// service, which restores them from a healthy copy if it finds one.
+// unreported: chunks not reported to the metadata service yet
+// reporting: serializes reports, which verify commands send as well
+type scrubber struct {
+	d        *DataNode
+	rate     int64
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+
+	reporting sync.Mutex
+
+	mu                sync.Mutex
+	running           bool
+	passes            uint64
+	passStarted       time.Time
+	lastPassCompleted time.Time
+	chunksScanned     uint64
+	chunksTotal       uint64
+	bytesScanned      uint64
+	corrupt           uint64
+	findings          []*p.ScrubFinding
+	unreported        []string
+}
+
+func newScrubber(d *DataNode, cfg Config) *scrubber {
+	return &scrubber{
+		d:        d,
+		rate:     cfg.ScrubRate,
+		interval: cfg.ScrubInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *scrubber) enabled() bool {
+	return s.rate > 0
+}
+
+func (s *scrubber) run() {
+	defer close(s.done)
+	for {
+		s.pass()
+		s.report()
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+func (s *scrubber) close() {
+	if !s.enabled() {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+// pass verifies every chunk stored when it starts.
+func (s *scrubber) pass() {
+	chunkIDs := s.d.chunkIDs()
+
+	s.mu.Lock()
+	s.running = true
+	s.passStarted = time.Now()
+	s.chunksScanned = 0
+	s.chunksTotal = uint64(len(chunkIDs))
+	s.bytesScanned = 0
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running = false
+		s.passes++
+		s.lastPassCompleted = time.Now()
+	}()
+
+	for _, chunkId := range chunkIDs {
+		data, err := readChunkFile(chunkPath(chunkId))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// Deleted since the pass started
+		case errors.Is(err, dn.ErrChunkCorrupt):
+			s.quarantine(chunkId)
+		case err != nil:
+			log.Printf("Error scrubbing chunk %s: %v", chunkId, err)
+		}
+
+		s.mu.Lock()
+		s.chunksScanned++
+		s.bytesScanned += uint64(len(data))
+		s.mu.Unlock()
+
+		// Keep to the rate, so that the scrubber does not starve reads
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(time.Duration(float64(len(data)) / float64(s.rate) * float64(time.Second))):
+		}
+	}
+}
+
+// quarantine moves a corrupt chunk out of chunkDir, so that it is no longer
+// served, unless it was rewritten since it was read.
+func (s *scrubber) quarantine(chunkId string) {
+	d := s.d
+	d.mu.Lock()
+	if _, err := readChunkFile(chunkPath(chunkId)); !errors.Is(err, dn.ErrChunkCorrupt) {
+		d.mu.Unlock()
+		return
+	}
+
+	err := quarantineChunk(chunkId)
+	if err == nil {
+		delete(d.index, chunkId)
+	}
+	d.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Error quarantining corrupt chunk %s: %v", chunkId, err)
+		return
+	}
+	d.cache.remove(chunkId)
+	log.Printf("Chunk %s does not match its checksums, moved to %s", chunkId, quarantineDir)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.corrupt++
+	s.findings = append(s.findings, &p.ScrubFinding{
+		ChunkId: chunkId,
+		Detail:  dn.ErrChunkCorrupt.Error(),
+		FoundAt: time.Now().UnixNano(),
+	})
+	if len(s.findings) > maxScrubFindings {
+		s.findings = s.findings[len(s.findings)-maxScrubFindings:]
+	}
+	s.unreported = append(s.unreported, chunkId)
+}
+
+// quarantineChunk moves a chunk from chunkDir to quarantineDir.
+func quarantineChunk(chunkId string) error {
+	if err := os.MkdirAll(quarantineDir, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(chunkPath(chunkId), quarantineDir+chunkId)
+}
+
+// report tells the metadata service about the chunks quarantined since the
+// last report. They are reported again after the next pass if it fails.
+func (s *scrubber) report() {
+	s.reporting.Lock()
+	defer s.reporting.Unlock()
+
+	s.mu.Lock()
+	chunkIDs := s.unreported
+	s.mu.Unlock()
+
+	if len(s.d.metadata) == 0 || len(chunkIDs) == 0 {
+		return
+	}
+
+	// Any of the metadata services will do, they share the data nodes
+	var repaired []string
+	var err error
+	for _, address := range s.d.metadata {
+		if repaired, err = reportCorruptChunks(address, s.d.ID, chunkIDs); err == nil {
+			break
+		}
+		log.Printf("Error reporting corrupt chunks to %s: %v", address, err)
+	}
+	if err != nil {
+		return
+	}
+	for _, chunkId := range repaired {
+		log.Printf("Chunk %s repaired by the metadata service", chunkId)
+	}
+
+	reported := make(map[string]bool, len(chunkIDs))
+	for _, chunkId := range chunkIDs {
+		reported[chunkId] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unreported = s.unreported[len(chunkIDs):]
+	for _, finding := range s.findings {
+		if reported[finding.ChunkId] {
+			finding.Reported = true
+		}
+	}
+}
+
+func reportCorruptChunks(address string, dataNode string, chunkIDs []string) ([]string, error) {
+	conn, err := grpc.NewClient(
+		address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close connection: %v", err)
+		}
+	}()
+
+	client := metadata.NewMetadataServiceClient(conn)
+
+	res, err := client.ReportCorruptChunks(context.Background(), &metadata.ReportCorruptChunksRequest{
+		DataNode: dataNode,
+		ChunkIds: chunkIDs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Repaired, nil
+}
+
+// status returns the progress and recent findings of the scrubber.
+func (s *scrubber) status() *p.ScrubStatusResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	findings := make([]*p.ScrubFinding, len(s.findings))
+	for i, finding := range s.findings {
+		findings[i] = &p.ScrubFinding{
+			ChunkId:  finding.ChunkId,
+			Detail:   finding.Detail,
+			FoundAt:  finding.FoundAt,
+			Reported: finding.Reported,
+		}
+	}
+
+	return &p.ScrubStatusResponse{
+		Enabled:           s.enabled(),
+		Running:           s.running,
+		Passes:            s.passes,
+		PassStarted:       unixNano(s.passStarted),
+		LastPassCompleted: unixNano(s.lastPassCompleted),
+		ChunksScanned:     s.chunksScanned,
+		ChunksTotal:       s.chunksTotal,
+		BytesScanned:      s.bytesScanned,
+		CorruptChunks:     s.corrupt,
+		Findings:          findings,
+	}
+}
+
+// unixNano returns t as a Unix time in nanoseconds, or 0 for the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// chunkIDs returns the IDs of the stored chunks in order.
+func (d *DataNode) chunkIDs() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	chunkIDs := make([]string, 0, len(d.index))
+	for id := range d.index {
+		chunkIDs = append(chunkIDs, id)
+	}
+	sort.Strings(chunkIDs)
+	return chunkIDs
+}
+
+// ScrubStatus reports the progress of the scrubber and the corrupt chunks
+// it found recently.
+func (d *DataNode) ScrubStatus(
+	ctx context.Context,
+	req *p.ScrubStatusRequest,
+) (
+	*p.ScrubStatusResponse, error,
+) {
+	log.Printf("SCRUBSTATUS\t%v", req)
+	return d.scrubber.status(), nil
+}
@@ -4,12 +4,25 @@ import (
 	"context"
 	"github.com/apolyeti/godfs/internal/metadata/genproto"
 	metaService "github.com/apolyeti/godfs/internal/metadata/service"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/status"
+	"io"
+	"log"
+	"time"
 )
 
 type Client struct {
 	metadataClient genproto.MetadataServiceClient
 	currentDir     string
 	currentDirName string
+	// owner identifies this client as the holder of its locks
+	owner string
+	// conn fails over between metadata services, nil for a client given its
+	// connection. generation is the failover the current directory was
+	// checked after, and currentPath the names leading to it from the root.
+	conn        *failoverConn
+	generation  uint64
+	currentPath []string
 }
 
 func NewClient(metadataClient genproto.MetadataServiceClient) *Client {
@@ -17,25 +30,108 @@ func NewClient(metadataClient genproto.MetadataServiceClient) *Client {
 		metadataClient: metadataClient,
 		currentDir:     metaService.RootID,
 		currentDirName: "/",
+		owner:          uuid.New().String(),
 	}
 }
 
+// Dial returns a client of the metadata services at addresses, replicas or
+// a primary and its standby. Requests go to one of them at a time, and move
+// on to the next when it is unavailable or does not lead.
+func Dial(addresses []string) (*Client, error) {
+	conn, err := newFailoverConn(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewClient(genproto.NewMetadataServiceClient(conn))
+	c.conn = conn
+	return c, nil
+}
+
+// Disconnect closes the connections of a client returned by Dial.
+func (c *Client) Disconnect() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.close()
+}
+
+// Owner returns the ID this client holds locks under.
+func (c *Client) Owner() string { return c.owner }
+
+// SetOwner sets the ID this client holds locks under, so that a restarted
+// worker can renew or release the locks it took before.
+func (c *Client) SetOwner(owner string) { c.owner = owner }
+
 func (c *Client) ChangeDir(dir string) error {
+	ctx := context.Background()
 	req := &genproto.ChangeDirRequest{
-		CurrentDirectoryId: c.currentDir,
+		CurrentDirectoryId: c.dir(ctx),
 		TargetDirectoryId:  dir,
 	}
 
-	res, err := c.metadataClient.ChangeDir(context.Background(), req)
+	res, err := c.metadataClient.ChangeDir(ctx, req)
 	if err != nil {
 		return err
 	}
 
+	switch dir {
+	case "..":
+		if len(c.currentPath) > 0 {
+			c.currentPath = c.currentPath[:len(c.currentPath)-1]
+		}
+	case ".":
+	case "":
+		c.currentPath = nil
+	default:
+		c.currentPath = append(c.currentPath, dir)
+	}
+
 	c.currentDir = res.DirectoryId
 	c.currentDirName = res.DirectoryName
 	return nil
 }
 
+// dir returns the ID of the current directory. After a failover, it is
+// looked up again by path if the new metadata service does not know it,
+// such as a replica that has not applied its creation yet.
+func (c *Client) dir(ctx context.Context) string {
+	if c.conn == nil || c.conn.generation() == c.generation {
+		return c.currentDir
+	}
+	c.generation = c.conn.generation()
+
+	_, err := c.metadataClient.GetInode(ctx, &genproto.GetInodeRequest{Name: c.currentDir})
+	if err == nil || status.Convert(err).Message() != metaService.ErrFileNotFound.Error() {
+		return c.currentDir
+	}
+
+	id, err := c.resolve(ctx, c.currentPath)
+	if err != nil {
+		log.Printf("Current directory %s not found after failover: %v", c.currentDirName, err)
+		return c.currentDir
+	}
+	c.currentDir = id
+	return id
+}
+
+// resolve returns the ID of the directory at path, the names leading to it
+// from the root, without changing the current directory.
+func (c *Client) resolve(ctx context.Context, path []string) (string, error) {
+	id := metaService.RootID
+	for _, name := range path {
+		res, err := c.metadataClient.ChangeDir(ctx, &genproto.ChangeDirRequest{
+			CurrentDirectoryId: id,
+			TargetDirectoryId:  name,
+		})
+		if err != nil {
+			return "", err
+		}
+		id = res.DirectoryId
+	}
+	return id, nil
+}
+
 func (c *Client) CurrentDir() string {
 	return c.currentDirName
 }
@@ -48,7 +144,7 @@ func (c *Client) CreateFile(ctx context.Context,
 	*genproto.CreateFileResponse, error,
 ) {
 	req := &genproto.CreateFileRequest{
-		Parent: c.currentDir,
+		Parent: c.dir(ctx),
 		Name:   name,
 	}
 
@@ -61,7 +157,7 @@ func (c *Client) Mkdir(ctx context.Context,
 	*genproto.CreateFileResponse, error,
 ) {
 	req := &genproto.CreateFileRequest{
-		Parent: c.currentDir,
+		Parent: c.dir(ctx),
 		Name:   name,
 		IsDir:  true,
 	}
@@ -71,7 +167,7 @@ func (c *Client) Mkdir(ctx context.Context,
 
 func (c *Client) ListDir(ctx context.Context) (*genproto.ListDirResponse, error) {
 	req := &genproto.ListDirRequest{
-		DirectoryId: c.currentDir,
+		DirectoryId: c.dir(ctx),
 	}
 
 	return c.metadataClient.ListDir(ctx, req)
@@ -79,19 +175,424 @@ func (c *Client) ListDir(ctx context.Context) (*genproto.ListDirResponse, error)
 
 func (c *Client) WriteFile(ctx context.Context, fileName string, data []byte) (*genproto.WriteFileResponse, error) {
 	req := &genproto.WriteFileRequest{
-		CurrentDirectoryId: c.currentDir,
+		CurrentDirectoryId: c.dir(ctx),
 		FileName:           fileName,
-		Data:               data,
+		Owner:              c.owner,
 	}
 
-	return c.metadataClient.WriteFile(ctx, req)
+	return c.writeFile(ctx, req, data)
 }
 
 func (c *Client) ReadFile(ctx context.Context, fileName string) (*genproto.ReadFileResponse, error) {
 	req := &genproto.ReadFileRequest{
-		CurrentDirectoryId: c.currentDir,
+		CurrentDirectoryId: c.dir(ctx),
+		FileName:           fileName,
+	}
+
+	return c.readFile(ctx, req)
+}
+
+// writeFile streams data to the file req names, in pieces of at most
+// FilePieceSize bytes. The first request names the file, the others only
+// carry content.
+func (c *Client) writeFile(ctx context.Context,
+	req *genproto.WriteFileRequest,
+	data []byte,
+) (
+	*genproto.WriteFileResponse, error,
+) {
+	var res *genproto.WriteFileResponse
+	err := c.call(ctx, genproto.MetadataService_WriteFile_FullMethodName, func() error {
+		stream, err := c.metadataClient.WriteFile(ctx)
+		if err != nil {
+			return err
+		}
+
+		piece := req
+		for offset := 0; ; {
+			end := min(offset+metaService.FilePieceSize, len(data))
+			piece.Data = data[offset:end]
+
+			// The service ended the stream, its error is returned below
+			if err := stream.Send(piece); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			if offset = end; offset == len(data) {
+				break
+			}
+			piece = &genproto.WriteFileRequest{}
+		}
+
+		res, err = stream.CloseAndRecv()
+		return err
+	})
+	return res, err
+}
+
+// readFile reads the file req names, which is streamed in pieces.
+func (c *Client) readFile(ctx context.Context, req *genproto.ReadFileRequest) (*genproto.ReadFileResponse, error) {
+	var res *genproto.ReadFileResponse
+	err := c.call(ctx, genproto.MetadataService_ReadFile_FullMethodName, func() error {
+		stream, err := c.metadataClient.ReadFile(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		res = nil
+		for {
+			piece, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if res == nil {
+				res = piece
+				continue
+			}
+			res.Data = append(res.Data, piece.Data...)
+		}
+	})
+	return res, err
+}
+
+// call runs a streaming call as a whole, failing over between metadata
+// services like unary requests do if the client was returned by Dial.
+func (c *Client) call(ctx context.Context, method string, fn func() error) error {
+	if c.conn == nil {
+		return fn()
+	}
+	return c.conn.retry(ctx, method, func(*endpoint) error {
+		return fn()
+	})
+}
+
+// CreateFileWithChunkSize creates a file split into chunks of chunkSize bytes.
+func (c *Client) CreateFileWithChunkSize(ctx context.Context,
+	name string,
+	chunkSize int64,
+) (
+	*genproto.CreateFileResponse, error,
+) {
+	req := &genproto.CreateFileRequest{
+		Parent:    c.dir(ctx),
+		Name:      name,
+		ChunkSize: chunkSize,
+	}
+
+	return c.metadataClient.CreateFile(ctx, req)
+}
+
+// MkdirWithChunkSize creates a directory whose new files default to chunkSize.
+func (c *Client) MkdirWithChunkSize(ctx context.Context,
+	name string,
+	chunkSize int64,
+) (
+	*genproto.CreateFileResponse, error,
+) {
+	req := &genproto.CreateFileRequest{
+		Parent:    c.dir(ctx),
+		Name:      name,
+		IsDir:     true,
+		ChunkSize: chunkSize,
+	}
+
+	return c.metadataClient.CreateFile(ctx, req)
+}
+
+// Watch streams namespace events for the current directory, optionally
+// including everything below it. Pass the last event seen to resume after
+// reconnecting, or nil to only receive new events.
+func (c *Client) Watch(ctx context.Context,
+	recursive bool,
+	after *genproto.WatchEvent,
+) (
+	genproto.MetadataService_WatchClient, error,
+) {
+	req := &genproto.WatchRequest{
+		DirectoryId:  c.dir(ctx),
+		Recursive:    recursive,
+		FromSequence: after.GetSequence(),
+		FromEpoch:    after.GetEpoch(),
+	}
+
+	return c.metadataClient.Watch(ctx, req)
+}
+
+// Lock takes an advisory lock on fileName for the given lease, 0 for the
+// server default. A mandatory lock also rejects writes from other clients.
+func (c *Client) Lock(ctx context.Context,
+	fileName string,
+	mode genproto.LockMode,
+	lease time.Duration,
+	mandatory bool,
+) (
+	*genproto.LockResponse, error,
+) {
+	req := &genproto.LockRequest{
+		CurrentDirectoryId: c.dir(ctx),
+		FileName:           fileName,
+		Owner:              c.owner,
+		Mode:               mode,
+		LeaseMs:            lease.Milliseconds(),
+		Mandatory:          mandatory,
+	}
+
+	return c.metadataClient.Lock(ctx, req)
+}
+
+func (c *Client) Unlock(ctx context.Context, fileName string) (*genproto.UnlockResponse, error) {
+	req := &genproto.UnlockRequest{
+		CurrentDirectoryId: c.dir(ctx),
+		FileName:           fileName,
+		Owner:              c.owner,
+	}
+
+	return c.metadataClient.Unlock(ctx, req)
+}
+
+func (c *Client) RenewLock(ctx context.Context,
+	fileName string,
+	lease time.Duration,
+) (
+	*genproto.LockResponse, error,
+) {
+	req := &genproto.RenewLockRequest{
+		CurrentDirectoryId: c.dir(ctx),
+		FileName:           fileName,
+		Owner:              c.owner,
+		LeaseMs:            lease.Milliseconds(),
+	}
+
+	return c.metadataClient.RenewLock(ctx, req)
+}
+
+// Open opens fileName for reading or writing. Opening for writing takes the
+// single-writer lease on the file, refused while another client holds it.
+func (c *Client) Open(ctx context.Context,
+	fileName string,
+	mode genproto.OpenMode,
+) (
+	*genproto.OpenResponse, error,
+) {
+	req := &genproto.OpenRequest{
+		CurrentDirectoryId: c.dir(ctx),
+		FileName:           fileName,
+		Mode:               mode,
+		Owner:              c.owner,
+	}
+
+	return c.metadataClient.Open(ctx, req)
+}
+
+func (c *Client) Close(ctx context.Context, handle string) (*genproto.CloseResponse, error) {
+	req := &genproto.CloseRequest{
+		Handle: handle,
+	}
+
+	return c.metadataClient.Close(ctx, req)
+}
+
+// WriteHandle writes data to the file opened as handle.
+func (c *Client) WriteHandle(ctx context.Context, handle string, data []byte) (*genproto.WriteFileResponse, error) {
+	req := &genproto.WriteFileRequest{
+		Handle: handle,
+		Owner:  c.owner,
+	}
+
+	return c.writeFile(ctx, req, data)
+}
+
+// ReadHandle reads the file opened as handle, even if it was removed since.
+func (c *Client) ReadHandle(ctx context.Context, handle string) (*genproto.ReadFileResponse, error) {
+	req := &genproto.ReadFileRequest{
+		Handle: handle,
+	}
+
+	return c.readFile(ctx, req)
+}
+
+func (c *Client) Remove(ctx context.Context, name string) (*genproto.RemoveResponse, error) {
+	req := &genproto.RemoveRequest{
+		CurrentDirectoryId: c.dir(ctx),
+		FileName:           name,
+		Owner:              c.owner,
+	}
+
+	return c.metadataClient.Remove(ctx, req)
+}
+
+// Stat returns the inode of name in the current directory, including the
+// generation to pass as a precondition to conditional mutations.
+func (c *Client) Stat(ctx context.Context, name string) (*genproto.Inode, error) {
+	req := &genproto.StatRequest{
+		CurrentDirectoryId: c.dir(ctx),
+		FileName:           name,
+	}
+
+	return c.metadataClient.Stat(ctx, req)
+}
+
+// WriteFileIfGeneration writes fileName only if it is still at generation.
+func (c *Client) WriteFileIfGeneration(ctx context.Context,
+	fileName string,
+	data []byte,
+	generation uint64,
+) (
+	*genproto.WriteFileResponse, error,
+) {
+	req := &genproto.WriteFileRequest{
+		CurrentDirectoryId: c.dir(ctx),
 		FileName:           fileName,
+		Owner:              c.owner,
+		ExpectedGeneration: generation,
+	}
+
+	return c.writeFile(ctx, req, data)
+}
+
+// RemoveIfGeneration removes name only if it is still at generation.
+func (c *Client) RemoveIfGeneration(ctx context.Context,
+	name string,
+	generation uint64,
+) (
+	*genproto.RemoveResponse, error,
+) {
+	req := &genproto.RemoveRequest{
+		CurrentDirectoryId: c.dir(ctx),
+		FileName:           name,
+		Owner:              c.owner,
+		ExpectedGeneration: generation,
+	}
+
+	return c.metadataClient.Remove(ctx, req)
+}
+
+// Rename moves name to newName in the directory targetDirId, or in the current
+// directory if targetDirId is empty. A non-zero generation makes the rename
+// conditional on the entry still being at that generation.
+func (c *Client) Rename(ctx context.Context,
+	name string,
+	targetDirId string,
+	newName string,
+	generation uint64,
+) (
+	*genproto.RenameResponse, error,
+) {
+	req := &genproto.RenameRequest{
+		CurrentDirectoryId: c.dir(ctx),
+		FileName:           name,
+		TargetDirectoryId:  targetDirId,
+		NewName:            newName,
+		ExpectedGeneration: generation,
+		Owner:              c.owner,
+	}
+
+	return c.metadataClient.Rename(ctx, req)
+}
+
+// SetAttr changes the attributes of name that are set in attrs.
+func (c *Client) SetAttr(ctx context.Context,
+	name string,
+	attrs *genproto.Attributes,
+) (
+	*genproto.Inode, error,
+) {
+	req := &genproto.SetAttrRequest{
+		CurrentDirectoryId: c.dir(ctx),
+		FileName:           name,
+		Attributes:         attrs,
+		Owner:              c.owner,
+	}
+
+	return c.metadataClient.SetAttr(ctx, req)
+}
+
+// Batch applies ops all together or not at all. Paths in ops are relative
+// to the current directory.
+func (c *Client) Batch(ctx context.Context,
+	ops []*genproto.BatchOperation,
+) (
+	*genproto.BatchResponse, error,
+) {
+	req := &genproto.BatchRequest{
+		CurrentDirectoryId: c.dir(ctx),
+		Operations:         ops,
+		Owner:              c.owner,
+	}
+
+	return c.metadataClient.Batch(ctx, req)
+}
+
+// Fsck checks the consistency of the namespace, repairing it if repair is set.
+// With checkChunks, the chunks of every file are checked against the data nodes.
+func (c *Client) Fsck(ctx context.Context,
+	repair bool,
+	checkChunks bool,
+) (
+	*genproto.FsckResponse, error,
+) {
+	req := &genproto.FsckRequest{
+		Repair:      repair,
+		CheckChunks: checkChunks,
+	}
+
+	return c.metadataClient.Fsck(ctx, req)
+}
+
+// ListNodes reports the data nodes registered with the metadata service and
+// their health.
+func (c *Client) ListNodes(ctx context.Context) (*genproto.ListNodesResponse, error) {
+	req := &genproto.ListNodesRequest{}
+
+	return c.metadataClient.ListNodes(ctx, req)
+}
+
+// GetReconciliation reports the discrepancies between the chunks the data
+// nodes reported to hold and the chunks the files place on them. With
+// refresh, the reports are reconciled again first.
+func (c *Client) GetReconciliation(ctx context.Context,
+	refresh bool,
+) (
+	*genproto.ReconciliationResponse, error,
+) {
+	req := &genproto.GetReconciliationRequest{
+		Refresh: refresh,
+	}
+
+	return c.metadataClient.GetReconciliation(ctx, req)
+}
+
+// QueueCommand queues a command for the data node nodeID, which carries it
+// out after its next heartbeat, and returns the ID of the command.
+func (c *Client) QueueCommand(ctx context.Context,
+	nodeID string,
+	command *genproto.DataNodeCommand,
+) (
+	*genproto.QueueCommandResponse, error,
+) {
+	req := &genproto.QueueCommandRequest{
+		NodeId:  nodeID,
+		Command: command,
+	}
+
+	return c.metadataClient.QueueCommand(ctx, req)
+}
+
+// Promote makes the standby the client is connected to take over from its
+// primary. force promotes it even while the primary is still reachable.
+func (c *Client) Promote(ctx context.Context,
+	force bool,
+) (
+	*genproto.PromoteResponse, error,
+) {
+	req := &genproto.PromoteRequest{
+		Force: force,
 	}
 
-	return c.metadataClient.ReadFile(ctx, req)
+	return c.metadataClient.Promote(ctx, req)
 }
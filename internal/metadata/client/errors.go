@@ -0,0 +1,9 @@
+package metadata_client
+
+import "errors"
+
+var (
+	ErrNoEndpoints  = errors.New("no metadata service addresses given")
+	ErrInvalidMount = errors.New("invalid mount table")
+	ErrCrossMount   = errors.New("rename across mount points is not supported")
+)
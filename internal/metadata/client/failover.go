@@ -0,0 +1,223 @@
+package metadata_client
+
+import (
+	"context"
+	"errors"
+	"github.com/apolyeti/godfs/internal/metadata/genproto"
+	metaService "github.com/apolyeti/godfs/internal/metadata/service"
+	"github.com/apolyeti/godfs/internal/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// failoverRounds is the number of times a request goes around every
+	// endpoint before it fails, as electing a leader takes a moment.
+	failoverRounds = 3
+	// failoverBackoff is the wait before going around the endpoints again,
+	// multiplied by the number of rounds so far.
+	failoverBackoff = 250 * time.Millisecond
+)
+
+// idempotentMethods may be sent again after failing with the endpoint
+// unavailable, as they change nothing or the same thing when repeated.
+// Other requests may have been applied before the endpoint went away, so
+// they are only retried when rejected by a replica that does not lead.
+var idempotentMethods = map[string]bool{
+	genproto.MetadataService_GetInode_FullMethodName:  true,
+	genproto.MetadataService_ListDir_FullMethodName:   true,
+	genproto.MetadataService_ChangeDir_FullMethodName: true,
+	genproto.MetadataService_ReadFile_FullMethodName:  true,
+	genproto.MetadataService_Stat_FullMethodName:      true,
+	genproto.MetadataService_RenewLock_FullMethodName: true,
+}
+
+// endpoint is a metadata service requests may be sent to.
+type endpoint struct {
+	address string
+	conn    *grpc.ClientConn
+}
+
+// failoverConn sends requests to one of several metadata services, moving
+// on to the next when it is unavailable, or to the leader when it is not.
+// current: index of the endpoint requests are sent to
+// failovers: number of times current changed
+type failoverConn struct {
+	mu        sync.Mutex
+	endpoints []*endpoint
+	current   int
+	failovers uint64
+}
+
+func dialEndpoint(address string) (*endpoint, error) {
+	conn, err := grpc.NewClient(
+		address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(metaService.MaxMsgSize),
+			grpc.MaxCallSendMsgSize(metaService.MaxMsgSize),
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint{address: address, conn: conn}, nil
+}
+
+func newFailoverConn(addresses []string) (*failoverConn, error) {
+	if len(addresses) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	f := &failoverConn{}
+	for _, address := range addresses {
+		e, err := dialEndpoint(address)
+		if err != nil {
+			_ = f.close()
+			return nil, err
+		}
+		f.endpoints = append(f.endpoints, e)
+	}
+	return f, nil
+}
+
+// endpoint returns the endpoint requests are sent to, and its index.
+func (f *failoverConn) endpoint() (*endpoint, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.endpoints[f.current], f.current
+}
+
+// generation returns the number of failovers so far.
+func (f *failoverConn) generation() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failovers
+}
+
+// next moves on from the endpoint at index, unless another request did so
+// already.
+func (f *failoverConn) next(index int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current != index {
+		return
+	}
+	f.current = (f.current + 1) % len(f.endpoints)
+	f.failovers++
+	log.Printf("Failing over from metadata service %s to %s", f.endpoints[index].address, f.endpoints[f.current].address)
+}
+
+// redirect moves on from the endpoint at index to the leader at address,
+// which is added to the endpoints if it is not one of them yet.
+func (f *failoverConn) redirect(index int, address string) {
+	if address == "" {
+		f.next(index)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current != index {
+		return
+	}
+
+	target := -1
+	for i, e := range f.endpoints {
+		if e.address == address {
+			target = i
+			break
+		}
+	}
+	if target == -1 {
+		e, err := dialEndpoint(address)
+		if err != nil {
+			log.Printf("Failed to connect to metadata leader %s: %v", address, err)
+			f.current = (f.current + 1) % len(f.endpoints)
+			f.failovers++
+			return
+		}
+		f.endpoints = append(f.endpoints, e)
+		target = len(f.endpoints) - 1
+	}
+
+	f.current = target
+	f.failovers++
+	log.Printf("Redirected from metadata service %s to leader %s", f.endpoints[index].address, address)
+}
+
+// Invoke sends a unary request, failing over until it succeeds, fails for
+// a reason other than the endpoint, or every endpoint was tried
+// failoverRounds times.
+func (f *failoverConn) Invoke(ctx context.Context, method string, args any, reply any, opts ...grpc.CallOption) error {
+	return f.retry(ctx, method, func(e *endpoint) error {
+		return e.conn.Invoke(ctx, method, args, reply, opts...)
+	})
+}
+
+// retry runs call against the current endpoint, failing over like Invoke
+// does. Calls that stream the whole of a request or response, such as
+// WriteFile and ReadFile, are retried as a whole this way.
+func (f *failoverConn) retry(ctx context.Context, method string, call func(e *endpoint) error) error {
+	f.mu.Lock()
+	n := len(f.endpoints)
+	f.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < failoverRounds*n; attempt++ {
+		if attempt > 0 && attempt%n == 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(time.Duration(attempt/n) * failoverBackoff):
+			}
+		}
+
+		e, index := f.endpoint()
+		err = call(e)
+		if err == nil {
+			return nil
+		}
+
+		// A replica that does not lead rejects requests before applying them
+		if notLeader, ok := raft.LeaderFromError(err); ok {
+			f.redirect(index, notLeader.LeaderAddress)
+			continue
+		}
+		if status.Code(err) != codes.Unavailable {
+			return err
+		}
+		f.next(index)
+		if !idempotentMethods[method] {
+			return err
+		}
+	}
+	return err
+}
+
+// NewStream opens a stream on the current endpoint. Streams are not failed
+// over once open, callers resume them, as Watch does from its last sequence.
+func (f *failoverConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	e, index := f.endpoint()
+	stream, err := e.conn.NewStream(ctx, desc, method, opts...)
+	if status.Code(err) == codes.Unavailable {
+		f.next(index)
+	}
+	return stream, err
+}
+
+func (f *failoverConn) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var errs []error
+	for _, e := range f.endpoints {
+		errs = append(errs, e.conn.Close())
+	}
+	return errors.Join(errs...)
+}
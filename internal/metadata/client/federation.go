@@ -0,0 +1,254 @@
+package metadata_client
+
+import (
+	"context"
+	"fmt"
+	"github.com/apolyeti/godfs/internal/metadata/genproto"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Mount maps the subtree at Prefix to the metadata services at Addresses,
+// which serve it as their root directory.
+type Mount struct {
+	Prefix    string
+	Addresses []string
+}
+
+// ParseMounts parses a mount table of prefix=address[,address...] entries
+// separated by semicolons, such as "/=meta1:8080;/teamA=meta2:8080,meta3:8080".
+func ParseMounts(s string) ([]Mount, error) {
+	var mounts []Mount
+	for _, entry := range strings.Split(s, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		prefix, addresses, ok := strings.Cut(entry, "=")
+		if !ok || addresses == "" {
+			return nil, fmt.Errorf("%w: %q is not prefix=addresses", ErrInvalidMount, entry)
+		}
+		mounts = append(mounts, Mount{
+			Prefix:    strings.TrimSpace(prefix),
+			Addresses: strings.Split(addresses, ","),
+		})
+	}
+	return mounts, nil
+}
+
+// splitPath returns the names along an absolute path, none for the root.
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func hasPrefix(p []string, prefix []string) bool {
+	if len(p) < len(prefix) {
+		return false
+	}
+	for i, name := range prefix {
+		if p[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+// mount is a subtree of the namespace served by its own metadata services.
+type mount struct {
+	prefix []string
+	client *Client
+}
+
+// Federation is a client of a namespace split by subtree across metadata
+// services. Requests about the current directory go to the services of the
+// mount it is in, and ChangeDir crosses mount points as if they were
+// directories.
+// Client: client of the mount the current directory is in
+// mounts: every mount, longest prefix first
+// path: names leading to the current directory from the root
+type Federation struct {
+	*Client
+	mounts  []*mount
+	current *mount
+	path    []string
+}
+
+// NewFederation connects to the services of every mount. The table must
+// mount the root directory.
+func NewFederation(mounts []Mount) (*Federation, error) {
+	f := &Federation{}
+	seen := make(map[string]bool)
+	for _, m := range mounts {
+		prefix := splitPath(m.Prefix)
+		key := strings.Join(prefix, "/")
+		if !strings.HasPrefix(m.Prefix, "/") || seen[key] {
+			_ = f.Disconnect()
+			return nil, fmt.Errorf("%w: bad or duplicate prefix %q", ErrInvalidMount, m.Prefix)
+		}
+		seen[key] = true
+
+		c, err := Dial(m.Addresses)
+		if err != nil {
+			_ = f.Disconnect()
+			return nil, err
+		}
+		f.mounts = append(f.mounts, &mount{prefix: prefix, client: c})
+	}
+	if !seen[""] {
+		_ = f.Disconnect()
+		return nil, fmt.Errorf("%w: nothing mounted at /", ErrInvalidMount)
+	}
+
+	sort.Slice(f.mounts, func(a, b int) bool {
+		return len(f.mounts[a].prefix) > len(f.mounts[b].prefix)
+	})
+
+	// Locks are held under the same owner whichever service keeps them
+	f.current, _ = f.mountOf(nil)
+	f.Client = f.current.client
+	for _, m := range f.mounts {
+		m.client.SetOwner(f.Client.Owner())
+	}
+	return f, nil
+}
+
+// mountOf returns the mount serving p, and the path within it.
+func (f *Federation) mountOf(p []string) (*mount, []string) {
+	for _, m := range f.mounts {
+		if hasPrefix(p, m.prefix) {
+			return m, p[len(m.prefix):]
+		}
+	}
+	return nil, nil
+}
+
+// isMountPoint reports whether p is where a mount is attached.
+func (f *Federation) isMountPoint(p []string) bool {
+	m, rest := f.mountOf(p)
+	return len(m.prefix) > 0 && len(rest) == 0
+}
+
+func (f *Federation) ChangeDir(dir string) error {
+	target := append([]string(nil), f.path...)
+	switch dir {
+	case "..":
+		if len(target) > 0 {
+			target = target[:len(target)-1]
+		}
+	case ".":
+	case "":
+		target = nil
+	default:
+		target = append(target, dir)
+	}
+
+	m, rest := f.mountOf(target)
+	if m == f.current {
+		if err := f.Client.ChangeDir(dir); err != nil {
+			return err
+		}
+		f.path = target
+		return nil
+	}
+
+	// Entering another mount starts over from its root
+	if err := m.client.ChangeDir(""); err != nil {
+		return err
+	}
+	for _, name := range rest {
+		if err := m.client.ChangeDir(name); err != nil {
+			return err
+		}
+	}
+
+	f.current = m
+	f.Client = m.client
+	f.path = target
+	return nil
+}
+
+// CurrentDir returns the name of the current directory, which is the name of
+// the mount point at the root of a mount.
+func (f *Federation) CurrentDir() string {
+	if len(f.path) == 0 {
+		return "/"
+	}
+	return f.path[len(f.path)-1]
+}
+
+// Path returns the absolute path of the current directory.
+func (f *Federation) Path() string {
+	return "/" + strings.Join(f.path, "/")
+}
+
+// ListDir lists the current directory, including the mount points in it.
+func (f *Federation) ListDir(ctx context.Context) (*genproto.ListDirResponse, error) {
+	res, err := f.Client.ListDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, entry := range res.Entries {
+		names[entry.Name] = true
+	}
+	for _, m := range f.mounts {
+		if len(m.prefix) != len(f.path)+1 || !hasPrefix(m.prefix, f.path) {
+			continue
+		}
+		name := m.prefix[len(m.prefix)-1]
+		if !names[name] {
+			res.Entries = append(res.Entries, &genproto.Inode{Name: name, IsDir: true})
+		}
+	}
+	return res, nil
+}
+
+// Rename moves name to newName in the directory at targetPath, an absolute
+// path, or in the current directory if targetPath is empty. Both directories
+// must be in the same mount, and mount points cannot be moved, or it fails
+// with ErrCrossMount.
+func (f *Federation) Rename(ctx context.Context,
+	name string,
+	targetPath string,
+	newName string,
+	generation uint64,
+) (
+	*genproto.RenameResponse, error,
+) {
+	target := f.path
+	if targetPath != "" {
+		target = splitPath(targetPath)
+	}
+
+	m, rest := f.mountOf(target)
+	source := append(append([]string(nil), f.path...), name)
+	dest := append(append([]string(nil), target...), newName)
+	if m != f.current || f.isMountPoint(source) || f.isMountPoint(dest) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrCrossMount, "/"+strings.Join(source, "/"), "/"+strings.Join(dest, "/"))
+	}
+
+	var targetID string
+	if targetPath != "" {
+		var err error
+		if targetID, err = f.Client.resolve(ctx, rest); err != nil {
+			return nil, err
+		}
+	}
+	return f.Client.Rename(ctx, name, targetID, newName, generation)
+}
+
+// Disconnect closes the connections to the services of every mount.
+func (f *Federation) Disconnect() error {
+	var err error
+	for _, m := range f.mounts {
+		if closeErr := m.client.Disconnect(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package metadata_service
+
+import (
+	"context"
+	"errors"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"log"
+)
+
+// errBatchAborted rolls back a batch whose failure is reported in its results.
+var errBatchAborted = errors.New("batch aborted")
+
+// Batch applies a list of namespace operations in a single transaction.
+// If any operation fails, none of them are applied and the failure is
+// reported in the results rather than as an RPC error.
+func (m *MetadataService) Batch(
+	ctx context.Context,
+	req *metadata.BatchRequest,
+) (
+	*metadata.BatchResponse,
+	error,
+) {
+	log.Printf("BATCH\t%v", req)
+
+	var results []*metadata.BatchResult
+	err := m.update(func(t *txn) error {
+		results = make([]*metadata.BatchResult, 0, len(req.Operations))
+		for _, op := range req.Operations {
+			inode, err := t.apply(req.CurrentDirectoryId, req.Owner, op)
+			if err != nil {
+				results = append(results, &metadata.BatchResult{
+					Error: err.Error(),
+				})
+				return errBatchAborted
+			}
+
+			results = append(results, &metadata.BatchResult{
+				Inode:      inode.ID,
+				Generation: inode.Generation,
+			})
+		}
+		return nil
+	})
+	if err == errBatchAborted {
+		return &metadata.BatchResponse{
+			Committed: false,
+			Results:   results,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata.BatchResponse{
+		Committed: true,
+		Results:   results,
+	}, nil
+}
+
+// apply runs a single batch operation and returns the inode it affected.
+func (t *txn) apply(dirID string, owner string, op *metadata.BatchOperation) (*Inode, error) {
+	switch op := op.Op.(type) {
+	case *metadata.BatchOperation_Mkdir:
+		parent, name, err := t.resolveParent(dirID, op.Mkdir.Path)
+		if err != nil {
+			return nil, err
+		}
+		return t.create(parent.ID, name, true, op.Mkdir.ChunkSize)
+
+	case *metadata.BatchOperation_Create:
+		parent, name, err := t.resolveParent(dirID, op.Create.Path)
+		if err != nil {
+			return nil, err
+		}
+		return t.create(parent.ID, name, false, op.Create.ChunkSize)
+
+	case *metadata.BatchOperation_Rename:
+		inode, err := t.resolve(dirID, op.Rename.Path)
+		if err != nil {
+			return nil, err
+		}
+		parent, name, err := t.resolveParent(dirID, op.Rename.NewPath)
+		if err != nil {
+			return nil, err
+		}
+		return t.rename(inode, parent.ID, name, owner, op.Rename.ExpectedGeneration)
+
+	case *metadata.BatchOperation_Remove:
+		inode, err := t.resolve(dirID, op.Remove.Path)
+		if err != nil {
+			return nil, err
+		}
+		return t.remove(inode, owner, op.Remove.ExpectedGeneration)
+
+	case *metadata.BatchOperation_SetAttr:
+		inode, err := t.resolve(dirID, op.SetAttr.Path)
+		if err != nil {
+			return nil, err
+		}
+		return t.setAttr(inode, op.SetAttr.Attributes, owner, op.SetAttr.ExpectedGeneration)
+
+	default:
+		return nil, ErrInvalidOperation
+	}
+}
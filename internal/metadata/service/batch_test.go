@@ -0,0 +1,100 @@
+package metadata_service
+
+import (
+	"context"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"testing"
+)
+
+func batchOps(ops ...any) []*metadata.BatchOperation {
+	var batch []*metadata.BatchOperation
+	for _, op := range ops {
+		switch op := op.(type) {
+		case *metadata.MkdirOperation:
+			batch = append(batch, &metadata.BatchOperation{Op: &metadata.BatchOperation_Mkdir{Mkdir: op}})
+		case *metadata.CreateOperation:
+			batch = append(batch, &metadata.BatchOperation{Op: &metadata.BatchOperation_Create{Create: op}})
+		case *metadata.RenameOperation:
+			batch = append(batch, &metadata.BatchOperation{Op: &metadata.BatchOperation_Rename{Rename: op}})
+		case *metadata.RemoveOperation:
+			batch = append(batch, &metadata.BatchOperation{Op: &metadata.BatchOperation_Remove{Remove: op}})
+		case *metadata.SetAttrOperation:
+			batch = append(batch, &metadata.BatchOperation{Op: &metadata.BatchOperation_SetAttr{SetAttr: op}})
+		}
+	}
+	return batch
+}
+
+// TestBatchAbort checks that a batch with a failing operation leaves no
+// trace of the operations before it, and that the same batch without it is
+// applied as a whole.
+func TestBatchAbort(t *testing.T) {
+	m := newTestService(t, nil)
+	ctx := context.Background()
+	if _, err := m.CreateFile(ctx, &metadata.CreateFileRequest{Name: "keep", Parent: RootID}); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	root, err := m.store.Get(RootID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	keep, err := m.lookup(RootID, "keep")
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	permissions := "rw-------"
+
+	watcher, _, err := m.events.subscribe(RootID, true, 0, 0)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer m.events.unsubscribe(watcher)
+
+	ops := batchOps(
+		&metadata.MkdirOperation{Path: "dir"},
+		&metadata.CreateOperation{Path: "dir/file"},
+		&metadata.SetAttrOperation{Path: "keep", Attributes: &metadata.Attributes{Permissions: &permissions}},
+		&metadata.RenameOperation{Path: "keep", NewPath: "dir/kept"},
+	)
+	failing := append(ops, batchOps(&metadata.RemoveOperation{Path: "missing"})...)
+
+	resp, err := m.Batch(ctx, &metadata.BatchRequest{CurrentDirectoryId: RootID, Operations: failing})
+	if err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	if resp.Committed || len(resp.Results) != len(failing) || resp.Results[len(failing)-1].Error == "" {
+		t.Fatalf("Batch = %v, want it aborted at its last operation", resp)
+	}
+
+	if got, _ := m.lookup(RootID, "keep"); got != keep {
+		t.Errorf("keep = %+v after an aborted batch, want %+v", got, keep)
+	}
+	if got, _ := m.store.Get(RootID); got != root {
+		t.Errorf("Root directory = %+v after an aborted batch, want %+v", got, root)
+	}
+	if _, err := m.lookup(RootID, "dir"); err != ErrFileNotFound {
+		t.Errorf("lookup(dir) = %v after an aborted batch, want %v", err, ErrFileNotFound)
+	}
+	select {
+	case e := <-watcher.events:
+		t.Errorf("Event %v published for an aborted batch", e)
+	default:
+	}
+
+	resp, err = m.Batch(ctx, &metadata.BatchRequest{CurrentDirectoryId: RootID, Operations: ops})
+	if err != nil || !resp.Committed {
+		t.Fatalf("Batch = %v, %v, want it committed", resp, err)
+	}
+	dir, err := m.lookup(RootID, "dir")
+	if err != nil {
+		t.Fatalf("lookup(dir): %v", err)
+	}
+	for _, name := range []string{"file", "kept"} {
+		if _, err := m.lookup(dir.ID, name); err != nil {
+			t.Errorf("lookup(dir/%s): %v", name, err)
+		}
+	}
+	if _, err := m.lookup(RootID, "keep"); err != ErrFileNotFound {
+		t.Errorf("lookup(keep) = %v, want %v", err, ErrFileNotFound)
+	}
+}
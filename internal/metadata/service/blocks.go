@@ -0,0 +1,374 @@
+package metadata_service
+
+import (
+	"context"
+	"fmt"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"github.com/google/uuid"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reconcileGrace is how long a chunk is left out of reconciliation after it
+// was first reported, or after its file was written, since chunks are stored
+// before the write is committed and reported some time after.
+const reconcileGrace = 2 * time.Minute
+
+// blockReport is what a data node reported to hold since it registered.
+// chunks: time each chunk held was first reported, nil until a full report completed
+// partial: chunks of the full report still being received
+// received: last time a report was received
+type blockReport struct {
+	chunks   map[string]time.Time
+	partial  map[string]time.Time
+	received time.Time
+}
+
+// reconciliation is the result of comparing the block reports of the data
+// nodes with the chunks the files place on them.
+// at: when the reconciliation ran
+// unreported: registered data nodes without a full report, left out
+// checked: number of chunks compared
+type reconciliation struct {
+	at            time.Time
+	discrepancies []*metadata.ChunkDiscrepancy
+	unreported    []string
+	checked       uint64
+}
+
+// reconciler holds the last reconciliation and serializes new ones.
+type reconciler struct {
+	run sync.Mutex
+
+	mu   sync.Mutex
+	last *reconciliation
+}
+
+// report applies a block report of a registered data node, and reports
+// whether a full report is needed first.
+func (s *nodeSet) report(req *metadata.BlockReportRequest, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nodes[req.NodeId]; !ok {
+		return false, ErrDataNodeUnknown
+	}
+	report, ok := s.reports[req.NodeId]
+	if !ok {
+		report = &blockReport{}
+		s.reports[req.NodeId] = report
+	}
+	report.received = now
+
+	if req.Full {
+		if req.Part == 0 {
+			report.partial = make(map[string]time.Time, len(req.Added))
+		} else if report.partial == nil {
+			return true, nil
+		}
+		for _, chunkId := range req.Added {
+			report.partial[chunkId] = firstReported(report.chunks, chunkId, now)
+		}
+		if !req.More {
+			report.chunks = report.partial
+			report.partial = nil
+		}
+		return false, nil
+	}
+
+	if report.chunks == nil {
+		return true, nil
+	}
+	for _, chunkId := range req.Added {
+		report.chunks[chunkId] = firstReported(report.chunks, chunkId, now)
+	}
+	for _, chunkId := range req.Removed {
+		delete(report.chunks, chunkId)
+	}
+	return false, nil
+}
+
+// firstReported returns when chunkId was first reported, now if it was not
+// reported before.
+func firstReported(chunks map[string]time.Time, chunkId string, now time.Time) time.Time {
+	if reported, ok := chunks[chunkId]; ok {
+		return reported
+	}
+	return now
+}
+
+// reportedChunks returns a copy of the chunks the data node registered under
+// id reported to hold, with the time each was first reported, or nil until
+// it completed a full report.
+func (s *nodeSet) reportedChunks(id string) map[string]time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	report, ok := s.reports[id]
+	if !ok || report.chunks == nil {
+		return nil
+	}
+	chunks := make(map[string]time.Time, len(report.chunks))
+	for chunkId, reported := range report.chunks {
+		chunks[chunkId] = reported
+	}
+	return chunks
+}
+
+// reportStats returns the Unix time in nanoseconds the data node last sent
+// a block report, 0 if it did not, and the number of chunks it reported.
+func (s *nodeSet) reportStats(id string) (int64, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	report, ok := s.reports[id]
+	if !ok {
+		return 0, 0
+	}
+	return report.received.UnixNano(), uint64(len(report.chunks))
+}
+
+// BlockReport records the chunks a data node reports to hold, for the next
+// reconciliation. Data nodes send a full report after registering, then
+// incremental reports.
+func (m *MetadataService) BlockReport(
+	ctx context.Context,
+	req *metadata.BlockReportRequest,
+) (
+	*metadata.BlockReportResponse,
+	error,
+) {
+	log.Printf("BLOCKREPORT\tnode_id:%q full:%v part:%d more:%v added:%d removed:%d",
+		req.NodeId, req.Full, req.Part, req.More, len(req.Added), len(req.Removed))
+
+	fullReport, err := m.nodes.report(req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &metadata.BlockReportResponse{FullReport: fullReport}, nil
+}
+
+// GetReconciliation returns the discrepancies found between the block
+// reports of the data nodes and the chunks the files place on them.
+func (m *MetadataService) GetReconciliation(
+	ctx context.Context,
+	req *metadata.GetReconciliationRequest,
+) (
+	*metadata.ReconciliationResponse,
+	error,
+) {
+	log.Printf("GETRECONCILIATION\t%v", req)
+
+	if req.Refresh {
+		if err := m.reconcile(); err != nil {
+			return nil, err
+		}
+	}
+
+	m.reconciler.mu.Lock()
+	last := m.reconciler.last
+	m.reconciler.mu.Unlock()
+
+	if last == nil {
+		return &metadata.ReconciliationResponse{}, nil
+	}
+	return &metadata.ReconciliationResponse{
+		ReconciledAt:  last.at.UnixNano(),
+		Discrepancies: last.discrepancies,
+		Unreported:    last.unreported,
+		ChunksChecked: last.checked,
+	}, nil
+}
+
+// startReconcileLoop reconciles the block reports with the namespace every
+// reconcileInterval, until the service shuts down.
+func (m *MetadataService) startReconcileLoop() {
+	ticker := time.NewTicker(m.reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.reconcile(); err != nil {
+				log.Printf("Error reconciling block reports: %v", err)
+			}
+		case <-m.shutdownChan:
+			return
+		}
+	}
+}
+
+// chunkPlacement is where a file places one of its chunks.
+// node: ID of the data node, empty for legacy placement by position
+// written: last time the file was written
+type chunkPlacement struct {
+	inode   string
+	node    string
+	written time.Time
+}
+
+// reconcile compares the block reports of the data nodes with the chunks the
+// files place on them, and keeps the discrepancies for GetReconciliation.
+// The namespace is read from a snapshot, and each block report copied, so
+// that neither m.mu nor the data nodes are held up while they are compared.
+func (m *MetadataService) reconcile() error {
+	m.reconciler.run.Lock()
+	defer m.reconciler.run.Unlock()
+
+	now := time.Now()
+	placements := make(map[string]chunkPlacement)
+	byNode := make(map[string][]string)
+	files := make(map[string]bool)
+
+	m.mu.RLock()
+	snapshot := m.store.Snapshot()
+	m.mu.RUnlock()
+
+	err := snapshot.ForEach(func(inode *Inode) error {
+		if inode.IsDir {
+			return nil
+		}
+		files[inode.ID] = true
+		for i, chunkId := range inode.ChunkIDs {
+			placement := chunkPlacement{inode: inode.ID, written: inode.Timestamp.UpdatedAt}
+			if len(inode.ChunkNodes) > 0 {
+				placement.node = inode.ChunkNodes[i]
+				byNode[placement.node] = append(byNode[placement.node], chunkId)
+			}
+			placements[chunkId] = placement
+		}
+		return nil
+	})
+	snapshot.Release()
+	if err != nil {
+		return err
+	}
+
+	result := &reconciliation{at: now}
+	var missing []*metadata.ChunkDiscrepancy
+
+	for _, node := range m.nodes.list() {
+		chunks := m.nodes.reportedChunks(node.ID)
+		if chunks == nil {
+			result.unreported = append(result.unreported, node.ID)
+			continue
+		}
+
+		for chunkId, reported := range chunks {
+			result.checked++
+			if now.Sub(reported) < reconcileGrace {
+				continue
+			}
+
+			placement, ok := placements[chunkId]
+			switch {
+			case ok && (placement.node == node.ID || placement.node == ""):
+			case ok:
+				result.discrepancies = append(result.discrepancies, &metadata.ChunkDiscrepancy{
+					Kind:    metadata.ChunkDiscrepancyKind_CHUNK_DISCREPANCY_KIND_STALE,
+					NodeId:  node.ID,
+					ChunkId: chunkId,
+					Inode:   placement.inode,
+					Detail:  fmt.Sprintf("the file places the chunk on %s", placement.node),
+				})
+			default:
+				if inodeID, ok := chunkInode(chunkId, files); ok {
+					result.discrepancies = append(result.discrepancies, &metadata.ChunkDiscrepancy{
+						Kind:    metadata.ChunkDiscrepancyKind_CHUNK_DISCREPANCY_KIND_STALE,
+						NodeId:  node.ID,
+						ChunkId: chunkId,
+						Inode:   inodeID,
+						Detail:  "left from an earlier write of the file",
+					})
+					break
+				}
+				result.discrepancies = append(result.discrepancies, &metadata.ChunkDiscrepancy{
+					Kind:    metadata.ChunkDiscrepancyKind_CHUNK_DISCREPANCY_KIND_ORPHAN,
+					NodeId:  node.ID,
+					ChunkId: chunkId,
+					Detail:  "no file references the chunk",
+				})
+			}
+		}
+
+		for _, chunkId := range byNode[node.ID] {
+			placement := placements[chunkId]
+			if now.Sub(placement.written) < reconcileGrace {
+				continue
+			}
+			if _, ok := chunks[chunkId]; ok {
+				continue
+			}
+			missing = append(missing, &metadata.ChunkDiscrepancy{
+				Kind:    metadata.ChunkDiscrepancyKind_CHUNK_DISCREPANCY_KIND_MISSING,
+				NodeId:  node.ID,
+				ChunkId: chunkId,
+				Inode:   placement.inode,
+				Detail:  "the data node does not report the chunk",
+			})
+		}
+	}
+
+	// The file may have been rewritten since the namespace was read, and
+	// the chunk removed with its earlier write
+	for _, discrepancy := range missing {
+		m.mu.RLock()
+		inode, err := m.store.Get(discrepancy.Inode)
+		m.mu.RUnlock()
+		if err != nil || !containsChunk(inode, discrepancy.ChunkId) {
+			continue
+		}
+		if dataNode, ok := m.corruptChunk(discrepancy.ChunkId); ok && dataNode == discrepancy.NodeId {
+			discrepancy.Detail = "quarantined as corrupt by the data node"
+		}
+		result.discrepancies = append(result.discrepancies, discrepancy)
+	}
+
+	sort.Slice(result.discrepancies, func(i, j int) bool {
+		a, b := result.discrepancies[i], result.discrepancies[j]
+		if a.NodeId != b.NodeId {
+			return a.NodeId < b.NodeId
+		}
+		return a.ChunkId < b.ChunkId
+	})
+
+	m.reconciler.mu.Lock()
+	previous := m.reconciler.last
+	m.reconciler.last = result
+	m.reconciler.mu.Unlock()
+
+	found := 0
+	if previous != nil {
+		found = len(previous.discrepancies)
+	}
+	if len(result.discrepancies) != found {
+		log.Printf("Reconciled block reports of %d chunks, %d discrepancies", result.checked, len(result.discrepancies))
+	}
+	return nil
+}
+
+// chunkInode returns the ID of the file a chunk was written for, if it still
+// exists. Chunk IDs are <inode>-<write>-<index>, or <inode>-<index> for
+// chunks written before writes had IDs.
+func chunkInode(chunkId string, files map[string]bool) (string, bool) {
+	i := strings.LastIndexByte(chunkId, '-')
+	if i < 0 {
+		return "", false
+	}
+	id := chunkId[:i]
+	if files[id] {
+		return id, true
+	}
+
+	// Write IDs are UUIDs
+	const writeIDLen = 36
+	if len(id) <= writeIDLen || id[len(id)-writeIDLen-1] != '-' {
+		return "", false
+	}
+	if _, err := uuid.Parse(id[len(id)-writeIDLen:]); err != nil {
+		return "", false
+	}
+	id = id[:len(id)-writeIDLen-1]
+	return id, files[id]
+}
@@ -0,0 +1,350 @@
+package metadata_service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// checkpointDir holds the checkpoints, named by the journal sequence number they cover.
+	checkpointDir = ".storage/checkpoints"
+	// legacySnapshotPath is where the namespace was saved before checkpoints.
+	legacySnapshotPath = ".storage/metadata.gob"
+	// checkpointMagic identifies a checkpoint file.
+	checkpointMagic = "GODFSCKP"
+	// checkpointVersion is the format version written by this service.
+	checkpointVersion = 1
+)
+
+// checkpointHeader precedes the gob encoded state in a checkpoint file.
+// Seq: sequence number of the last journal entry included in the checkpoint
+// Length: length of the state in bytes
+// Checksum: CRC-32C of the state
+type checkpointHeader struct {
+	Magic    [8]byte
+	Version  uint32
+	Seq      uint64
+	Length   uint64
+	Checksum uint32
+}
+
+func checkpointPath(seq uint64) string {
+	return filepath.Join(checkpointDir, fmt.Sprintf("%020d.ckpt", seq))
+}
+
+// listCheckpoints returns the sequence numbers of the checkpoints on disk,
+// newest first.
+func listCheckpoints() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(checkpointDir, "*.ckpt"))
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".ckpt"), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(a, b int) bool {
+		return seqs[a] > seqs[b]
+	})
+	return seqs, nil
+}
+
+// writeCheckpoint writes state to a temporary file and renames it into place
+// once it is synced, so a crash never leaves a partial checkpoint behind.
+func writeCheckpoint(seq uint64, state []byte) (err error) {
+	if err := os.MkdirAll(checkpointDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(checkpointDir, "checkpoint-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	header := checkpointHeader{
+		Version:  checkpointVersion,
+		Seq:      seq,
+		Length:   uint64(len(state)),
+		Checksum: crc32.Checksum(state, crcTable),
+	}
+	copy(header.Magic[:], checkpointMagic)
+
+	if err := binary.Write(file, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if _, err := file.Write(state); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), checkpointPath(seq)); err != nil {
+		return err
+	}
+	return syncDir(checkpointDir)
+}
+
+// readCheckpoint returns the state stored in the checkpoint at path after
+// checking its header and checksum.
+func readCheckpoint(path string) (uint64, []byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("Failed to close checkpoint: %v", err)
+		}
+	}()
+
+	var header checkpointHeader
+	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrCheckpointCorrupt, err)
+	}
+	if string(header.Magic[:]) != checkpointMagic {
+		return 0, nil, fmt.Errorf("%w: bad magic", ErrCheckpointCorrupt)
+	}
+	if header.Version != checkpointVersion {
+		return 0, nil, fmt.Errorf("%w: version %d", ErrCheckpointVersion, header.Version)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	if header.Length != uint64(info.Size())-uint64(binary.Size(header)) {
+		return 0, nil, fmt.Errorf("%w: expected %d bytes of state", ErrCheckpointCorrupt, header.Length)
+	}
+
+	state := make([]byte, header.Length)
+	if _, err := io.ReadFull(file, state); err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrCheckpointCorrupt, err)
+	}
+	if crc32.Checksum(state, crcTable) != header.Checksum {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", ErrCheckpointCorrupt)
+	}
+
+	return header.Seq, state, nil
+}
+
+// pruneCheckpoints removes all but the newest retain checkpoints and returns
+// the sequence number of the oldest one kept.
+func pruneCheckpoints(retain int) (uint64, error) {
+	seqs, err := listCheckpoints()
+	if err != nil {
+		return 0, err
+	}
+	if len(seqs) == 0 {
+		return 0, nil
+	}
+
+	if len(seqs) > retain {
+		for _, seq := range seqs[retain:] {
+			if err := os.Remove(checkpointPath(seq)); err != nil && !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+		seqs = seqs[:retain]
+	}
+	return seqs[len(seqs)-1], nil
+}
+
+// startCheckpointLoop checkpoints the namespace on every interval in which
+// it changed, unless a standby does.
+func (m *MetadataService) startCheckpointLoop() {
+	ticker := time.NewTicker(m.checkpointInterval)
+
+	for {
+		select {
+		case <-m.checkpointNow:
+			if err := m.SaveToDisk(); err != nil {
+				log.Printf("Error writing checkpoint: %v", err)
+			}
+		case <-ticker.C:
+			m.mu.RLock()
+			changed := m.seq != m.checkpointSeq
+			// A standby checkpoints on behalf of its primary while it is running
+			delegated := time.Since(m.standbyCheckpoint) < 2*m.checkpointInterval
+			m.mu.RUnlock()
+
+			if !changed || delegated {
+				continue
+			}
+			if err := m.SaveToDisk(); err != nil {
+				log.Printf("Error writing checkpoint: %v", err)
+			}
+		case <-m.shutdownChan:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// checkpointState is the content of a checkpoint.
+// Inodes: the namespace, empty if it is kept by a persistent store
+// Locks: advisory locks by inode ID
+// External: True if the inodes are kept by a persistent store
+type checkpointState struct {
+	Inodes   map[string]*Inode
+	Locks    map[string]*FileLock
+	External bool
+}
+
+// encodeState writes the state to checkpoint, flushing a persistent store
+// first. Must be called with m.mu held.
+func (m *MetadataService) encodeState(w io.Writer) error {
+	store, ok := m.store.(PersistentStore)
+	if !ok {
+		return m.encodeFullState(w)
+	}
+
+	// The store keeps the inodes, the checkpoint only records the rest
+	if err := store.Flush(m.seq); err != nil {
+		return err
+	}
+	return writeState(w, &checkpointState{
+		Inodes:   make(map[string]*Inode),
+		Locks:    m.locks,
+		External: true,
+	})
+}
+
+// encodeFullState writes the state with every inode, whichever store keeps
+// them, for a standby to load. Must be called with m.mu held.
+func (m *MetadataService) encodeFullState(w io.Writer) error {
+	state := &checkpointState{
+		Inodes: make(map[string]*Inode),
+		Locks:  m.locks,
+	}
+	err := m.store.ForEach(func(inode *Inode) error {
+		state.Inodes[inode.ID] = inode
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeState(w, state)
+}
+
+func writeState(w io.Writer, state *checkpointState) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(state.Inodes); err != nil {
+		return err
+	}
+	if err := enc.Encode(state.Locks); err != nil {
+		return err
+	}
+	return enc.Encode(state.External)
+}
+
+// requestCheckpoint asks the checkpoint loop for a checkpoint without waiting.
+func (m *MetadataService) requestCheckpoint() {
+	select {
+	case m.checkpointNow <- struct{}{}:
+	default:
+	}
+}
+
+// decodeState decodes the state of a checkpoint into fresh maps, so that a
+// corrupt checkpoint leaves the service untouched.
+func decodeState(r io.Reader) (*checkpointState, error) {
+	state := &checkpointState{
+		Inodes: make(map[string]*Inode),
+		Locks:  make(map[string]*FileLock),
+	}
+
+	dec := gob.NewDecoder(r)
+	if err := dec.Decode(&state.Inodes); err != nil {
+		return nil, err
+	}
+	if err := dec.Decode(&state.Locks); err != nil {
+		return nil, err
+	}
+
+	// Checkpoints taken before persistent stores always hold the inodes
+	if err := dec.Decode(&state.External); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if _, ok := state.Inodes[RootID]; !ok && !state.External {
+		return nil, fmt.Errorf("%w: root directory missing", ErrCheckpointCorrupt)
+	}
+	return state, nil
+}
+
+// loadCheckpoint loads the newest checkpoint that is intact, falling back to
+// older ones when it is not.
+func (m *MetadataService) loadCheckpoint() error {
+	seqs, err := listCheckpoints()
+	if err != nil {
+		return err
+	}
+	if len(seqs) == 0 {
+		return os.ErrNotExist
+	}
+
+	for _, seq := range seqs {
+		path := checkpointPath(seq)
+		headerSeq, data, err := readCheckpoint(path)
+		if err == nil {
+			var state *checkpointState
+			if state, err = decodeState(bytes.NewReader(data)); err == nil {
+				return m.loadState(headerSeq, state)
+			}
+		}
+		log.Printf("Skipping checkpoint %s: %v", path, err)
+	}
+
+	return ErrNoCheckpoint
+}
+
+// loadState restores the service from the state of the checkpoint at seq.
+func (m *MetadataService) loadState(seq uint64, state *checkpointState) error {
+	m.locks = state.Locks
+	m.seq = seq
+	m.checkpointSeq = seq
+
+	if !state.External {
+		m.loadInodes(state.Inodes)
+		return nil
+	}
+
+	store, ok := m.store.(PersistentStore)
+	if !ok {
+		return ErrStoreMismatch
+	}
+
+	// The store may have been flushed without the checkpoint being written,
+	// or be ahead of an older checkpoint. Replaying the journal from the
+	// earlier of the two is correct either way, as entries are redone in full.
+	if store.Seq() < m.seq {
+		m.seq = store.Seq()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package metadata_service
+
+import (
+	"context"
+	"fmt"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"os"
+	"testing"
+)
+
+// inTempDir runs the test in a new directory, as the metadata service keeps
+// its checkpoints and journal under the working directory.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatalf("Chdir: %v", err)
+		}
+	})
+}
+
+// TestCheckpointFallback checks that the service falls back to an older
+// checkpoint when the newest is corrupt, and that compaction kept the
+// journal entries needed to bring it up to date.
+func TestCheckpointFallback(t *testing.T) {
+	inTempDir(t)
+	ctx := context.Background()
+
+	cfg := DefaultConfig()
+	cfg.CheckpointRetain = 2
+	m, err := openMetadataService(cfg)
+	if err != nil {
+		t.Fatalf("openMetadataService: %v", err)
+	}
+	if err := m.journal.start(m.seq + 1); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	names := []string{"a", "b", "c", "d"}
+	for i, name := range names {
+		if _, err := m.CreateFile(ctx, &metadata.CreateFileRequest{Name: name, Parent: RootID}); err != nil {
+			t.Fatalf("CreateFile: %v", err)
+		}
+		// The last file is only in the journal
+		if i < len(names)-1 {
+			if err := m.SaveToDisk(); err != nil {
+				t.Fatalf("SaveToDisk: %v", err)
+			}
+		}
+	}
+	if err := m.journal.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	seqs, err := listCheckpoints()
+	if err != nil {
+		t.Fatalf("listCheckpoints: %v", err)
+	}
+	if fmt.Sprint(seqs) != "[3 2]" {
+		t.Fatalf("Checkpoints %v, want [3 2]", seqs)
+	}
+	file, err := os.ReadFile(checkpointPath(3))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	file[len(file)-1] ^= 0xff
+	if err := os.WriteFile(checkpointPath(3), file, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	m, err = openMetadataService(cfg)
+	if err != nil {
+		t.Fatalf("openMetadataService: %v", err)
+	}
+	if m.checkpointSeq != 2 || m.seq != 4 {
+		t.Fatalf("Loaded checkpoint %d up to %d, want checkpoint 2 up to 4", m.checkpointSeq, m.seq)
+	}
+	for _, name := range names {
+		if _, err := m.view().lookup(RootID, name); err != nil {
+			t.Errorf("lookup(%s): %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package metadata_service
+
+import (
+	"context"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"log"
+	"time"
+)
+
+const (
+	// commandRetry is the time after which a command sent to a data node
+	// that was not acknowledged is sent again.
+	commandRetry = time.Minute
+	// maxHeartbeatCommands is the number of commands sent in a single
+	// heartbeat response.
+	maxHeartbeatCommands = 100
+	// maxCommandChunks is the number of chunks a single queued command names.
+	maxCommandChunks = 1000
+	// maxQueuedCommands is the number of commands queued for a data node,
+	// beyond which the oldest are dropped.
+	maxQueuedCommands = 10000
+)
+
+// queuedCommand is a command for a data node that was not acknowledged yet.
+// sent: last time it was sent, zero until it is sent
+type queuedCommand struct {
+	command *metadata.DataNodeCommand
+	sent    time.Time
+}
+
+// queue adds a command for the data node id, and returns its ID.
+func (s *nodeSet) queue(id string, command *metadata.DataNodeCommand) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextCommand++
+	command.Id = s.nextCommand
+
+	queued := append(s.commands[id], &queuedCommand{command: command})
+	if len(queued) > maxQueuedCommands {
+		log.Printf("Too many commands queued for data node %s, dropping %d", id, len(queued)-maxQueuedCommands)
+		queued = queued[len(queued)-maxQueuedCommands:]
+	}
+	s.commands[id] = queued
+	return command.Id
+}
+
+// acknowledge removes the commands the data node id carried out, and returns
+// the commands to send to it, marking them sent at now. s.mu must be held.
+func (s *nodeSet) acknowledge(id string, completed []*metadata.CommandResult, now time.Time) []*metadata.DataNodeCommand {
+	done := make(map[uint64]bool, len(completed))
+	for _, result := range completed {
+		done[result.Id] = true
+		if result.Error != "" {
+			log.Printf("Data node %s failed command %d: %s", id, result.Id, result.Error)
+		}
+	}
+
+	var commands []*metadata.DataNodeCommand
+	queued := s.commands[id][:0]
+	for _, command := range s.commands[id] {
+		if done[command.command.Id] {
+			continue
+		}
+		queued = append(queued, command)
+
+		if len(commands) < maxHeartbeatCommands && now.Sub(command.sent) >= commandRetry {
+			command.sent = now
+			commands = append(commands, command.command)
+		}
+	}
+	if len(queued) == 0 {
+		delete(s.commands, id)
+	} else {
+		s.commands[id] = queued
+	}
+	return commands
+}
+
+// resend marks the commands queued for the data node id as not sent, as it
+// lost those in progress when it restarted. s.mu must be held.
+func (s *nodeSet) resend(id string) {
+	for _, command := range s.commands[id] {
+		command.sent = time.Time{}
+	}
+}
+
+// pendingCommands returns the number of commands queued for the data node id.
+func (s *nodeSet) pendingCommands(id string) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return uint64(len(s.commands[id]))
+}
+
+// queueChunkCommand queues commands of kind for the chunks on the data node
+// id, split so that no command names more than maxCommandChunks.
+func (m *MetadataService) queueChunkCommand(id string, kind metadata.CommandKind, chunkIDs []string, target string) uint64 {
+	var commandID uint64
+	for len(chunkIDs) > 0 {
+		n := min(len(chunkIDs), maxCommandChunks)
+		commandID = m.nodes.queue(id, &metadata.DataNodeCommand{
+			Kind:     kind,
+			ChunkIds: chunkIDs[:n],
+			Target:   target,
+		})
+		chunkIDs = chunkIDs[n:]
+	}
+	return commandID
+}
+
+// QueueCommand queues a command for a registered data node, which carries it
+// out after its next heartbeat. Commands naming many chunks are split, and
+// the ID of the last is returned.
+func (m *MetadataService) QueueCommand(
+	ctx context.Context,
+	req *metadata.QueueCommandRequest,
+) (
+	*metadata.QueueCommandResponse,
+	error,
+) {
+	log.Printf("QUEUECOMMAND\t%v", req)
+
+	if _, ok := m.nodes.get(req.NodeId); !ok {
+		return nil, ErrDataNodeUnknown
+	}
+
+	command := req.Command
+	if command == nil {
+		return nil, ErrInvalidCommand
+	}
+	switch command.Kind {
+	case metadata.CommandKind_COMMAND_KIND_DELETE, metadata.CommandKind_COMMAND_KIND_VERIFY:
+		if len(command.ChunkIds) == 0 {
+			return nil, ErrInvalidCommand
+		}
+	case metadata.CommandKind_COMMAND_KIND_REPLICATE:
+		if len(command.ChunkIds) == 0 || command.Target == "" {
+			return nil, ErrInvalidCommand
+		}
+	case metadata.CommandKind_COMMAND_KIND_REPORT:
+		id := m.nodes.queue(req.NodeId, &metadata.DataNodeCommand{Kind: command.Kind})
+		return &metadata.QueueCommandResponse{Id: id}, nil
+	default:
+		return nil, ErrInvalidCommand
+	}
+
+	id := m.queueChunkCommand(req.NodeId, command.Kind, command.ChunkIds, command.Target)
+	return &metadata.QueueCommandResponse{Id: id}, nil
+}
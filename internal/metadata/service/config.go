@@ -0,0 +1,120 @@
+package metadata_service
+
+import (
+	"github.com/apolyeti/godfs/internal/raft"
+	"log"
+	"time"
+)
+
+const (
+	// DefaultChunkSize is the cluster chunk size used when none is configured.
+	DefaultChunkSize = 4 * 1024 * 1024
+	// MaxChunkSize is the largest chunk size a file or directory may request.
+	MaxChunkSize = 64 * 1024 * 1024
+	// legacyChunkSize is the size files were split into before chunk sizes
+	// were stored on the inode.
+	legacyChunkSize = 1024
+	// MaxMsgSize leaves headroom over MaxChunkSize for the rest of a chunk
+	// message. Metadata servers and clients accept messages up to this size.
+	MaxMsgSize = MaxChunkSize + 1024*1024
+	// FilePieceSize is the most content a WriteFile request or a ReadFile
+	// response carries, so that files of any size are streamed in messages
+	// well below the default message size limit.
+	FilePieceSize = 1024 * 1024
+	// DefaultCheckpointInterval is the time between background checkpoints.
+	DefaultCheckpointInterval = time.Minute
+	// DefaultCheckpointRetain is the number of checkpoints kept on disk.
+	DefaultCheckpointRetain = 3
+	// DefaultRaftDir is where a replica keeps its raft log and snapshots.
+	DefaultRaftDir = ".storage/raft"
+	// DefaultSuspectTimeout is the time without a heartbeat after which no
+	// chunks are placed on a data node.
+	DefaultSuspectTimeout = 15 * time.Second
+	// DefaultDeadTimeout is the time without a heartbeat after which a data
+	// node is considered dead.
+	DefaultDeadTimeout = time.Minute
+	// DefaultReconcileInterval is the time between reconciliations of the
+	// block reports of the data nodes with the namespace.
+	DefaultReconcileInterval = time.Minute
+	// livenessCheckInterval is the time between checks for data nodes that
+	// stopped sending heartbeats.
+	livenessCheckInterval = time.Second
+)
+
+// Config holds the settings of the metadata service.
+// ChunkSize: Default chunk size in bytes for files whose directories do not set one
+// CheckpointInterval: Time between checkpoints of the namespace
+// CheckpointRetain: Number of checkpoints kept to fall back to
+// Store: Where inodes are kept, StoreMemory or StoreDisk
+// RaftID: ID of the service within its group of replicas, empty to run a single service
+// RaftDir: Directory the raft log and snapshots of a replica are kept in
+// RaftServers: Replicas of the group, bootstrapped when RaftDir holds no state yet
+// Standby: Address of the primary to follow as a warm standby, empty to serve on its own
+// LegacyDataNodes: Data nodes the chunks of files written before data nodes registered are kept on by position, empty if there are none
+// SuspectTimeout: Time without a heartbeat after which no chunks are placed on a data node
+// DeadTimeout: Time without a heartbeat after which a data node is considered dead
+// ReconcileInterval: Time between reconciliations of the block reports of the data nodes with the namespace
+type Config struct {
+	ChunkSize          int64
+	CheckpointInterval time.Duration
+	CheckpointRetain   int
+	Store              string
+	RaftID             string
+	RaftDir            string
+	RaftServers        []raft.Server
+	Standby            string
+	LegacyDataNodes    []string
+	SuspectTimeout     time.Duration
+	DeadTimeout        time.Duration
+	ReconcileInterval  time.Duration
+}
+
+// DefaultConfig returns the configuration used when no flags are given.
+func DefaultConfig() Config {
+	return Config{
+		ChunkSize:          DefaultChunkSize,
+		CheckpointInterval: DefaultCheckpointInterval,
+		CheckpointRetain:   DefaultCheckpointRetain,
+		Store:              StoreMemory,
+		RaftDir:            DefaultRaftDir,
+		SuspectTimeout:     DefaultSuspectTimeout,
+		DeadTimeout:        DefaultDeadTimeout,
+		ReconcileInterval:  DefaultReconcileInterval,
+	}
+}
+
+// withDefaults replaces the settings that are out of range with defaults.
+func (cfg Config) withDefaults() Config {
+	if !validChunkSize(cfg.ChunkSize) {
+		log.Printf("Invalid chunk size %d, using %d", cfg.ChunkSize, DefaultChunkSize)
+		cfg.ChunkSize = DefaultChunkSize
+	}
+	if cfg.CheckpointInterval <= 0 {
+		cfg.CheckpointInterval = DefaultCheckpointInterval
+	}
+	if cfg.CheckpointRetain < 1 {
+		cfg.CheckpointRetain = DefaultCheckpointRetain
+	}
+	if cfg.RaftDir == "" {
+		cfg.RaftDir = DefaultRaftDir
+	}
+	if cfg.SuspectTimeout <= 0 {
+		cfg.SuspectTimeout = DefaultSuspectTimeout
+	}
+	if cfg.ReconcileInterval <= 0 {
+		cfg.ReconcileInterval = DefaultReconcileInterval
+	}
+	if cfg.DeadTimeout <= 0 {
+		cfg.DeadTimeout = DefaultDeadTimeout
+	}
+	if cfg.DeadTimeout < cfg.SuspectTimeout {
+		log.Printf("Dead timeout %v is below the suspect timeout, using %v", cfg.DeadTimeout, cfg.SuspectTimeout)
+		cfg.DeadTimeout = cfg.SuspectTimeout
+	}
+	return cfg
+}
+
+// validChunkSize reports whether size can be used to split a file.
+func validChunkSize(size int64) bool {
+	return size > 0 && size <= MaxChunkSize
+}
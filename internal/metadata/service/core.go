@@ -9,17 +9,14 @@ import (
 	"errors"
 	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
 	"log"
+	"strings"
 )
 
 // GetInode returns the inode with the given ID
 func (m *MetadataService) getInode(id string) (*Inode, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	inode, ok := m.inodes[id]
-	if !ok {
-		return nil, ErrFileNotFound
-	}
-	return inode, nil
+	return m.store.Get(id)
 }
 
 func (m *MetadataService) CreateInode(
@@ -30,15 +27,25 @@ func (m *MetadataService) CreateInode(
 	error,
 ) {
 	log.Printf("CREATEINODE\t%v", req)
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if _, ok := m.inodes[req.Name]; ok {
-		return nil, ErrExists
+	// Inodes created here are keyed by name, so GetInode finds them by name
+	inode := NewInode(req.Name, req.IsDir)
+	inode.ID = req.Name
+	if !req.IsDir {
+		inode.UpdateChunkSize(m.chunkSize)
+	}
+	err := m.update(func(t *txn) error {
+		if _, ok := t.get(req.Name); ok {
+			return ErrExists
+		}
+		t.put(inode)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	m.inodes[req.Name] = NewInode(req.Name, req.IsDir)
 	return &metadata.CreateFileResponse{
 		Name:  req.Name,
-		Inode: m.inodes[req.Name].ID,
+		Inode: inode.ID,
 	}, nil
 }
 
@@ -51,16 +58,12 @@ func (m *MetadataService) GetInode(
 ) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	inode, ok := m.inodes[req.Name]
-	if !ok {
-		return nil, ErrFileNotFound
+	inode, err := m.store.Get(req.Name)
+	if err != nil {
+		return nil, err
 	}
 
-	return &metadata.Inode{
-		Name:  inode.Name,
-		Id:    inode.ID,
-		IsDir: inode.IsDir,
-	}, nil
+	return toProtoInode(inode), nil
 }
 
 func (m *MetadataService) CreateFile(
@@ -72,36 +75,16 @@ func (m *MetadataService) CreateFile(
 ) {
 	log.Printf("CREATEFILE\t%v", req)
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	parentId := req.Parent
-
-	if parentId == "" {
-		parentId = RootID
-	}
-
-	parentInode, ok := m.inodes[parentId]
-	if !ok {
-		return nil, errors.New("parent directory not found")
-	}
-
-	if !parentInode.IsDir {
-		return nil, ErrNotDir
-	}
-
-	if _, exists := parentInode.DirectoryEntries[req.Name]; exists {
-		return nil, ErrExists
+	var inode *Inode
+	err := m.update(func(t *txn) error {
+		var err error
+		inode, err = t.create(req.Parent, req.Name, req.IsDir, req.ChunkSize)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	inode := NewInode(req.Name, req.IsDir)
-
-	parentInode.DirectoryEntries[req.Name] = inode.ID
-
-	m.inodes[inode.ID] = inode
-
-	inode.ParentID = parentId
-
 	return &metadata.CreateFileResponse{
 		Name:  req.Name,
 		Inode: inode.ID,
@@ -116,12 +99,12 @@ func (m *MetadataService) GetFile(
 ) {
 	log.Printf("GETFILE\t%v", req)
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	parentInode, ok := m.inodes[req.Parent]
-	if !ok {
-		return nil, ErrFileNotFound
+	parentInode, err := m.store.Get(req.Parent)
+	if err != nil {
+		return nil, err
 	}
 	if !parentInode.IsDir {
 		return nil, ErrNotDir
@@ -132,9 +115,9 @@ func (m *MetadataService) GetFile(
 		return nil, ErrExists
 	}
 
-	inode, ok := m.inodes[inodeId]
-	if !ok {
-		return nil, ErrFileNotFound
+	inode, err := m.store.Get(inodeId)
+	if err != nil {
+		return nil, err
 	}
 	if inode.IsDir {
 		return nil, ErrIsDir
@@ -146,23 +129,91 @@ func (m *MetadataService) GetFile(
 	}, nil
 }
 
+// validName reports whether name can be used as a directory entry.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// checkGeneration returns ErrPreconditionFailed unless inode is at the
+// expected generation. An expected generation of 0 always matches.
+func checkGeneration(inode *Inode, expected uint64) error {
+	if expected != 0 && inode.Generation != expected {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// lookup returns the inode named name in the directory dirID,
+// or in the root directory if dirID is empty.
+func (m *MetadataService) lookup(dirID string, name string) (*Inode, error) {
+	return m.view().lookup(dirID, name)
+}
+
+// lookup returns the inode named name in the directory dirID,
+// or in the root directory if dirID is empty.
+func (t *txn) lookup(dirID string, name string) (*Inode, error) {
+	if dirID == "" {
+		dirID = RootID
+	}
+
+	dir, ok := t.get(dirID)
+	if !ok {
+		return nil, ErrDirNotFound
+	}
+	if !dir.IsDir {
+		return nil, ErrNotDir
+	}
+
+	inodeId, exists := dir.DirectoryEntries[name]
+	if !exists {
+		return nil, ErrFileNotFound
+	}
+
+	inode, ok := t.get(inodeId)
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	return inode, nil
+}
+
+// inheritedChunkSize returns the chunk size new files in dir should use: the
+// closest chunk size set on dir or its ancestors, or the cluster default.
+func (t *txn) inheritedChunkSize(dir *Inode) int64 {
+	for dir != nil {
+		if dir.ChunkSize != 0 {
+			return dir.ChunkSize
+		}
+		dir, _ = t.get(dir.ParentID)
+	}
+	return t.m.chunkSize
+}
+
+func toProtoInode(inode *Inode) *metadata.Inode {
+	return &metadata.Inode{
+		Name:       inode.Name,
+		Id:         inode.ID,
+		IsDir:      inode.IsDir,
+		Size:       inode.Size,
+		Parent:     inode.ParentID,
+		ChunkSize:  inode.ChunkSize,
+		Generation: inode.Generation,
+	}
+}
+
 func (m *MetadataService) listDir(inode *Inode) ([]*metadata.Inode, error) {
 
 	if !inode.IsDir {
 		return nil, ErrNotDir
 	}
 
+	children, err := m.store.Children(inode)
+	if err != nil {
+		return nil, err
+	}
+
 	var inodes []*metadata.Inode
-	for _, id := range inode.DirectoryEntries {
-		inode, ok := m.inodes[id]
-		if !ok {
-			return nil, ErrFileNotFound
-		}
-		inodes = append(inodes, &metadata.Inode{
-			Name:  inode.Name,
-			Id:    inode.ID,
-			IsDir: inode.IsDir,
-		})
+	for _, child := range children {
+		inodes = append(inodes, toProtoInode(child))
 	}
 	return inodes, nil
 }
@@ -176,31 +227,31 @@ func (m *MetadataService) ListDir(
 ) {
 	log.Printf("LISTDIR\t%v", req)
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	var dirInode *Inode
-	var ok bool
+	var err error
 
 	if req.DirectoryId != "" {
 		// Look up by DirectoryID
-		dirInode, ok = m.inodes[req.DirectoryId]
-		if !ok {
-			return nil, ErrFileNotFound
+		dirInode, err = m.store.Get(req.DirectoryId)
+		if err != nil {
+			return nil, err
 		}
 	} else if req.DirectoryName != "" && req.ParentId != "" {
 		// Look up by DirectoryName and ParentID
-		parentInode, ok := m.inodes[req.ParentId]
-		if !ok {
-			return nil, ErrFileNotFound
+		parentInode, err := m.store.Get(req.ParentId)
+		if err != nil {
+			return nil, err
 		}
 		dirInodeID, exists := parentInode.DirectoryEntries[req.DirectoryName]
 		if !exists {
 			return nil, ErrFileNotFound
 		}
-		dirInode, ok = m.inodes[dirInodeID]
-		if !ok {
-			return nil, ErrFileNotFound
+		dirInode, err = m.store.Get(dirInodeID)
+		if err != nil {
+			return nil, err
 		}
 	} else {
 		return nil, errors.New("directory identifier not provided")
@@ -225,20 +276,20 @@ func (m *MetadataService) ChangeDir(
 ) {
 	log.Printf("CHANGEDIR\t%v", req)
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	currentInode, ok := m.inodes[req.CurrentDirectoryId]
-	if !ok {
-		return nil, ErrFileNotFound
+	currentInode, err := m.store.Get(req.CurrentDirectoryId)
+	if err != nil {
+		return nil, err
 	}
 
 	switch req.TargetDirectoryId {
 	case "..":
 		if currentInode.ID != RootID {
-			parentInode, ok := m.inodes[currentInode.ParentID]
-			if !ok {
-				return nil, ErrFileNotFound
+			parentInode, err := m.store.Get(currentInode.ParentID)
+			if err != nil {
+				return nil, err
 			}
 			currentInode = parentInode
 		}
@@ -246,7 +297,9 @@ func (m *MetadataService) ChangeDir(
 		// Do nothing
 	case "":
 		// Go to root
-		currentInode = m.inodes[RootID]
+		if currentInode, err = m.store.Get(RootID); err != nil {
+			return nil, err
+		}
 	default:
 		// Because the client provides the NAME of the target directory,
 		// We need to look up the ID of the target directory, which is done
@@ -257,9 +310,9 @@ func (m *MetadataService) ChangeDir(
 			return nil, ErrFileNotFound
 		}
 
-		targetInode, ok := m.inodes[targetDirectoryId]
-		if !ok {
-			return nil, ErrFileNotFound
+		targetInode, err := m.store.Get(targetDirectoryId)
+		if err != nil {
+			return nil, err
 		}
 
 		currentInode = targetInode
@@ -270,3 +323,131 @@ func (m *MetadataService) ChangeDir(
 		DirectoryName: currentInode.Name,
 	}, nil
 }
+
+func (m *MetadataService) Remove(
+	ctx context.Context,
+	req *metadata.RemoveRequest,
+) (
+	*metadata.RemoveResponse,
+	error,
+) {
+	log.Printf("REMOVE\t%v", req)
+
+	var inode *Inode
+	err := m.update(func(t *txn) error {
+		var err error
+		if inode, err = t.lookup(req.CurrentDirectoryId, req.FileName); err != nil {
+			return err
+		}
+
+		_, err = t.remove(inode, req.Owner, req.ExpectedGeneration)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata.RemoveResponse{
+		Inode: inode.ID,
+	}, nil
+}
+
+// dropInode forgets an inode that is no longer reachable, along with its
+// locks and the chunks holding its data.
+func (m *MetadataService) dropInode(inode *Inode) {
+	m.store.Apply(nil, []string{inode.ID})
+	delete(m.locks, inode.ID)
+	m.releaseInode(inode)
+}
+
+// releaseInode frees the chunks a dropped inode still holds on the data nodes.
+func (m *MetadataService) releaseInode(inode *Inode) {
+	if len(inode.ChunkIDs) > 0 {
+		m.deleteChunks(inode.ChunkIDs, inode.ChunkNodes)
+	}
+}
+
+func (m *MetadataService) Rename(
+	ctx context.Context,
+	req *metadata.RenameRequest,
+) (
+	*metadata.RenameResponse,
+	error,
+) {
+	log.Printf("RENAME\t%v", req)
+
+	var inode *Inode
+	err := m.update(func(t *txn) error {
+		var err error
+		if inode, err = t.lookup(req.CurrentDirectoryId, req.FileName); err != nil {
+			return err
+		}
+
+		targetDir := req.TargetDirectoryId
+		if targetDir == "" {
+			targetDir = inode.ParentID
+		}
+
+		newName := req.NewName
+		if newName == "" {
+			newName = inode.Name
+		}
+
+		inode, err = t.rename(inode, targetDir, newName, req.Owner, req.ExpectedGeneration)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata.RenameResponse{
+		Inode:      inode.ID,
+		Generation: inode.Generation,
+	}, nil
+}
+
+func (m *MetadataService) SetAttr(
+	ctx context.Context,
+	req *metadata.SetAttrRequest,
+) (
+	*metadata.Inode,
+	error,
+) {
+	log.Printf("SETATTR\t%v", req)
+
+	var inode *Inode
+	err := m.update(func(t *txn) error {
+		var err error
+		if inode, err = t.lookup(req.CurrentDirectoryId, req.FileName); err != nil {
+			return err
+		}
+
+		inode, err = t.setAttr(inode, req.Attributes, req.Owner, req.ExpectedGeneration)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return toProtoInode(inode), nil
+}
+
+func (m *MetadataService) Stat(
+	ctx context.Context,
+	req *metadata.StatRequest,
+) (
+	*metadata.Inode,
+	error,
+) {
+	log.Printf("STAT\t%v", req)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	inode, err := m.lookup(req.CurrentDirectoryId, req.FileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return toProtoInode(inode), nil
+}
@@ -0,0 +1,126 @@
+package metadata_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pb "github.com/apolyeti/godfs/internal/data_node/genproto"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// TestStaleGeneration checks that every operation taking an expected
+// generation rejects a stale one without changing the file, and accepts the
+// current one.
+func TestStaleGeneration(t *testing.T) {
+	dataNode := serveTest(t, func(s *grpc.Server) {
+		pb.RegisterDataNodeServiceServer(s, newTestDataNode())
+	})
+	m := newTestService(t, []string{dataNode})
+	address := serveTest(t, func(s *grpc.Server) {
+		metadata.RegisterMetadataServiceServer(s, m)
+	})
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer conn.Close()
+	client := metadata.NewMetadataServiceClient(conn)
+	ctx := context.Background()
+	permissions := "rw-------"
+
+	tests := []struct {
+		name string
+		op   func(name string, generation uint64) error
+	}{
+		{
+			name: "SetAttr",
+			op: func(name string, generation uint64) error {
+				_, err := m.SetAttr(ctx, &metadata.SetAttrRequest{
+					FileName:           name,
+					Attributes:         &metadata.Attributes{Permissions: &permissions},
+					ExpectedGeneration: generation,
+				})
+				return err
+			},
+		},
+		{
+			name: "Rename",
+			op: func(name string, generation uint64) error {
+				_, err := m.Rename(ctx, &metadata.RenameRequest{
+					FileName:           name,
+					NewName:            name + "-renamed",
+					ExpectedGeneration: generation,
+				})
+				return err
+			},
+		},
+		{
+			name: "Remove",
+			op: func(name string, generation uint64) error {
+				_, err := m.Remove(ctx, &metadata.RemoveRequest{FileName: name, ExpectedGeneration: generation})
+				return err
+			},
+		},
+		{
+			name: "WriteFile",
+			op: func(name string, generation uint64) error {
+				write, err := client.WriteFile(ctx)
+				if err != nil {
+					return err
+				}
+				err = write.Send(&metadata.WriteFileRequest{FileName: name, Data: []byte("data"), ExpectedGeneration: generation})
+				if err != nil {
+					return err
+				}
+				_, err = write.CloseAndRecv()
+				if status.Code(err) == codes.FailedPrecondition {
+					return ErrPreconditionFailed
+				}
+				return err
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("file-%d", i)
+			if _, err := m.CreateFile(ctx, &metadata.CreateFileRequest{Name: name, Parent: RootID}); err != nil {
+				t.Fatalf("CreateFile: %v", err)
+			}
+			stale, err := m.lookup(RootID, name)
+			if err != nil {
+				t.Fatalf("lookup: %v", err)
+			}
+			if _, err := m.SetAttr(ctx, &metadata.SetAttrRequest{FileName: name, Attributes: &metadata.Attributes{}}); err != nil {
+				t.Fatalf("SetAttr: %v", err)
+			}
+			current, err := m.lookup(RootID, name)
+			if err != nil {
+				t.Fatalf("lookup: %v", err)
+			}
+			if current.Generation == stale.Generation {
+				t.Fatalf("Generation %d did not change", current.Generation)
+			}
+
+			if err := tt.op(name, stale.Generation); !errors.Is(err, ErrPreconditionFailed) {
+				t.Fatalf("%s at a stale generation = %v, want %v", tt.name, err, ErrPreconditionFailed)
+			}
+			after, err := m.lookup(RootID, name)
+			if err != nil {
+				t.Fatalf("lookup after a stale %s: %v", tt.name, err)
+			}
+			if after != current {
+				t.Fatalf("File changed by a stale %s: %+v, want %+v", tt.name, after, current)
+			}
+
+			if err := tt.op(name, current.Generation); err != nil {
+				t.Fatalf("%s at the current generation: %v", tt.name, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,827 @@
+package metadata_service
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// diskStoreDir holds the tables and manifest of the disk store.
+	diskStoreDir = ".storage/store"
+	// diskStoreManifest lists the live tables, newest first.
+	diskStoreManifest = "MANIFEST"
+	// diskStoreMaxTables is the number of tables above which they are merged into one.
+	diskStoreMaxTables = 8
+	// diskStoreFlushSize is the number of pending changes that triggers an early checkpoint.
+	diskStoreFlushSize = 64 * 1024
+	// tableIndexInterval is the number of records between entries of a table's sparse index.
+	tableIndexInterval = 64
+	// tableMagic ends every table file.
+	tableMagic = 0x676f646673747331 // "godfsts1"
+	// tableFooterSize is the size of the footer: index offset, record count and magic.
+	tableFooterSize = 24
+	// tableTombstone is the value length recorded for a deleted inode.
+	tableTombstone = math.MaxUint32
+)
+
+// diskManifest is the durable description of a disk store.
+// Seq: sequence number of the last journal entry included in the tables
+// Tables: file names of the live tables, newest first
+// NextTable: number used to name the next table
+// Migrated: True once the inodes in the tables were brought up to date with
+// the service, so that it need not read every inode when it starts
+// Unlinked: IDs of the inodes in the tables removed while open
+type diskManifest struct {
+	Seq       uint64
+	Tables    []string
+	NextTable uint64
+	Migrated  bool
+	Unlinked  []string
+}
+
+// diskStore is a log-structured MetadataStore. Changes collect in a memtable
+// until a checkpoint flushes them to an immutable sorted table, and tables are
+// merged once there are too many. Only the sparse index of each table is kept
+// in memory, so the namespace is bounded by disk rather than RAM. Changes not
+// yet flushed are recovered from the journal after a crash.
+// mem: changes since the last flush, nil for removed inodes
+// tables: open tables, newest first
+// migrated: whether the inodes were brought up to date, as of the last change
+// unlinked: IDs of the inodes removed while open, as of the last change
+// flushed: Migrated and Unlinked as of the last flush, for the manifest
+type diskStore struct {
+	dir       string
+	mu        sync.RWMutex
+	mem       map[string]*Inode
+	tables    []*table
+	seq       uint64
+	nextTable uint64
+	migrated  bool
+	unlinked  map[string]struct{}
+	flushed   diskManifest
+	compactMu sync.Mutex
+}
+
+func openDiskStore(dir string) (*diskStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	s := &diskStore{
+		dir:      dir,
+		mem:      make(map[string]*Inode),
+		unlinked: make(map[string]struct{}),
+	}
+
+	var manifest diskManifest
+	data, err := os.ReadFile(filepath.Join(dir, diskStoreManifest))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrStoreCorrupt, err)
+		}
+	}
+
+	live := make(map[string]struct{})
+	for _, name := range manifest.Tables {
+		t, err := openTable(filepath.Join(dir, name))
+		if err != nil {
+			s.closeTables()
+			return nil, err
+		}
+		s.tables = append(s.tables, t)
+		live[name] = struct{}{}
+	}
+	s.seq = manifest.Seq
+	s.nextTable = manifest.NextTable
+	s.migrated = manifest.Migrated
+	for _, id := range manifest.Unlinked {
+		s.unlinked[id] = struct{}{}
+	}
+	s.flushed = diskManifest{Migrated: manifest.Migrated, Unlinked: manifest.Unlinked}
+
+	// Tables left behind by a flush or merge that did not finish
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		s.closeTables()
+		return nil, err
+	}
+	for _, entry := range entries {
+		if _, ok := live[entry.Name()]; ok || entry.Name() == diskStoreManifest {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("Failed to remove stale store file %s: %v", entry.Name(), err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *diskStore) Get(id string) (*Inode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if inode, ok := s.mem[id]; ok {
+		if inode == nil {
+			return nil, ErrFileNotFound
+		}
+		return inode, nil
+	}
+
+	for _, t := range s.tables {
+		value, found, err := t.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		if value == nil {
+			return nil, ErrFileNotFound
+		}
+		return decodeInode(value)
+	}
+	return nil, ErrFileNotFound
+}
+
+func (s *diskStore) Children(dir *Inode) ([]*Inode, error) {
+	return children(s, dir)
+}
+
+func (s *diskStore) Apply(puts []*Inode, deletes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range deletes {
+		s.mem[id] = nil
+		delete(s.unlinked, id)
+	}
+	for _, inode := range puts {
+		s.mem[inode.ID] = inode
+		if inode.Unlinked {
+			s.unlinked[inode.ID] = struct{}{}
+		} else {
+			delete(s.unlinked, inode.ID)
+		}
+	}
+}
+
+func (s *diskStore) ForEach(fn func(*Inode) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.merge(s.sources(s.tables, true), true, func(key string, value []byte) error {
+		inode, err := decodeInode(value)
+		if err != nil {
+			return err
+		}
+		return fn(inode)
+	})
+}
+
+// Snapshot copies the memtable, and keeps the tables open until it is
+// released even if they are merged meanwhile.
+func (s *diskStore) Snapshot() StoreSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := &diskSnapshot{
+		s:      s,
+		mem:    make(map[string]*Inode, len(s.mem)),
+		tables: append([]*table(nil), s.tables...),
+	}
+	for id, inode := range s.mem {
+		snap.mem[id] = inode
+	}
+	for _, t := range snap.tables {
+		t.refs++
+	}
+	return snap
+}
+
+// Migrated reports whether the inodes were brought up to date with the
+// service since the store was created or last imported into.
+func (s *diskStore) Migrated() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.migrated
+}
+
+// SetMigrated records whether the inodes are up to date, with the next flush.
+func (s *diskStore) SetMigrated(migrated bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.migrated = migrated
+}
+
+// Unlinked returns the IDs of the inodes removed while open.
+func (s *diskStore) Unlinked() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.unlinkedIDs()
+}
+
+// unlinkedIDs returns the IDs in s.unlinked in order. Must be called with
+// s.mu held.
+func (s *diskStore) unlinkedIDs() []string {
+	ids := make([]string, 0, len(s.unlinked))
+	for id := range s.unlinked {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *diskStore) Seq() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.seq
+}
+
+func (s *diskStore) Pending() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.mem)
+}
+
+// Flush writes the memtable to a new table. It must not run concurrently
+// with Apply, which the service ensures by holding m.mu.
+func (s *diskStore) Flush(seq uint64) error {
+	// The name is taken up front so a merge started meanwhile cannot reuse it
+	s.mu.Lock()
+	name := fmt.Sprintf("%020d.sst", s.nextTable)
+	empty := len(s.mem) == 0
+	if !empty {
+		s.nextTable++
+	}
+	s.mu.Unlock()
+
+	var t *table
+	if !empty {
+		path := filepath.Join(s.dir, name)
+		err := writeTable(path, func(add func(key string, value []byte) error) error {
+			return s.merge([]recordIter{newMemIter(s.mem)}, false, add)
+		})
+		if err != nil {
+			return err
+		}
+		if t, err = openTable(path); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	if t != nil {
+		s.tables = append([]*table{t}, s.tables...)
+		s.mem = make(map[string]*Inode)
+	}
+	s.seq = seq
+	s.flushed = diskManifest{Migrated: s.migrated, Unlinked: s.unlinkedIDs()}
+	err := s.writeManifest()
+	merge := len(s.tables) > diskStoreMaxTables
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if merge {
+		go s.compact()
+	}
+	return nil
+}
+
+// compact merges every table into one. Tables flushed while it runs are
+// kept in front of the merged one.
+func (s *diskStore) compact() {
+	if !s.compactMu.TryLock() {
+		return
+	}
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	old := append([]*table(nil), s.tables...)
+	name := fmt.Sprintf("%020d.sst", s.nextTable)
+	s.nextTable++
+	s.mu.Unlock()
+
+	// The oldest table takes part, so removed inodes can be dropped for good
+	path := filepath.Join(s.dir, name)
+	err := writeTable(path, func(add func(key string, value []byte) error) error {
+		return s.merge(s.sources(old, false), true, add)
+	})
+	if err != nil {
+		log.Printf("Failed to merge store tables: %v", err)
+		return
+	}
+	merged, err := openTable(path)
+	if err != nil {
+		log.Printf("Failed to open merged store table: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.tables = append(s.tables[:len(s.tables)-len(old)], merged)
+	err = s.writeManifest()
+
+	// Tables still read by snapshots are removed once they are released
+	var unused []*table
+	if err == nil {
+		for _, t := range old {
+			t.merged = true
+			if t.refs == 0 {
+				unused = append(unused, t)
+			}
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to record merged store table: %v", err)
+		return
+	}
+	removeTables(unused)
+}
+
+// release lets go of the tables of a snapshot, and removes those merged
+// since that no other snapshot reads.
+func (s *diskStore) release(tables []*table) {
+	s.mu.Lock()
+	var unused []*table
+	for _, t := range tables {
+		if t.refs--; t.refs == 0 && t.merged {
+			unused = append(unused, t)
+		}
+	}
+	s.mu.Unlock()
+	removeTables(unused)
+}
+
+func removeTables(tables []*table) {
+	for _, t := range tables {
+		if err := t.close(); err != nil {
+			log.Printf("Failed to close store table: %v", err)
+		}
+		if err := os.Remove(t.path); err != nil {
+			log.Printf("Failed to remove store table: %v", err)
+		}
+	}
+}
+
+// diskSnapshot is a snapshot of a diskStore.
+type diskSnapshot struct {
+	s      *diskStore
+	mem    map[string]*Inode
+	tables []*table
+}
+
+func (snap *diskSnapshot) ForEach(fn func(*Inode) error) error {
+	iters := append([]recordIter{newMemIter(snap.mem)}, snap.s.sources(snap.tables, false)...)
+	return snap.s.merge(iters, true, func(key string, value []byte) error {
+		inode, err := decodeInode(value)
+		if err != nil {
+			return err
+		}
+		return fn(inode)
+	})
+}
+
+func (snap *diskSnapshot) Release() {
+	snap.s.release(snap.tables)
+}
+
+func (s *diskStore) Close() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeTables()
+}
+
+func (s *diskStore) closeTables() error {
+	var firstErr error
+	for _, t := range s.tables {
+		if err := t.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.tables = nil
+	return firstErr
+}
+
+// writeManifest atomically replaces the manifest. Must be called with s.mu held.
+func (s *diskStore) writeManifest() error {
+	manifest := diskManifest{
+		Seq:       s.seq,
+		NextTable: s.nextTable,
+		Migrated:  s.flushed.Migrated,
+		Unlinked:  s.flushed.Unlinked,
+	}
+	for _, t := range s.tables {
+		manifest.Tables = append(manifest.Tables, filepath.Base(t.path))
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, diskStoreManifest)
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// sources returns iterators over the memtable, if withMem is set, and tables,
+// newest first.
+func (s *diskStore) sources(tables []*table, withMem bool) []recordIter {
+	var iters []recordIter
+	if withMem {
+		iters = append(iters, newMemIter(s.mem))
+	}
+	for _, t := range tables {
+		iters = append(iters, t.iter())
+	}
+	return iters
+}
+
+// merge calls fn for every key of iters in order, with the value from the
+// newest iterator holding it. Removed inodes are passed as nil values unless
+// dropDeleted is set.
+func (s *diskStore) merge(iters []recordIter, dropDeleted bool, fn func(key string, value []byte) error) error {
+	type head struct {
+		key   string
+		value []byte
+		ok    bool
+	}
+
+	heads := make([]head, len(iters))
+	advance := func(i int) error {
+		key, value, err := iters[i].next()
+		if err == io.EOF {
+			heads[i] = head{}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		heads[i] = head{key: key, value: value, ok: true}
+		return nil
+	}
+	for i := range iters {
+		if err := advance(i); err != nil {
+			return err
+		}
+	}
+
+	for {
+		// Iterators are newest first, so the first one holding the smallest key wins
+		winner := -1
+		for i, h := range heads {
+			if h.ok && (winner < 0 || h.key < heads[winner].key) {
+				winner = i
+			}
+		}
+		if winner < 0 {
+			return nil
+		}
+
+		key, value := heads[winner].key, heads[winner].value
+		for i, h := range heads {
+			if h.ok && h.key == key {
+				if err := advance(i); err != nil {
+					return err
+				}
+			}
+		}
+
+		if value == nil && dropDeleted {
+			continue
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+}
+
+func encodeInode(inode *Inode) ([]byte, error) {
+	return json.Marshal(inode)
+}
+
+func decodeInode(value []byte) (*Inode, error) {
+	var inode Inode
+	if err := json.Unmarshal(value, &inode); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStoreCorrupt, err)
+	}
+	return &inode, nil
+}
+
+// recordIter yields key-value records in key order, then io.EOF.
+// A nil value marks a removed inode.
+type recordIter interface {
+	next() (string, []byte, error)
+}
+
+// memIter iterates over a memtable in key order.
+type memIter struct {
+	mem  map[string]*Inode
+	keys []string
+}
+
+func newMemIter(mem map[string]*Inode) *memIter {
+	keys := make([]string, 0, len(mem))
+	for key := range mem {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return &memIter{mem: mem, keys: keys}
+}
+
+func (it *memIter) next() (string, []byte, error) {
+	if len(it.keys) == 0 {
+		return "", nil, io.EOF
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+
+	inode := it.mem[key]
+	if inode == nil {
+		return key, nil, nil
+	}
+	value, err := encodeInode(inode)
+	return key, value, err
+}
+
+// table is an immutable file of records sorted by key:
+//
+//	records: [key length u32][value length u32][key][value] ...
+//	index:   [key length u32][key][record offset u64] every tableIndexInterval records
+//	footer:  [index offset u64][record count u64][magic u64]
+//
+// Only the index is held in memory.
+// refs: number of snapshots reading the table, guarded by the store's mu
+// merged: True once merged into another table, guarded by the store's mu
+type table struct {
+	path        string
+	file        *os.File
+	index       []tableIndexEntry
+	indexOffset int64
+	refs        int
+	merged      bool
+}
+
+type tableIndexEntry struct {
+	key    string
+	offset int64
+}
+
+// writeTable writes the records passed to add by fill, which must be in key
+// order, to a new table at path.
+func writeTable(path string, fill func(add func(key string, value []byte) error) error) (err error) {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	w := bufio.NewWriter(file)
+	var offset int64
+	var count uint64
+	var index []tableIndexEntry
+
+	err = fill(func(key string, value []byte) error {
+		if count%tableIndexInterval == 0 {
+			index = append(index, tableIndexEntry{key: key, offset: offset})
+		}
+		count++
+
+		var header [8]byte
+		binary.LittleEndian.PutUint32(header[0:4], uint32(len(key)))
+		if value == nil {
+			binary.LittleEndian.PutUint32(header[4:8], tableTombstone)
+		} else {
+			binary.LittleEndian.PutUint32(header[4:8], uint32(len(value)))
+		}
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := w.WriteString(key); err != nil {
+			return err
+		}
+		if _, err := w.Write(value); err != nil {
+			return err
+		}
+		offset += int64(len(header) + len(key) + len(value))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	indexOffset := offset
+	for _, entry := range index {
+		var buf [8]byte
+		binary.LittleEndian.PutUint32(buf[0:4], uint32(len(entry.key)))
+		if _, err := w.Write(buf[0:4]); err != nil {
+			return err
+		}
+		if _, err := w.WriteString(entry.key); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(buf[:], uint64(entry.offset))
+		if _, err := w.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+
+	var footer [tableFooterSize]byte
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(indexOffset))
+	binary.LittleEndian.PutUint64(footer[8:16], count)
+	binary.LittleEndian.PutUint64(footer[16:24], tableMagic)
+	if _, err := w.Write(footer[:]); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func openTable(path string) (*table, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := loadTable(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("%w: %s: %v", ErrStoreCorrupt, path, err)
+	}
+	t.path = path
+	return t, nil
+}
+
+func loadTable(file *os.File) (*table, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < tableFooterSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var footer [tableFooterSize]byte
+	if _, err := file.ReadAt(footer[:], info.Size()-tableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(footer[16:24]) != tableMagic {
+		return nil, fmt.Errorf("bad magic")
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	if indexOffset < 0 || indexOffset > info.Size()-tableFooterSize {
+		return nil, fmt.Errorf("bad index offset")
+	}
+
+	t := &table{file: file, indexOffset: indexOffset}
+	r := bufio.NewReader(io.NewSectionReader(file, indexOffset, info.Size()-tableFooterSize-indexOffset))
+	for {
+		var buf [8]byte
+		if _, err := io.ReadFull(r, buf[0:4]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		key := make([]byte, binary.LittleEndian.Uint32(buf[0:4]))
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		t.index = append(t.index, tableIndexEntry{
+			key:    string(key),
+			offset: int64(binary.LittleEndian.Uint64(buf[:])),
+		})
+	}
+	return t, nil
+}
+
+// get returns the value recorded for key, nil if it was removed.
+// found is false if the table holds no record of key.
+func (t *table) get(key string) (value []byte, found bool, err error) {
+	// The last index entry at or before key starts the block that may hold it
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > key
+	}) - 1
+	if i < 0 {
+		return nil, false, nil
+	}
+
+	end := t.indexOffset
+	if i+1 < len(t.index) {
+		end = t.index[i+1].offset
+	}
+	it := &tableIter{
+		r: bufio.NewReader(io.NewSectionReader(t.file, t.index[i].offset, end-t.index[i].offset)),
+	}
+	for {
+		k, v, err := it.next()
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if k == key {
+			return v, true, nil
+		}
+		if k > key {
+			return nil, false, nil
+		}
+	}
+}
+
+func (t *table) iter() *tableIter {
+	return &tableIter{
+		r: bufio.NewReader(io.NewSectionReader(t.file, 0, t.indexOffset)),
+	}
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
+
+// tableIter reads the records of a table in order.
+type tableIter struct {
+	r *bufio.Reader
+}
+
+func (it *tableIter) next() (string, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(it.r, header[:]); err != nil {
+		if err == io.EOF {
+			return "", nil, io.EOF
+		}
+		return "", nil, fmt.Errorf("%w: %v", ErrStoreCorrupt, err)
+	}
+
+	key := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(it.r, key); err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrStoreCorrupt, err)
+	}
+
+	length := binary.LittleEndian.Uint32(header[4:8])
+	if length == tableTombstone {
+		return string(key), nil, nil
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(it.r, value); err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrStoreCorrupt, err)
+	}
+	return string(key), value, nil
+}
@@ -0,0 +1,355 @@
+package metadata_service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// storeStep is one change made to a disk store by a test.
+// put: inodes to store, by ID with their names
+// del: IDs of the inodes to remove
+// flush: flush the store after the change
+// compact: merge the tables after the change
+// reopen: close and open the store again after the change
+type storeStep struct {
+	put     map[string]string
+	del     []string
+	flush   bool
+	compact bool
+	reopen  bool
+}
+
+func TestDiskStore(t *testing.T) {
+	tests := []struct {
+		name       string
+		steps      []storeStep
+		want       map[string]string
+		wantTables int
+	}{
+		{
+			name:  "memtable only",
+			steps: []storeStep{{put: map[string]string{"a": "1", "b": "2"}}},
+			want:  map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name: "flushed and reopened",
+			steps: []storeStep{
+				{put: map[string]string{"a": "1", "b": "2"}, flush: true, reopen: true},
+			},
+			want:       map[string]string{"a": "1", "b": "2"},
+			wantTables: 1,
+		},
+		{
+			name: "unflushed changes are lost on reopen",
+			steps: []storeStep{
+				{put: map[string]string{"a": "1"}, flush: true},
+				{put: map[string]string{"a": "2", "b": "3"}, reopen: true},
+			},
+			want:       map[string]string{"a": "1"},
+			wantTables: 1,
+		},
+		{
+			name: "newer table wins",
+			steps: []storeStep{
+				{put: map[string]string{"a": "1", "b": "1"}, flush: true},
+				{put: map[string]string{"a": "2"}, flush: true},
+				{put: map[string]string{"b": "3"}},
+			},
+			want:       map[string]string{"a": "2", "b": "3"},
+			wantTables: 2,
+		},
+		{
+			name: "tombstone hides older table",
+			steps: []storeStep{
+				{put: map[string]string{"a": "1", "b": "2"}, flush: true},
+				{del: []string{"a"}, flush: true, reopen: true},
+			},
+			want:       map[string]string{"b": "2"},
+			wantTables: 2,
+		},
+		{
+			name: "tombstone in memtable",
+			steps: []storeStep{
+				{put: map[string]string{"a": "1", "b": "2"}, flush: true},
+				{del: []string{"b"}},
+			},
+			want:       map[string]string{"a": "1"},
+			wantTables: 1,
+		},
+		{
+			name: "put after delete",
+			steps: []storeStep{
+				{put: map[string]string{"a": "1"}, flush: true},
+				{del: []string{"a"}, flush: true},
+				{put: map[string]string{"a": "2"}, flush: true},
+			},
+			want:       map[string]string{"a": "2"},
+			wantTables: 3,
+		},
+		{
+			name: "compaction merges tables and drops tombstones",
+			steps: []storeStep{
+				{put: map[string]string{"a": "1", "b": "1", "c": "1"}, flush: true},
+				{put: map[string]string{"b": "2"}, flush: true},
+				{del: []string{"c"}, flush: true, compact: true, reopen: true},
+			},
+			want:       map[string]string{"a": "1", "b": "2"},
+			wantTables: 1,
+		},
+		{
+			name: "compaction keeps the memtable",
+			steps: []storeStep{
+				{put: map[string]string{"a": "1"}, flush: true},
+				{put: map[string]string{"b": "1"}, flush: true},
+				{put: map[string]string{"a": "2"}, compact: true},
+			},
+			want:       map[string]string{"a": "2", "b": "1"},
+			wantTables: 1,
+		},
+		{
+			name: "flush after compaction",
+			steps: []storeStep{
+				{put: map[string]string{"a": "1"}, flush: true},
+				{put: map[string]string{"b": "1"}, flush: true, compact: true},
+				{del: []string{"a"}, flush: true, reopen: true},
+			},
+			want:       map[string]string{"b": "1"},
+			wantTables: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestDiskStore(t, dir)
+
+			var seq uint64
+			for _, step := range tt.steps {
+				var puts []*Inode
+				for id, name := range step.put {
+					puts = append(puts, &Inode{ID: id, Name: name})
+				}
+				s.Apply(puts, step.del)
+
+				if step.flush {
+					seq++
+					if err := s.Flush(seq); err != nil {
+						t.Fatalf("Flush: %v", err)
+					}
+				}
+				if step.compact {
+					s.compact()
+				}
+				if step.reopen {
+					if err := s.Close(); err != nil {
+						t.Fatalf("Close: %v", err)
+					}
+					s = openTestDiskStore(t, dir)
+				}
+			}
+
+			if got := storeNames(t, s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ForEach = %v, want %v", got, tt.want)
+			}
+			for id, name := range tt.want {
+				inode, err := s.Get(id)
+				if err != nil || inode.Name != name {
+					t.Errorf("Get(%q) = %v, %v, want name %q", id, inode, err, name)
+				}
+			}
+			if _, err := s.Get("missing"); err != ErrFileNotFound {
+				t.Errorf("Get(missing) = %v, want ErrFileNotFound", err)
+			}
+			if len(s.tables) != tt.wantTables {
+				t.Errorf("%d tables, want %d", len(s.tables), tt.wantTables)
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		})
+	}
+}
+
+// TestDiskStoreStaleFiles checks that files left behind by a flush or merge
+// that did not finish are removed when the store is opened.
+func TestDiskStoreStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestDiskStore(t, dir)
+	s.Apply([]*Inode{{ID: "a", Name: "1"}}, nil)
+	if err := s.Flush(1); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	stale := []string{"00000000000000000099.sst", "00000000000000000100.sst.tmp", diskStoreManifest + ".tmp"}
+	for _, name := range stale {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s = openTestDiskStore(t, dir)
+	defer s.Close()
+	for _, name := range stale {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("stale file %s was not removed: %v", name, err)
+		}
+	}
+	if got, want := storeNames(t, s), map[string]string{"a": "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEach = %v, want %v", got, want)
+	}
+}
+
+// TestDiskStoreCompactDuringFlush merges tables while more are flushed, and
+// checks that no change is lost and the manifest lists every live table.
+func TestDiskStoreCompactDuringFlush(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestDiskStore(t, dir)
+
+	const flushes = 4 * diskStoreMaxTables
+	want := make(map[string]string)
+	var wg sync.WaitGroup
+	for i := 1; i <= flushes; i++ {
+		id := fmt.Sprintf("inode-%03d", i)
+		s.Apply([]*Inode{{ID: id, Name: "1"}, {ID: "shared", Name: id}}, nil)
+		want[id] = "1"
+		want["shared"] = id
+		if i%3 == 0 {
+			s.Apply(nil, []string{id})
+			delete(want, id)
+		}
+		if err := s.Flush(uint64(i)); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.compact()
+		}()
+	}
+	wg.Wait()
+	s.compact()
+
+	if got := storeNames(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEach = %v, want %v", got, want)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s = openTestDiskStore(t, dir)
+	defer s.Close()
+	if got := storeNames(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEach after reopen = %v, want %v", got, want)
+	}
+	if s.Seq() != flushes {
+		t.Errorf("Seq = %d, want %d", s.Seq(), flushes)
+	}
+}
+
+// TestDiskStoreSnapshot checks that a snapshot is unaffected by later changes
+// and merges, and that merged tables are removed once it is released.
+func TestDiskStoreSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestDiskStore(t, dir)
+	defer s.Close()
+
+	s.Apply([]*Inode{{ID: "a", Name: "1"}, {ID: "b", Name: "1"}}, nil)
+	if err := s.Flush(1); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	s.Apply([]*Inode{{ID: "c", Name: "1"}}, nil)
+	snap := s.Snapshot()
+	old := s.tables[0].path
+
+	s.Apply([]*Inode{{ID: "a", Name: "2"}}, []string{"b"})
+	if err := s.Flush(2); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	s.compact()
+	if _, err := os.Stat(old); err != nil {
+		t.Errorf("merged table read by a snapshot was removed: %v", err)
+	}
+
+	got := make(map[string]string)
+	err := snap.ForEach(func(inode *Inode) error {
+		got[inode.ID] = inode.Name
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+	if want := map[string]string{"a": "1", "b": "1", "c": "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot ForEach = %v, want %v", got, want)
+	}
+
+	snap.Release()
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("merged table was not removed once released: %v", err)
+	}
+	if got, want := storeNames(t, s), map[string]string{"a": "2", "c": "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEach = %v, want %v", got, want)
+	}
+}
+
+// TestDiskStoreManifestState checks that whether the store was migrated and
+// which inodes are unlinked are recorded with the flush covering them.
+func TestDiskStoreManifestState(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestDiskStore(t, dir)
+
+	s.Apply([]*Inode{{ID: "a", Unlinked: true}, {ID: "b", Unlinked: true}, {ID: "c"}}, nil)
+	s.SetMigrated(true)
+	if err := s.Flush(1); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// Changes that were not flushed are redone from the journal instead
+	s.Apply([]*Inode{{ID: "c", Unlinked: true}}, []string{"a"})
+	s.SetMigrated(false)
+	if got, want := s.Unlinked(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unlinked = %v, want %v", got, want)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s = openTestDiskStore(t, dir)
+	defer s.Close()
+	if !s.Migrated() {
+		t.Errorf("Migrated = false after reopen, want true")
+	}
+	if got, want := s.Unlinked(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unlinked after reopen = %v, want %v", got, want)
+	}
+}
+
+func openTestDiskStore(t *testing.T, dir string) *diskStore {
+	t.Helper()
+	s, err := openDiskStore(dir)
+	if err != nil {
+		t.Fatalf("openDiskStore: %v", err)
+	}
+	return s
+}
+
+// storeNames returns the names of the inodes of s by ID.
+func storeNames(t *testing.T, s MetadataStore) map[string]string {
+	t.Helper()
+	names := make(map[string]string)
+	err := s.ForEach(func(inode *Inode) error {
+		names[inode.ID] = inode.Name
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+	return names
+}
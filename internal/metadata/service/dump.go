@@ -0,0 +1,401 @@
+package metadata_service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DumpVersion is the schema version of the dumps written by Dump. Fields
+	// added in later versions must have a sensible default when missing, so
+	// that dumps written by older versions still load.
+	DumpVersion = 1
+	// dumpFormat identifies a dump in its header.
+	dumpFormat = "godfs-meta"
+)
+
+// dumpHeader is the first line of a dump.
+type dumpHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Seq     uint64    `json:"seq"`
+	Created time.Time `json:"created"`
+}
+
+// dumpRecord is a line of a dump: a single inode and the path it is found
+// at. The path alone places the inode in the namespace, so entries can be
+// moved or renamed by editing it.
+type dumpRecord struct {
+	Path        string    `json:"path"`
+	ID          string    `json:"id"`
+	IsDir       bool      `json:"is_dir,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Permissions string    `json:"permissions,omitempty"`
+	UID         int       `json:"uid,omitempty"`
+	GID         int       `json:"gid,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	AccessedAt  time.Time `json:"accessed_at"`
+	ChunkIDs    []string  `json:"chunk_ids,omitempty"`
+	ChunkNodes  []string  `json:"chunk_nodes,omitempty"`
+	Links       []string  `json:"links,omitempty"`
+	ChunkSize   int64     `json:"chunk_size,omitempty"`
+	Generation  uint64    `json:"generation,omitempty"`
+	Lock        *dumpLock `json:"lock,omitempty"`
+}
+
+// dumpLock is the advisory lock held on an inode.
+type dumpLock struct {
+	Mode      string               `json:"mode"`
+	Mandatory bool                 `json:"mandatory,omitempty"`
+	Holders   map[string]time.Time `json:"holders"`
+}
+
+// Dump writes the namespace kept in the working directory to w as JSON
+// lines: a header, then every inode reachable from the root, parents first.
+// The metadata service must not be running.
+func Dump(cfg Config, w io.Writer) error {
+	m, err := openMetadataService(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = m.store.Close()
+	}()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	err = enc.Encode(dumpHeader{
+		Format:  dumpFormat,
+		Version: DumpVersion,
+		Seq:     m.seq,
+		Created: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	root, err := m.store.Get(RootID)
+	if err != nil {
+		return err
+	}
+
+	type queued struct {
+		inode *Inode
+		path  string
+	}
+	queue := []queued{{root, "/"}}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		if err := enc.Encode(m.dumpRecord(next.inode, next.path)); err != nil {
+			return err
+		}
+		if !next.inode.IsDir {
+			continue
+		}
+
+		children, err := m.store.Children(next.inode)
+		if err != nil {
+			return err
+		}
+		// Sorted so that dumps of the same namespace can be diffed
+		sort.Slice(children, func(a, b int) bool {
+			return children[a].Name < children[b].Name
+		})
+		for _, child := range children {
+			queue = append(queue, queued{child, path.Join(next.path, child.Name)})
+		}
+	}
+
+	return bw.Flush()
+}
+
+func (m *MetadataService) dumpRecord(inode *Inode, p string) *dumpRecord {
+	record := &dumpRecord{
+		Path:        p,
+		ID:          inode.ID,
+		IsDir:       inode.IsDir,
+		Size:        inode.Size,
+		Permissions: inode.Permissions,
+		UID:         inode.Ownership.UID,
+		GID:         inode.Ownership.GID,
+		CreatedAt:   inode.Timestamp.CreatedAt,
+		UpdatedAt:   inode.Timestamp.UpdatedAt,
+		AccessedAt:  inode.Timestamp.AccessedAt,
+		ChunkIDs:    inode.ChunkIDs,
+		ChunkNodes:  inode.ChunkNodes,
+		Links:       inode.Links,
+		ChunkSize:   inode.ChunkSize,
+		Generation:  inode.Generation,
+	}
+
+	if lock, ok := m.locks[inode.ID]; ok {
+		mode := "shared"
+		if lock.Mode == LockExclusive {
+			mode = "exclusive"
+		}
+		record.Lock = &dumpLock{
+			Mode:      mode,
+			Mandatory: lock.Mandatory,
+			Holders:   lock.Holders,
+		}
+	}
+
+	return record
+}
+
+// Load replaces the namespace kept in the working directory with the dump
+// read from r. Unless force is set, it refuses to replace a namespace that
+// is not empty. The metadata service must not be running.
+func Load(cfg Config, r io.Reader, force bool) error {
+	inodes, locks, err := readDump(r)
+	if err != nil {
+		return err
+	}
+
+	m, err := openMetadataService(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = m.store.Close()
+	}()
+
+	root, err := m.store.Get(RootID)
+	if err != nil {
+		return err
+	}
+	if len(root.DirectoryEntries) > 0 && !force {
+		return fmt.Errorf("namespace is not empty, force loading to replace it")
+	}
+
+	if err := m.replaceInodes(inodes); err != nil {
+		return err
+	}
+	m.locks = locks
+
+	// Older checkpoints and journal entries describe the replaced namespace
+	m.checkpointRetain = 1
+	return m.SaveToDisk()
+}
+
+// replaceInodes swaps the namespace for inodes.
+func (m *MetadataService) replaceInodes(inodes map[string]*Inode) error {
+	if store, ok := m.store.(*memStore); ok {
+		store.inodes = inodes
+		return nil
+	}
+
+	// The new store is built next to the old one, which is only removed once
+	// the new one is complete
+	tmpDir := diskStoreDir + ".load"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	store, err := openDiskStore(tmpDir)
+	if err != nil {
+		return err
+	}
+	puts := make([]*Inode, 0, len(inodes))
+	for _, inode := range inodes {
+		puts = append(puts, inode)
+	}
+	store.Apply(puts, nil)
+	if err := store.Flush(m.seq); err != nil {
+		_ = store.Close()
+		return err
+	}
+	if err := store.Close(); err != nil {
+		return err
+	}
+
+	if err := m.store.Close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(diskStoreDir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, diskStoreDir); err != nil {
+		return err
+	}
+	m.store, err = openDiskStore(diskStoreDir)
+	return err
+}
+
+// readDump reads a dump and rebuilds the directory tree from its paths.
+func readDump(r io.Reader) (map[string]*Inode, map[string]*FileLock, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header dumpHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, nil, fmt.Errorf("%w: reading header: %v", ErrInvalidDump, err)
+	}
+	if header.Format != dumpFormat {
+		return nil, nil, fmt.Errorf("%w: not a %s dump", ErrInvalidDump, dumpFormat)
+	}
+	if header.Version < 1 || header.Version > DumpVersion {
+		return nil, nil, fmt.Errorf("%w: version %d, this server reads up to %d", ErrDumpVersion, header.Version, DumpVersion)
+	}
+
+	byPath := make(map[string]*Inode)
+	byID := make(map[string]struct{})
+	locks := make(map[string]*FileLock)
+	for line := 2; ; line++ {
+		var record dumpRecord
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: line %d: %v", ErrInvalidDump, line, err)
+		}
+
+		p := path.Clean("/" + record.Path)
+		if _, dup := byPath[p]; dup {
+			return nil, nil, fmt.Errorf("%w: line %d: duplicate path %s", ErrInvalidDump, line, p)
+		}
+		if p == "/" {
+			record.ID = RootID
+			record.IsDir = true
+		}
+		if record.ID == "" {
+			return nil, nil, fmt.Errorf("%w: line %d: missing id", ErrInvalidDump, line)
+		}
+		if _, dup := byID[record.ID]; dup {
+			return nil, nil, fmt.Errorf("%w: line %d: duplicate id %s", ErrInvalidDump, line, record.ID)
+		}
+		byID[record.ID] = struct{}{}
+
+		inode, lock, err := record.inode()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: line %d: %v", ErrInvalidDump, line, err)
+		}
+		byPath[p] = inode
+		if lock != nil {
+			locks[inode.ID] = lock
+		}
+	}
+
+	if _, ok := byPath["/"]; !ok {
+		byPath["/"] = &Inode{
+			ID:               RootID,
+			Name:             "/",
+			IsDir:            true,
+			DirectoryEntries: map[string]string{},
+			Generation:       1,
+		}
+	}
+
+	// Parents are linked before their children
+	paths := make([]string, 0, len(byPath))
+	for p := range byPath {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(a, b int) bool {
+		return strings.Count(paths[a], "/") < strings.Count(paths[b], "/")
+	})
+
+	inodes := make(map[string]*Inode, len(byPath))
+	for _, p := range paths {
+		inode := byPath[p]
+		inodes[inode.ID] = inode
+		if p == "/" {
+			inode.Name = "/"
+			continue
+		}
+
+		dir, name := path.Split(p)
+		parent, ok := byPath[path.Clean(dir)]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %s has no parent directory", ErrInvalidDump, p)
+		}
+		if !parent.IsDir {
+			return nil, nil, fmt.Errorf("%w: parent of %s is not a directory", ErrInvalidDump, p)
+		}
+		if !validName(name) {
+			return nil, nil, fmt.Errorf("%w: invalid name %q", ErrInvalidDump, name)
+		}
+
+		inode.Name = name
+		inode.ParentID = parent.ID
+		parent.DirectoryEntries[name] = inode.ID
+	}
+
+	return inodes, locks, nil
+}
+
+// inode converts a record to an inode, filling in what older dumps lack.
+func (record *dumpRecord) inode() (*Inode, *FileLock, error) {
+	inode := &Inode{
+		ID:          record.ID,
+		IsDir:       record.IsDir,
+		Size:        record.Size,
+		Permissions: record.Permissions,
+		Ownership: Ownership{
+			UID: record.UID,
+			GID: record.GID,
+		},
+		Timestamp: Timestamp{
+			CreatedAt:  record.CreatedAt,
+			UpdatedAt:  record.UpdatedAt,
+			AccessedAt: record.AccessedAt,
+		},
+		ChunkIDs:   record.ChunkIDs,
+		ChunkNodes: record.ChunkNodes,
+		Links:      record.Links,
+		ChunkSize:  record.ChunkSize,
+		Generation: record.Generation,
+	}
+
+	if inode.Permissions == "" {
+		inode.Permissions = "rw-r--r--"
+	}
+	if !validPermissions(inode.Permissions) {
+		return nil, nil, ErrInvalidPermissions
+	}
+	if inode.Generation == 0 {
+		inode.Generation = 1
+	}
+	if inode.ChunkSize != 0 && !validChunkSize(inode.ChunkSize) {
+		return nil, nil, ErrInvalidSize
+	}
+	if len(inode.ChunkNodes) > 0 && len(inode.ChunkNodes) != len(inode.ChunkIDs) {
+		return nil, nil, ErrInvalidChunk
+	}
+	if inode.IsDir {
+		inode.DirectoryEntries = make(map[string]string)
+	} else if inode.ChunkSize == 0 {
+		inode.ChunkSize = legacyChunkSize
+	}
+
+	if record.Lock == nil {
+		return inode, nil, nil
+	}
+
+	lock := &FileLock{
+		Mandatory: record.Lock.Mandatory,
+		Holders:   record.Lock.Holders,
+	}
+	switch record.Lock.Mode {
+	case "shared":
+		lock.Mode = LockShared
+	case "exclusive":
+		lock.Mode = LockExclusive
+	default:
+		return nil, nil, ErrInvalidLockMode
+	}
+	if lock.Holders == nil {
+		lock.Holders = make(map[string]time.Time)
+	}
+	return inode, lock, nil
+}
@@ -3,7 +3,11 @@
 
 package metadata_service
 
-import "errors"
+import (
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
 
 var (
 	ErrFileNotFound = errors.New("file not found")
@@ -18,5 +22,69 @@ var (
 	ErrNotLink      = errors.New("path is not a link")
 	ErrInvalidChunk = errors.New("invalid chunk")
 	ErrInvalidSize  = errors.New("invalid size")
+	ErrEmptyWrite   = errors.New("write stream ended before naming a file")
 	ErrInvalidInode = errors.New("invalid inode")
+
+	ErrSequenceExpired = errors.New("watch sequence no longer available")
+	ErrWatchOverflow   = errors.New("watcher fell behind, resume from last sequence")
+
+	ErrLocked          = errors.New("file is locked")
+	ErrNotLockHolder   = errors.New("lock not held")
+	ErrInvalidOwner    = errors.New("lock owner not provided")
+	ErrInvalidLockMode = errors.New("invalid lock mode")
+
+	ErrInvalidHandle   = errors.New("invalid or expired file handle")
+	ErrNotWriteHandle  = errors.New("file handle not opened for writing")
+	ErrInvalidOpenMode = errors.New("invalid open mode")
+	ErrLeaseHeld       = errors.New("file is open for writing by another client")
+
+	ErrPreconditionFailed = &codeError{codes.FailedPrecondition, "generation does not match"}
+	ErrInvalidPermissions = errors.New("invalid permissions")
+	ErrInvalidOperation   = errors.New("invalid batch operation")
+
+	ErrJournalGap     = errors.New("journal is missing entries")
+	ErrJournalCorrupt = errors.New("journal record is corrupt")
+	ErrJournalClosed  = errors.New("journal is closed")
+	ErrJournalFailed  = errors.New("journal write failed")
+	ErrNotDurable     = errors.New("change was applied but may not be durable")
+
+	ErrJournalTruncated = errors.New("journal no longer holds the requested entries")
+	ErrNotPrimary       = errors.New("service does not keep a journal to stream")
+	ErrNotStandby       = errors.New("service is not a standby")
+	ErrPrimaryConnected = errors.New("standby is still following its primary")
+	ErrStandbyBehind    = errors.New("standby fell behind the journal, resume from its last entry")
+	ErrCheckpointAhead  = errors.New("checkpoint is ahead of the journal")
+
+	ErrCheckpointCorrupt = errors.New("checkpoint is corrupt")
+	ErrCheckpointVersion = errors.New("unsupported checkpoint version")
+	ErrNoCheckpoint      = errors.New("no intact checkpoint found")
+
+	ErrStoreCorrupt  = errors.New("metadata store is corrupt")
+	ErrStoreMismatch = errors.New("checkpoint was taken with a persistent metadata store")
+
+	ErrReplicaStore = errors.New("unsupported metadata store for a replica")
+
+	ErrNoDataNodes     = errors.New("no data nodes registered")
+	ErrDataNodeUnknown = errors.New("data node holding the chunk is not registered")
+	ErrInvalidDataNode = errors.New("data node ID and address must be provided")
+	ErrNoLiveDataNodes = errors.New("no live data nodes to place chunks on")
+	ErrInvalidCommand  = errors.New("invalid data node command")
+
+	ErrInvalidDump = errors.New("invalid metadata dump")
+	ErrDumpVersion = errors.New("unsupported metadata dump version")
 )
+
+// codeError is an error that reaches clients with its own status code, for
+// errors clients are expected to branch on.
+type codeError struct {
+	code codes.Code
+	msg  string
+}
+
+func (e *codeError) Error() string {
+	return e.msg
+}
+
+func (e *codeError) GRPCStatus() *status.Status {
+	return status.New(e.code, e.msg)
+}
@@ -0,0 +1,411 @@
+package metadata_service
+
+import (
+	"context"
+	"fmt"
+	pb "github.com/apolyeti/godfs/internal/data_node/genproto"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"log"
+	"path"
+	"sort"
+)
+
+// lostAndFound is the directory below the root that fsck moves orphans to.
+const lostAndFound = "lost+found"
+
+// Fsck checks the namespace for dangling entries, inodes whose parent or name
+// disagree with their directory, inodes listed twice and inodes that cannot
+// be reached from the root, and optionally repairs them. It can also check
+// the chunks of every file against the inventories of the data nodes.
+// The whole namespace is held in memory while it is checked.
+func (m *MetadataService) Fsck(
+	ctx context.Context,
+	req *metadata.FsckRequest,
+) (
+	*metadata.FsckResponse,
+	error,
+) {
+	log.Printf("FSCK\t%v", req)
+
+	var c *fsck
+	check := func(t *txn) error {
+		c = &fsck{t: t, repair: req.Repair}
+		if err := c.run(); err != nil {
+			return err
+		}
+		return t.err
+	}
+
+	var err error
+	if req.Repair {
+		err = m.update(check)
+	} else {
+		m.mu.RLock()
+		err = check(m.view())
+		m.mu.RUnlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &metadata.FsckResponse{
+		Findings:      c.findings,
+		InodesChecked: uint64(len(c.inodes)),
+	}
+
+	if req.CheckChunks {
+		resp.ChunksChecked = uint64(len(c.chunks))
+		resp.Findings = append(resp.Findings, m.checkChunks(c)...)
+	}
+
+	return resp, nil
+}
+
+// fsck is a single consistency check of the namespace.
+// inodes: every inode in the store, as it was when the check started
+// paths: path of every inode reachable from the root
+// chunks: ID of the file referencing each chunk
+type fsck struct {
+	t        *txn
+	repair   bool
+	inodes   map[string]*Inode
+	paths    map[string]string
+	chunks   map[string]string
+	findings []*metadata.FsckFinding
+}
+
+func (c *fsck) report(problem metadata.FsckProblem, inodeID string, p string, detail string) *metadata.FsckFinding {
+	finding := &metadata.FsckFinding{
+		Problem:  problem,
+		Inode:    inodeID,
+		Path:     p,
+		Detail:   detail,
+		Repaired: c.repair,
+	}
+	c.findings = append(c.findings, finding)
+	return finding
+}
+
+func (c *fsck) run() error {
+	// Read up front, so that the store is not read from while it is iterated
+	c.inodes = make(map[string]*Inode)
+	err := c.t.m.store.ForEach(func(inode *Inode) error {
+		c.inodes[inode.ID] = inode
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.paths = make(map[string]string)
+	c.chunks = make(map[string]string)
+
+	c.checkTree()
+	return c.checkUnreachable()
+}
+
+// checkTree walks the namespace from the root, checking every directory entry.
+func (c *fsck) checkTree() {
+	root, ok := c.inodes[RootID]
+	if !ok {
+		return
+	}
+
+	c.paths[RootID] = "/"
+	queue := []*Inode{root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		dirPath := c.paths[dir.ID]
+
+		names := make([]string, 0, len(dir.DirectoryEntries))
+		for name := range dir.DirectoryEntries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			id := dir.DirectoryEntries[name]
+			childPath := path.Join(dirPath, name)
+
+			child, ok := c.inodes[id]
+			if !ok {
+				c.report(metadata.FsckProblem_FSCK_PROBLEM_DANGLING_ENTRY, id, childPath, "entry names a missing inode")
+				c.dropEntry(dir.ID, name, nil)
+				continue
+			}
+
+			if _, seen := c.paths[id]; seen {
+				c.report(metadata.FsckProblem_FSCK_PROBLEM_MULTIPLY_LINKED, id, childPath,
+					fmt.Sprintf("also listed at %s", c.paths[id]))
+				c.dropEntry(dir.ID, name, child)
+				continue
+			}
+			c.paths[id] = childPath
+
+			if child.ParentID != dir.ID || child.Name != name {
+				c.report(metadata.FsckProblem_FSCK_PROBLEM_PARENT_MISMATCH, id, childPath,
+					fmt.Sprintf("inode records parent %s and name %q", child.ParentID, child.Name))
+				if c.repair {
+					inode, _ := c.t.edit(id)
+					inode.UpdateParentID(dir.ID)
+					inode.UpdateName(name)
+					inode.Touch()
+				}
+			}
+
+			c.addChunks(child)
+			if child.IsDir {
+				queue = append(queue, child)
+			}
+		}
+	}
+}
+
+// checkUnreachable reports the inodes the walk from the root did not reach.
+// Orphaned subtrees are reported, and moved to lost+found, as a whole.
+func (c *fsck) checkUnreachable() error {
+	orphans := make(map[string]*Inode)
+	for id, inode := range c.inodes {
+		if _, reached := c.paths[id]; reached {
+			continue
+		}
+
+		if inode.Unlinked {
+			// Still held open through a handle, it is dropped once closed
+			if c.t.openCount(id) > 0 {
+				continue
+			}
+			c.report(metadata.FsckProblem_FSCK_PROBLEM_UNLINKED_INODE, id, "", "removed while open, but no longer open")
+			if c.repair {
+				c.t.del(id)
+				c.t.onCommit(func() { c.t.m.releaseInode(inode) })
+			}
+			continue
+		}
+
+		orphans[id] = inode
+	}
+
+	for len(orphans) > 0 {
+		// The top of an orphaned subtree is not listed by an orphaned parent
+		var tops []*Inode
+		for _, inode := range orphans {
+			parent, ok := orphans[inode.ParentID]
+			if !ok || !parent.IsDir || parent.DirectoryEntries[inode.Name] != inode.ID {
+				tops = append(tops, inode)
+			}
+		}
+		sort.Slice(tops, func(a, b int) bool {
+			return tops[a].ID < tops[b].ID
+		})
+		if len(tops) == 0 {
+			// Orphans listing each other in a cycle, break it anywhere
+			for _, inode := range orphans {
+				if len(tops) == 0 || inode.ID < tops[0].ID {
+					tops = []*Inode{inode}
+				}
+			}
+		}
+
+		for _, top := range tops {
+			below := c.detach(top, orphans)
+			finding := c.report(metadata.FsckProblem_FSCK_PROBLEM_ORPHAN_INODE, top.ID, "",
+				fmt.Sprintf("unreachable with %d inodes below it", below))
+			if c.repair {
+				p, err := c.moveToLostAndFound(top)
+				if err != nil {
+					return err
+				}
+				finding.Path = p
+			}
+		}
+	}
+	return nil
+}
+
+// detach removes top and everything below it from orphans, and returns the
+// number of inodes below it.
+func (c *fsck) detach(top *Inode, orphans map[string]*Inode) int {
+	below := -1
+	queue := []*Inode{top}
+	delete(orphans, top.ID)
+	for len(queue) > 0 {
+		inode := queue[0]
+		queue = queue[1:]
+		below++
+
+		c.addChunks(inode)
+		for _, id := range inode.DirectoryEntries {
+			if child, ok := orphans[id]; ok {
+				delete(orphans, id)
+				queue = append(queue, child)
+			}
+		}
+	}
+	return below
+}
+
+// moveToLostAndFound moves an orphan into /lost+found under its ID, and
+// returns its new path.
+func (c *fsck) moveToLostAndFound(orphan *Inode) (string, error) {
+	t := c.t
+
+	dir, err := t.lookup(RootID, lostAndFound)
+	if err == ErrFileNotFound {
+		dir, err = t.create(RootID, lostAndFound, true, 0)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !dir.IsDir {
+		return "", fmt.Errorf("/%s is not a directory", lostAndFound)
+	}
+
+	// An orphan in a cycle is still listed by its parent
+	if parent, ok := t.get(orphan.ParentID); ok && parent.IsDir && parent.DirectoryEntries[orphan.Name] == orphan.ID {
+		c.dropEntry(parent.ID, orphan.Name, orphan)
+	}
+
+	inode, _ := t.edit(orphan.ID)
+	inode.UpdateParentID(dir.ID)
+	inode.UpdateName(orphan.ID)
+	inode.Touch()
+
+	dir, _ = t.edit(dir.ID)
+	dir.DirectoryEntries[inode.Name] = inode.ID
+	dir.Touch()
+
+	t.notify(metadata.EventType_EVENT_TYPE_CREATE, inode, dir.ID, inode.Name, "", "")
+
+	return path.Join("/", lostAndFound, inode.Name), nil
+}
+
+// dropEntry removes the entry name from the directory dirID when repairing.
+func (c *fsck) dropEntry(dirID string, name string, inode *Inode) {
+	if !c.repair {
+		return
+	}
+
+	dir, _ := c.t.edit(dirID)
+	delete(dir.DirectoryEntries, name)
+	dir.Touch()
+
+	if inode != nil {
+		c.t.notify(metadata.EventType_EVENT_TYPE_DELETE, inode, dirID, name, "", "")
+	}
+}
+
+func (c *fsck) addChunks(inode *Inode) {
+	for _, chunkID := range inode.ChunkIDs {
+		c.chunks[chunkID] = inode.ID
+	}
+}
+
+// checkChunks reports the chunks that no data node holds, as corrupt if a
+// data node quarantined them. Chunks are only reported missing if every data
+// node reported its inventory, and if the file still references them, since
+// files may be rewritten meanwhile.
+func (m *MetadataService) checkChunks(c *fsck) []*metadata.FsckFinding {
+	var findings []*metadata.FsckFinding
+
+	// The legacy data nodes are only asked if files still have chunks on them
+	legacy := false
+	for _, inodeID := range c.chunks {
+		if inode, ok := c.inodes[inodeID]; ok && len(inode.ChunkNodes) == 0 {
+			legacy = true
+			break
+		}
+	}
+
+	held := make(map[string]struct{})
+	complete := true
+	for _, dataNode := range m.dataNodeAddresses(legacy) {
+		chunkIDs, err := listChunksOnDataNode(dataNode)
+		if err != nil {
+			complete = false
+			findings = append(findings, &metadata.FsckFinding{
+				Problem: metadata.FsckProblem_FSCK_PROBLEM_DATA_NODE_UNAVAILABLE,
+				Detail:  fmt.Sprintf("%s: %v", dataNode, err),
+			})
+			continue
+		}
+		for _, id := range chunkIDs {
+			held[id] = struct{}{}
+		}
+	}
+	if !complete {
+		return findings
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	chunkIDs := make([]string, 0, len(c.chunks))
+	for chunkID := range c.chunks {
+		chunkIDs = append(chunkIDs, chunkID)
+	}
+	sort.Strings(chunkIDs)
+
+	for _, chunkID := range chunkIDs {
+		if _, ok := held[chunkID]; ok {
+			continue
+		}
+
+		inode, err := m.store.Get(c.chunks[chunkID])
+		if err != nil || !containsChunk(inode, chunkID) {
+			continue
+		}
+
+		finding := &metadata.FsckFinding{
+			Problem: metadata.FsckProblem_FSCK_PROBLEM_MISSING_CHUNK,
+			Inode:   inode.ID,
+			Path:    c.paths[inode.ID],
+			ChunkId: chunkID,
+			Detail:  "no data node holds the chunk",
+		}
+		if dataNode, ok := m.corruptChunk(chunkID); ok {
+			finding.Problem = metadata.FsckProblem_FSCK_PROBLEM_CORRUPT_CHUNK
+			finding.Detail = fmt.Sprintf("quarantined as corrupt by %s", dataNode)
+		}
+		findings = append(findings, finding)
+	}
+	return findings
+}
+
+func containsChunk(inode *Inode, chunkID string) bool {
+	for _, id := range inode.ChunkIDs {
+		if id == chunkID {
+			return true
+		}
+	}
+	return false
+}
+
+func listChunksOnDataNode(dataNode string) ([]string, error) {
+	conn, err := grpc.NewClient(
+		dataNode,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close connection: %v", err)
+		}
+	}()
+
+	client := pb.NewDataNodeServiceClient(conn)
+
+	res, err := client.ListChunks(context.Background(), &pb.ListChunksRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.ChunkIds, nil
+}
@@ -0,0 +1,296 @@
+package metadata_service
+
+import (
+	"context"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"github.com/google/uuid"
+	"log"
+	"time"
+)
+
+// DefaultHandleLease is how long a handle stays open without being used.
+const DefaultHandleLease = time.Minute
+
+// leaseCheckInterval is how often expired handles are recovered.
+const leaseCheckInterval = time.Second
+
+// fileHandle is an open file, handed out by Open and released by Close.
+// Handles only live in memory, so a restart releases every lease.
+// ID: Handle returned to the client
+// InodeID: ID of the opened inode
+// Owner: Client that opened the file
+// Write: True if the handle holds the single-writer lease on the inode
+// Lease: How long the handle lives after its last use
+// Expires: Time at which the handle is recovered unless used again
+type fileHandle struct {
+	ID      string
+	InodeID string
+	Owner   string
+	Write   bool
+	Lease   time.Duration
+	Expires time.Time
+}
+
+func (h *fileHandle) renew(now time.Time) {
+	h.Expires = now.Add(h.Lease)
+}
+
+func handleLease(leaseMs int64) time.Duration {
+	if leaseMs <= 0 {
+		return DefaultHandleLease
+	}
+	lease := time.Duration(leaseMs) * time.Millisecond
+	if lease > MaxLockLease {
+		return MaxLockLease
+	}
+	return lease
+}
+
+// handle returns the live handle with the given ID. Expired handles are
+// left for the lease loop to recover.
+func (m *MetadataService) handle(id string) (*fileHandle, error) {
+	h, ok := m.handles[id]
+	if !ok || !time.Now().Before(h.Expires) {
+		return nil, ErrInvalidHandle
+	}
+	return h, nil
+}
+
+// resolveFile returns the file a read or write refers to: the file opened as
+// handleID if one is given, or the file named name in the directory dirID.
+// The handle is renewed unless t is a read-only view.
+func (t *txn) resolveFile(
+	dirID string,
+	name string,
+	handleID string,
+	write bool,
+) (*Inode, error) {
+	if handleID == "" {
+		inode, err := t.lookup(dirID, name)
+		if err != nil {
+			return nil, err
+		}
+		if inode.IsDir {
+			return nil, ErrIsDir
+		}
+		return inode, nil
+	}
+
+	h, err := t.m.handle(handleID)
+	if err != nil {
+		return nil, err
+	}
+	if write && !h.Write {
+		return nil, ErrNotWriteHandle
+	}
+
+	inode, ok := t.get(h.InodeID)
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+
+	// A read-only view may be used with m.mu held for reading
+	if t.inodes != nil {
+		h.renew(time.Now())
+	}
+	return inode, nil
+}
+
+// writerOf returns the live handle holding the write lease on inodeID, if any.
+func (m *MetadataService) writerOf(inodeID string) *fileHandle {
+	id, ok := m.writers[inodeID]
+	if !ok {
+		return nil
+	}
+	h, err := m.handle(id)
+	if err != nil {
+		return nil
+	}
+	return h
+}
+
+// checkWriteLease returns ErrLeaseHeld unless a write to inode through
+// handleID is allowed by the single-writer lease.
+func (m *MetadataService) checkWriteLease(inode *Inode, handleID string) error {
+	writer := m.writerOf(inode.ID)
+	if writer == nil {
+		return nil
+	}
+	if writer.ID != handleID {
+		return ErrLeaseHeld
+	}
+	return nil
+}
+
+// closeHandle closes h once the transaction commits, and drops its inode
+// along with it if a removed file has no handles left.
+func (t *txn) closeHandle(h *fileHandle) {
+	if _, closed := t.closed[h.ID]; closed {
+		return
+	}
+	t.closed[h.ID] = h
+	if t.openCount(h.InodeID) > 0 {
+		return
+	}
+
+	if inode, ok := t.get(h.InodeID); ok && inode.Unlinked {
+		m := t.m
+		t.del(inode.ID)
+		t.onCommit(func() { m.releaseInode(inode) })
+	}
+}
+
+// openCount returns the number of handles open on inodeID that the
+// transaction does not close.
+func (t *txn) openCount(inodeID string) int {
+	n := t.m.openCount[inodeID]
+	for _, h := range t.closed {
+		if h.InodeID == inodeID {
+			n--
+		}
+	}
+	return n
+}
+
+// releaseHandles forgets the handles closed by a committed transaction.
+func (m *MetadataService) releaseHandles(closed map[string]*fileHandle) {
+	for _, h := range closed {
+		delete(m.handles, h.ID)
+		if h.Write && m.writers[h.InodeID] == h.ID {
+			delete(m.writers, h.InodeID)
+		}
+
+		m.openCount[h.InodeID]--
+		if m.openCount[h.InodeID] <= 0 {
+			delete(m.openCount, h.InodeID)
+		}
+	}
+}
+
+// recoverHandle releases a handle whose holder stopped using it. Writes
+// commit the size and chunk list of a file together, so a file whose
+// writer went away is already in its last consistent state.
+func (t *txn) recoverHandle(h *fileHandle) {
+	log.Printf("Recovering lease on %v held by %v", h.InodeID, h.Owner)
+	t.closeHandle(h)
+}
+
+// recoverExpiredHandles releases every handle whose lease ran out.
+func (t *txn) recoverExpiredHandles(now time.Time) {
+	for _, h := range t.m.handles {
+		if !now.Before(h.Expires) {
+			t.recoverHandle(h)
+		}
+	}
+}
+
+func (m *MetadataService) startLeaseLoop() {
+	ticker := time.NewTicker(leaseCheckInterval)
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if m.checkLeader() != nil {
+				continue
+			}
+			err := m.update(func(t *txn) error {
+				t.recoverExpiredHandles(now)
+				return nil
+			})
+			if err != nil {
+				log.Printf("Error recovering expired handles: %v", err)
+			}
+		case <-m.shutdownChan:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func (m *MetadataService) Open(
+	ctx context.Context,
+	req *metadata.OpenRequest,
+) (
+	*metadata.OpenResponse,
+	error,
+) {
+	log.Printf("OPEN\t%v", req)
+
+	var write bool
+	switch req.Mode {
+	case metadata.OpenMode_OPEN_MODE_READ:
+	case metadata.OpenMode_OPEN_MODE_WRITE:
+		write = true
+	default:
+		return nil, ErrInvalidOpenMode
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Handles are held by the leader, which serves the writes through them
+	if err := m.checkLeader(); err != nil {
+		return nil, err
+	}
+
+	inode, err := m.lookup(req.CurrentDirectoryId, req.FileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if inode.IsDir {
+		return nil, ErrIsDir
+	}
+
+	if write && m.writerOf(inode.ID) != nil {
+		return nil, ErrLeaseHeld
+	}
+
+	h := &fileHandle{
+		ID:      uuid.New().String(),
+		InodeID: inode.ID,
+		Owner:   req.Owner,
+		Write:   write,
+		Lease:   handleLease(req.LeaseMs),
+	}
+	h.renew(time.Now())
+
+	m.handles[h.ID] = h
+	m.openCount[inode.ID]++
+	if write {
+		m.writers[inode.ID] = h.ID
+	}
+
+	return &metadata.OpenResponse{
+		Handle:    h.ID,
+		Inode:     inode.ID,
+		ExpiresAt: h.Expires.UnixNano(),
+	}, nil
+}
+
+func (m *MetadataService) Close(
+	ctx context.Context,
+	req *metadata.CloseRequest,
+) (
+	*metadata.CloseResponse,
+	error,
+) {
+	log.Printf("CLOSE\t%v", req)
+
+	var h *fileHandle
+	err := m.update(func(t *txn) error {
+		var err error
+		if h, err = m.handle(req.Handle); err != nil {
+			return err
+		}
+		t.closeHandle(h)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata.CloseResponse{
+		Inode: h.InodeID,
+	}, nil
+}
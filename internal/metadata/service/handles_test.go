@@ -0,0 +1,67 @@
+package metadata_service
+
+import (
+	"context"
+	"errors"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"testing"
+)
+
+// TestCloseHandleAbort checks that closing a handle in a transaction that
+// fails leaves it open, and that closing the last handle on a removed file
+// drops the file once committed.
+func TestCloseHandleAbort(t *testing.T) {
+	m := newTestService(t, nil)
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+
+	file := &metadata.CreateFileRequest{Name: "file", Parent: RootID}
+	if _, err := m.CreateFile(ctx, file); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	open, err := m.Open(ctx, &metadata.OpenRequest{
+		FileName:           "file",
+		CurrentDirectoryId: RootID,
+		Mode:               metadata.OpenMode_OPEN_MODE_WRITE,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := m.Remove(ctx, &metadata.RemoveRequest{FileName: "file", CurrentDirectoryId: RootID}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	err = m.update(func(t *txn) error {
+		h, err := m.handle(open.Handle)
+		if err != nil {
+			return err
+		}
+		t.closeHandle(h)
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("update = %v, want %v", err, errAbort)
+	}
+	if _, err := m.handle(open.Handle); err != nil {
+		t.Fatalf("Handle closed by an aborted transaction: %v", err)
+	}
+	if m.writers[open.Inode] != open.Handle || m.openCount[open.Inode] != 1 {
+		t.Fatalf("writers = %v, openCount = %v after an aborted transaction", m.writers, m.openCount)
+	}
+	if _, err := m.store.Get(open.Inode); err != nil {
+		t.Fatalf("Removed file still open was dropped: %v", err)
+	}
+
+	if _, err := m.Close(ctx, &metadata.CloseRequest{Handle: open.Handle}); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := m.handle(open.Handle); err != ErrInvalidHandle {
+		t.Fatalf("handle = %v after Close, want %v", err, ErrInvalidHandle)
+	}
+	if len(m.writers) != 0 || len(m.openCount) != 0 {
+		t.Fatalf("writers = %v, openCount = %v after Close, want none", m.writers, m.openCount)
+	}
+	if _, err := m.store.Get(open.Inode); err != ErrFileNotFound {
+		t.Fatalf("Get = %v after the last handle was closed, want %v", err, ErrFileNotFound)
+	}
+}
@@ -40,8 +40,14 @@ type Timestamp struct {
 // Ownership: Ownership of file or directory
 // Timestamp: Timestamps of file or directory
 // ChunkIDs: IDs of chunks that store the data of the file
+// ChunkNodes: IDs of the data nodes holding each chunk, empty if the chunks are
+// placed on the legacy data nodes by position
 // ParentID: ID of parent directory
 // Links: IDs of hard links to the file
+// ChunkSize: Size in bytes of each chunk of a file. For a directory, the default
+// inherited by new files created below it, or 0 to inherit from its own parent
+// Unlinked: True if the file was removed while open, it is dropped once closed
+// Generation: Incremented on every change to the content or metadata of the inode
 type Inode struct {
 	ID               string
 	Name             string
@@ -51,9 +57,13 @@ type Inode struct {
 	Ownership        Ownership
 	Timestamp        Timestamp
 	ChunkIDs         []string
+	ChunkNodes       []string
 	ParentID         string
 	Links            []string
 	DirectoryEntries map[string]string
+	ChunkSize        int64
+	Unlinked         bool
+	Generation       uint64
 }
 
 func NewInode(name string, isDir bool) *Inode {
@@ -69,9 +79,10 @@ func NewInode(name string, isDir bool) *Inode {
 			UpdatedAt:  time.Now(),
 			AccessedAt: time.Now(),
 		},
-		ChunkIDs: []string{},
-		ParentID: "",
-		Links:    []string{},
+		ChunkIDs:   []string{},
+		ParentID:   "",
+		Links:      []string{},
+		Generation: 1,
 	}
 	if isDir {
 		inode.DirectoryEntries = make(map[string]string)
@@ -79,6 +90,30 @@ func NewInode(name string, isDir bool) *Inode {
 	return inode
 }
 
+// Clone returns a copy of the inode that shares no state with it.
+func (i *Inode) Clone() *Inode {
+	clone := *i
+	clone.ChunkIDs = append([]string(nil), i.ChunkIDs...)
+	if i.ChunkNodes != nil {
+		clone.ChunkNodes = append([]string(nil), i.ChunkNodes...)
+	}
+	clone.Links = append([]string(nil), i.Links...)
+	if i.DirectoryEntries != nil {
+		clone.DirectoryEntries = make(map[string]string, len(i.DirectoryEntries))
+		for name, id := range i.DirectoryEntries {
+			clone.DirectoryEntries[name] = id
+		}
+	}
+	return &clone
+}
+
+// Touch records a change to the content or metadata of the inode
+// by incrementing its generation and update time.
+func (i *Inode) Touch() {
+	i.Generation++
+	i.Timestamp.UpdatedAt = time.Now()
+}
+
 // AddLink adds a hard link to the inode.
 func (i *Inode) AddLink(linkID string) {
 	i.Links = append(i.Links, linkID)
@@ -129,6 +164,11 @@ func (i *Inode) UpdateTimestamp(timestamp Timestamp) {
 	i.Timestamp = timestamp
 }
 
+// UpdateChunkSize updates the chunk size of the inode.
+func (i *Inode) UpdateChunkSize(chunkSize int64) {
+	i.ChunkSize = chunkSize
+}
+
 // UpdateParentID updates the parent ID of the inode.
 func (i *Inode) UpdateParentID(parentID string) {
 	i.ParentID = parentID
@@ -159,6 +199,12 @@ func (i *Inode) UpdateChunkIDs(chunkIDs []string) {
 	i.ChunkIDs = chunkIDs
 }
 
+// UpdateChunkNodes updates the IDs of the data nodes holding the chunks of
+// the inode.
+func (i *Inode) UpdateChunkNodes(chunkNodes []string) {
+	i.ChunkNodes = chunkNodes
+}
+
 // GetLink returns the link at the specified index.
 func (i *Inode) GetLink(index int) string {
 	return i.Links[index]
@@ -191,6 +237,16 @@ func (i *Inode) GetTimestamp() Timestamp {
 	return i.Timestamp
 }
 
+// GetChunkSize returns the chunk size of the inode.
+func (i *Inode) GetChunkSize() int64 {
+	return i.ChunkSize
+}
+
+// GetGeneration returns the generation of the inode.
+func (i *Inode) GetGeneration() uint64 {
+	return i.Generation
+}
+
 // GetParentID returns the parent ID of the inode.
 func (i *Inode) GetParentID() string {
 	return i.ParentID
@@ -0,0 +1,593 @@
+package metadata_service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// journalDir holds the journal segments, named by their first sequence number.
+	journalDir = ".storage/journal"
+	// journalQueueSize is the number of entries that may wait for the writer.
+	journalQueueSize = 1024
+	// journalMaxRecord guards replay against reading a garbage length.
+	journalMaxRecord = 256 * 1024 * 1024
+	// journalSubscriberBuffer is the number of entries a subscriber may fall
+	// behind by before it is dropped and has to resume.
+	journalSubscriberBuffer = 4 * journalQueueSize
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// journalEntry is the redo record of one committed transaction: the full
+// state of every inode and lock it changed, and the IDs of those it removed.
+// Replaying entries in order on top of a checkpoint rebuilds the namespace.
+type journalEntry struct {
+	Seq          uint64
+	Inodes       []*Inode
+	Deleted      []string
+	Locks        map[string]*FileLock
+	LocksDeleted []string
+}
+
+func (e *journalEntry) empty() bool {
+	return len(e.Inodes) == 0 && len(e.Deleted) == 0 && len(e.Locks) == 0 && len(e.LocksDeleted) == 0
+}
+
+// journalSegment is a closed journal file.
+type journalSegment struct {
+	path  string
+	first uint64
+	last  uint64
+}
+
+// journalSubscriber receives the entries of the journal once they are durable.
+// entries: Entries waiting to be sent, closed when the subscriber falls behind
+type journalSubscriber struct {
+	entries chan *journalEntry
+}
+
+// journalWrite is an entry waiting for the writer.
+// durable: called once the entry is durable, in sequence number order, nil if unused
+type journalWrite struct {
+	entry   *journalEntry
+	durable func()
+	done    chan error
+}
+
+// journal is the append-only operation log of the metadata service.
+// Entries are queued in commit order and written by a single goroutine,
+// which syncs every batch it writes at once (group commit).
+// file: current segment, appended to by the writer
+// first, last: sequence numbers of the first and last entry of the current segment
+// segments: closed segments, oldest first
+// err: first write error, after which every append fails
+// subscribers: streams sent every entry once it is durable
+// closed: True once the journal is closed
+type journal struct {
+	dir         string
+	mu          sync.Mutex
+	file        *os.File
+	first       uint64
+	last        uint64
+	segments    []journalSegment
+	err         error
+	subscribers map[*journalSubscriber]struct{}
+	closed      bool
+
+	queueMu sync.Mutex
+	stopped bool
+	queue   chan *journalWrite
+	done    chan struct{}
+}
+
+func openJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	j := &journal{
+		dir:         dir,
+		queue:       make(chan *journalWrite, journalQueueSize),
+		done:        make(chan struct{}),
+		subscribers: make(map[*journalSubscriber]struct{}),
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		j.segments = append(j.segments, journalSegment{path: name, first: first})
+	}
+	sort.Slice(j.segments, func(a, b int) bool {
+		return j.segments[a].first < j.segments[b].first
+	})
+
+	// Every segment ends where the next one starts, so only the newest one
+	// is read to find its last entry. A segment without one ends before it
+	// starts. replay sets the same bounds from the entries it reads.
+	for i := range j.segments {
+		seg := &j.segments[i]
+		if i+1 < len(j.segments) {
+			seg.last = j.segments[i+1].first - 1
+			continue
+		}
+		seg.last = seg.first - 1
+		err := readSegment(seg.path, func(e *journalEntry) (bool, error) {
+			seg.last = e.Seq
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return j, nil
+}
+
+func (j *journal) segmentPath(first uint64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%020d.log", first))
+}
+
+// replay calls apply for every entry after fromSeq, in order, and returns
+// the sequence number of the last entry in the journal. A torn record left
+// by a crash mid-write is cut off, and any entry missing after it is then
+// reported as a gap.
+func (j *journal) replay(fromSeq uint64, apply func(*journalEntry)) (uint64, error) {
+	last := fromSeq
+	for i := range j.segments {
+		seg := &j.segments[i]
+
+		err := j.replaySegment(seg, func(e *journalEntry) error {
+			if e.Seq <= fromSeq {
+				return nil
+			}
+			if e.Seq != last+1 {
+				return fmt.Errorf("%w: expected entry %d, found %d in %s", ErrJournalGap, last+1, e.Seq, seg.path)
+			}
+			apply(e)
+			last = e.Seq
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return last, nil
+}
+
+func (j *journal) replaySegment(seg *journalSegment, apply func(*journalEntry) error) error {
+	file, err := os.OpenFile(seg.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("Failed to close journal segment: %v", err)
+		}
+	}()
+
+	r := bufio.NewReader(file)
+	var offset int64
+	for {
+		entry, n, err := readJournalRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Truncating torn journal record in %s at offset %d: %v", seg.path, offset, err)
+			return file.Truncate(offset)
+		}
+		if err := apply(entry); err != nil {
+			return err
+		}
+		seg.last = entry.Seq
+		offset += n
+	}
+}
+
+// readJournalRecord reads a single record: its length, the CRC-32C of its
+// payload, and the gob encoded entry.
+func readJournalRecord(r io.Reader) (*journalEntry, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, ErrJournalCorrupt
+		}
+		return nil, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	if length > journalMaxRecord {
+		return nil, 0, ErrJournalCorrupt
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, ErrJournalCorrupt
+	}
+	if crc32.Checksum(payload, crcTable) != sum {
+		return nil, 0, ErrJournalCorrupt
+	}
+
+	var entry journalEntry
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entry); err != nil {
+		return nil, 0, ErrJournalCorrupt
+	}
+	return &entry, int64(len(header)) + int64(length), nil
+}
+
+func writeJournalRecord(w io.Writer, entry *journalEntry) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(entry); err != nil {
+		return err
+	}
+
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(payload.Bytes(), crcTable))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload.Bytes())
+	return err
+}
+
+// start opens a new segment for entries from nextSeq on, and starts the writer.
+// A segment a crash left without entries already starts at nextSeq, and is
+// reopened as the current segment instead of being kept as a closed one.
+func (j *journal) start(nextSeq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	kept := j.segments[:0]
+	for _, seg := range j.segments {
+		if seg.first != nextSeq {
+			kept = append(kept, seg)
+		}
+	}
+	j.segments = kept
+
+	if err := j.openSegment(nextSeq); err != nil {
+		return err
+	}
+
+	go j.writeLoop()
+	return nil
+}
+
+func (j *journal) openSegment(first uint64) error {
+	file, err := os.OpenFile(j.segmentPath(first), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.file = file
+	j.first = first
+	j.last = first - 1
+	return syncDir(j.dir)
+}
+
+// append queues entry and returns a channel that receives the result of
+// writing it once it is durable. durable, if not nil, is called by the writer
+// before that, so that the entries written together are seen in order. Must
+// be called in sequence number order.
+func (j *journal) append(entry *journalEntry, durable func()) <-chan error {
+	done := make(chan error, 1)
+
+	j.queueMu.Lock()
+	defer j.queueMu.Unlock()
+
+	if j.stopped {
+		done <- ErrJournalClosed
+		return done
+	}
+
+	j.queue <- &journalWrite{entry: entry, durable: durable, done: done}
+	return done
+}
+
+func (j *journal) writeLoop() {
+	defer close(j.done)
+
+	for w := range j.queue {
+		batch := []*journalWrite{w}
+	drain:
+		for len(batch) < journalQueueSize {
+			select {
+			case w, ok := <-j.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, w)
+			default:
+				break drain
+			}
+		}
+
+		err := j.writeBatch(batch)
+		for _, w := range batch {
+			if err == nil && w.durable != nil {
+				w.durable()
+			}
+			w.done <- err
+		}
+	}
+}
+
+func (j *journal) writeBatch(batch []*journalWrite) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return j.err
+	}
+
+	w := bufio.NewWriter(j.file)
+	for _, write := range batch {
+		if err := writeJournalRecord(w, write.entry); err != nil {
+			j.fail(err)
+			return j.err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		j.fail(err)
+		return j.err
+	}
+	if err := j.file.Sync(); err != nil {
+		j.fail(err)
+		return j.err
+	}
+
+	j.last = batch[len(batch)-1].entry.Seq
+	j.publish(batch)
+	return nil
+}
+
+// publish sends the entries just made durable to every subscriber. Must be
+// called with j.mu held.
+func (j *journal) publish(batch []*journalWrite) {
+	for sub := range j.subscribers {
+		for _, write := range batch {
+			select {
+			case sub.entries <- write.entry:
+				continue
+			default:
+			}
+
+			// The subscriber is too slow, drop it so it resumes from its last entry
+			log.Printf("Journal subscriber fell behind at entry %d", write.entry.Seq)
+			close(sub.entries)
+			delete(j.subscribers, sub)
+			break
+		}
+	}
+}
+
+// subscribe registers a subscriber for the entries made durable from now on,
+// and returns the sequence number of the last entry that already is.
+func (j *journal) subscribe() (*journalSubscriber, uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return nil, 0, j.err
+	}
+	if j.closed {
+		return nil, 0, ErrJournalClosed
+	}
+
+	sub := &journalSubscriber{
+		entries: make(chan *journalEntry, journalSubscriberBuffer),
+	}
+	j.subscribers[sub] = struct{}{}
+	return sub, j.last, nil
+}
+
+func (j *journal) unsubscribe(sub *journalSubscriber) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.subscribers[sub]; ok {
+		delete(j.subscribers, sub)
+		close(sub.entries)
+	}
+}
+
+// read calls fn for the entries after fromSeq up to upTo, in order, without
+// modifying the segments. upTo must be durable. It fails with
+// ErrJournalTruncated once the entry after fromSeq was compacted away.
+func (j *journal) read(fromSeq uint64, upTo uint64, fn func(*journalEntry) error) error {
+	if fromSeq >= upTo {
+		return nil
+	}
+
+	j.mu.Lock()
+	first := j.first
+	if len(j.segments) > 0 {
+		first = j.segments[0].first
+	}
+	paths := make([]string, 0, len(j.segments)+1)
+	for _, seg := range j.segments {
+		paths = append(paths, seg.path)
+	}
+	if j.file != nil {
+		paths = append(paths, j.file.Name())
+	}
+	j.mu.Unlock()
+
+	if fromSeq+1 < first {
+		return ErrJournalTruncated
+	}
+
+	last := fromSeq
+	for _, path := range paths {
+		err := readSegment(path, func(e *journalEntry) (bool, error) {
+			if e.Seq <= last {
+				return true, nil
+			}
+			if e.Seq != last+1 {
+				return false, fmt.Errorf("%w: expected entry %d, found %d in %s", ErrJournalGap, last+1, e.Seq, path)
+			}
+			if err := fn(e); err != nil {
+				return false, err
+			}
+			last = e.Seq
+			return last < upTo, nil
+		})
+		// A segment compacted while reading held entries that are needed
+		if os.IsNotExist(err) {
+			return ErrJournalTruncated
+		}
+		if err != nil {
+			return err
+		}
+		if last == upTo {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: expected entry %d", ErrJournalGap, last+1)
+}
+
+// readSegment calls fn for the entries of the segment at path until it
+// returns false. Reading stops at a torn record, which the writer may still
+// be appending.
+func readSegment(path string, fn func(*journalEntry) (bool, error)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("Failed to close journal segment: %v", err)
+		}
+	}()
+
+	r := bufio.NewReader(file)
+	for {
+		entry, _, err := readJournalRecord(r)
+		if err == io.EOF || err == ErrJournalCorrupt {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if more, err := fn(entry); err != nil || !more {
+			return err
+		}
+	}
+}
+
+// fail records the first write error. The in-memory state is then ahead of
+// what is durable, so every later mutation is refused until a restart.
+func (j *journal) fail(err error) {
+	log.Printf("Journal write failed, refusing further changes: %v", err)
+	j.err = fmt.Errorf("%w: %v", ErrJournalFailed, err)
+}
+
+// rotate closes the current segment and starts a new one, so that segments
+// covered by a checkpoint can be removed with compact.
+func (j *journal) rotate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return j.err
+	}
+	if j.file == nil || j.last < j.first {
+		// Not started, or nothing was written to the current segment yet
+		return nil
+	}
+
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	j.segments = append(j.segments, journalSegment{
+		path:  j.file.Name(),
+		first: j.first,
+		last:  j.last,
+	})
+
+	return j.openSegment(j.last + 1)
+}
+
+// failed returns the error that stopped the journal, if any.
+func (j *journal) failed() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// compact removes the closed segments holding only entries up to upTo. The
+// current segment is never removed, even if nothing was written to it yet.
+func (j *journal) compact(upTo uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	kept := j.segments[:0]
+	for _, seg := range j.segments {
+		if seg.last > upTo || (j.file != nil && seg.path == j.file.Name()) {
+			kept = append(kept, seg)
+			continue
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	j.segments = kept
+	return nil
+}
+
+// close stops accepting entries, waits for the queued ones to be written
+// and closes the current segment.
+func (j *journal) close() error {
+	j.queueMu.Lock()
+	if j.stopped {
+		j.queueMu.Unlock()
+		return nil
+	}
+	j.stopped = true
+	close(j.queue)
+	j.queueMu.Unlock()
+
+	<-j.done
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closed = true
+	for sub := range j.subscribers {
+		delete(j.subscribers, sub)
+		close(sub.entries)
+	}
+	return j.file.Close()
+}
+
+// syncDir makes the creation of files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
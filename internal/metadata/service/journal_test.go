@@ -0,0 +1,230 @@
+package metadata_service
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// appendEntries writes entries from..to to j and waits until they are durable.
+func appendEntries(t *testing.T, j *journal, from, to uint64) {
+	t.Helper()
+	for seq := from; seq <= to; seq++ {
+		entry := &journalEntry{Seq: seq, Deleted: []string{"inode"}}
+		if err := <-j.append(entry, nil); err != nil {
+			t.Fatalf("append(%d): %v", seq, err)
+		}
+	}
+}
+
+// replayed returns the sequence numbers of the entries of j after fromSeq.
+func replayed(t *testing.T, j *journal, fromSeq uint64) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	if _, err := j.replay(fromSeq, func(e *journalEntry) { seqs = append(seqs, e.Seq) }); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return seqs
+}
+
+func equalSeqs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestJournalReplayDamagedTail checks that a final record torn by a crash or
+// not matching its checksum is cut off on replay, and that the journal goes
+// on after the last intact entry.
+func TestJournalReplayDamagedTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(file []byte, last int) []byte
+	}{
+		{
+			name:   "torn header",
+			damage: func(file []byte, last int) []byte { return file[:last+4] },
+		},
+		{
+			name:   "torn payload",
+			damage: func(file []byte, last int) []byte { return file[:len(file)-1] },
+		},
+		{
+			name: "checksum mismatch",
+			damage: func(file []byte, last int) []byte {
+				file[len(file)-1] ^= 0xff
+				return file
+			},
+		},
+		{
+			name: "garbage length",
+			damage: func(file []byte, last int) []byte {
+				file[last+3] = 0xff
+				return file
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			j, err := openJournal(dir)
+			if err != nil {
+				t.Fatalf("openJournal: %v", err)
+			}
+			if err := j.start(1); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			appendEntries(t, j, 1, 2)
+			info, err := os.Stat(j.segmentPath(1))
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			intact := int(info.Size())
+			appendEntries(t, j, 3, 3)
+			if err := j.close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			file, err := os.ReadFile(j.segmentPath(1))
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if err := os.WriteFile(j.segmentPath(1), tt.damage(file, intact), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+
+			j, err = openJournal(dir)
+			if err != nil {
+				t.Fatalf("openJournal: %v", err)
+			}
+			if got := replayed(t, j, 0); !equalSeqs(got, []uint64{1, 2}) {
+				t.Fatalf("replayed %v, want [1 2]", got)
+			}
+			if info, err := os.Stat(j.segmentPath(1)); err != nil || info.Size() != int64(intact) {
+				t.Fatalf("Stat = %v, %v, want the damaged record cut off at %d", info, err, intact)
+			}
+
+			// The entry that was lost is written again after the intact ones
+			if err := j.start(3); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			appendEntries(t, j, 3, 4)
+			if err := j.close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			j, err = openJournal(dir)
+			if err != nil {
+				t.Fatalf("openJournal: %v", err)
+			}
+			if got := replayed(t, j, 0); !equalSeqs(got, []uint64{1, 2, 3, 4}) {
+				t.Fatalf("replayed %v, want [1 2 3 4]", got)
+			}
+		})
+	}
+}
+
+// TestJournalRotateCompact checks that compaction removes only the segments
+// whose entries are all covered, and never the current segment, even when a
+// crash left it empty and it was reopened.
+func TestJournalRotateCompact(t *testing.T) {
+	dir := t.TempDir()
+	j, err := openJournal(dir)
+	if err != nil {
+		t.Fatalf("openJournal: %v", err)
+	}
+	if err := j.start(1); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	appendEntries(t, j, 1, 2)
+	if err := j.rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	appendEntries(t, j, 3, 5)
+	if err := j.rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	// Nothing was written to the current segment, so there is nothing to rotate
+	if err := j.rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if len(j.segments) != 2 {
+		t.Fatalf("%d closed segments, want 2", len(j.segments))
+	}
+
+	if err := j.compact(4); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if _, err := os.Stat(j.segmentPath(1)); !os.IsNotExist(err) {
+		t.Fatalf("Stat = %v, want the covered segment removed", err)
+	}
+	if _, err := os.Stat(j.segmentPath(3)); err != nil {
+		t.Fatalf("Segment with entries after 4 was removed: %v", err)
+	}
+	var read []uint64
+	err = j.read(2, 5, func(e *journalEntry) error {
+		read = append(read, e.Seq)
+		return nil
+	})
+	if err != nil || !equalSeqs(read, []uint64{3, 4, 5}) {
+		t.Fatalf("read = %v, %v, want [3 4 5]", read, err)
+	}
+	if err := j.read(0, 5, func(*journalEntry) error { return nil }); !errors.Is(err, ErrJournalTruncated) {
+		t.Fatalf("read = %v, want %v", err, ErrJournalTruncated)
+	}
+
+	// A crash leaves the current segment empty
+	if err := j.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	j, err = openJournal(dir)
+	if err != nil {
+		t.Fatalf("openJournal: %v", err)
+	}
+	want := []journalSegment{
+		{path: j.segmentPath(3), first: 3, last: 5},
+		{path: j.segmentPath(6), first: 6, last: 5},
+	}
+	if len(j.segments) != len(want) {
+		t.Fatalf("segments = %+v, want %+v", j.segments, want)
+	}
+	for i := range want {
+		if j.segments[i] != want[i] {
+			t.Fatalf("segments = %+v, want %+v", j.segments, want)
+		}
+	}
+	if got := replayed(t, j, 2); !equalSeqs(got, []uint64{3, 4, 5}) {
+		t.Fatalf("replayed %v, want [3 4 5]", got)
+	}
+
+	if err := j.start(6); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if len(j.segments) != 1 {
+		t.Fatalf("segments = %+v, want the empty segment reopened as the current one", j.segments)
+	}
+	if err := j.compact(100); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if _, err := os.Stat(j.segmentPath(3)); !os.IsNotExist(err) {
+		t.Fatalf("Stat = %v, want the covered segment removed", err)
+	}
+	appendEntries(t, j, 6, 6)
+	if err := j.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	j, err = openJournal(dir)
+	if err != nil {
+		t.Fatalf("openJournal: %v", err)
+	}
+	if got := replayed(t, j, 5); !equalSeqs(got, []uint64{6}) {
+		t.Fatalf("replayed %v, want [6]", got)
+	}
+}
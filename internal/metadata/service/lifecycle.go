@@ -1,126 +1,405 @@
 package metadata_service
 
 import (
+	"bytes"
 	"encoding/gob"
-	dc "github.com/apolyeti/godfs/internal/data_node/client"
+	"errors"
+	"fmt"
 	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"github.com/apolyeti/godfs/internal/raft"
+	"io"
 	"log"
 	"os"
 	"sync"
 	"time"
 )
 
-// MetadataService has 2 fields
-// inodes: map of string to Inode
+// MetadataService has the following fields
+// store: inodes of the namespace by ID, guarded by mu
 // mu: RWMutex for concurrent access to inodes
+// chunkSize: cluster default chunk size for new files
+// events: namespace change events for Watch streams
+// locks: advisory locks by inode ID, guarded by mu
+// handles: open file handles by handle ID, guarded by mu
+// writers: ID of the handle holding the write lease, by inode ID
+// openCount: number of open handles, by inode ID
+// writeLocks: serialize the data node I/O of writes to the same file
+// nodes: data nodes that registered, chunks of new files are placed on them
+// legacyNodes: data nodes chunks of files written before nodes registered are placed on by position
+// suspectTimeout, deadTimeout: time without a heartbeat after which a data node is suspect, and dead
+// reconciler: last reconciliation of the block reports of the data nodes with the namespace
+// reconcileInterval: time between background reconciliations
+// corruptChunks: data node reporting each corrupt chunk no healthy copy was found for, guarded by corruptMu
+// journal: log of committed transactions since the last checkpoint, nil on a replica
+// raft: replicates committed transactions to the other replicas, nil unless replicated
+// standby: connection to the primary a standby follows, nil unless a standby
+// seq: sequence number of the last committed transaction, guarded by mu
+// checkpointMu: serializes checkpoints
+// checkpointSeq: sequence number covered by the last checkpoint, guarded by mu
+// standbyCheckpoint: last time a standby sent a checkpoint, guarded by mu
+// checkpointNow: requests a checkpoint ahead of the interval
+// checkpointInterval: time between background checkpoints
+// checkpointRetain: number of checkpoints kept on disk
 type MetadataService struct {
 	metadata.UnimplementedMetadataServiceServer
-	inodes       map[string]*Inode
+	store        MetadataStore
 	mu           sync.RWMutex
-	dataNodes    []string
-	numDataNodes int
+	nodes        *nodeSet
+	legacyNodes  []string
+	chunkSize    int64
+	events       *watchHub
+	locks        map[string]*FileLock
+	handles      map[string]*fileHandle
+	writers      map[string]string
+	openCount    map[string]int
+	writeLocks   *inodeLocks
+	journal      *journal
+	raft         *raft.Node
+	standby      *standby
+	seq          uint64
 	shutdownChan chan struct{}
+
+	suspectTimeout time.Duration
+	deadTimeout    time.Duration
+
+	reconciler        reconciler
+	reconcileInterval time.Duration
+
+	corruptMu     sync.Mutex
+	corruptChunks map[string]string
+
+	checkpointMu       sync.Mutex
+	checkpointSeq      uint64
+	standbyCheckpoint  time.Time
+	checkpointNow      chan struct{}
+	checkpointInterval time.Duration
+	checkpointRetain   int
 }
 
 // NewMetadataService creates a new MetadataService
 
-func NewMetadataService() *MetadataService {
-	m := &MetadataService{
-		inodes:       make(map[string]*Inode),
-		numDataNodes: 3,
-		dataNodes: []string{
-			"data_node_1:50051",
-			"data_node_2:50052",
-			"data_node_3:50053",
-		},
-	}
-	m.initializeRootDirectory()
-	err := m.LoadFromDisk()
+func NewMetadataService(cfg Config) *MetadataService {
+	var m *MetadataService
+	var err error
+	switch {
+	case cfg.RaftID != "":
+		m, err = openReplica(cfg)
+	case cfg.Standby != "":
+		m, err = openStandby(cfg)
+	default:
+		m, err = openMetadataService(cfg)
+	}
 	if err != nil {
-		log.Printf("No previous metadata found, starting with empty state")
+		log.Fatalf("Failed to load metadata: %v", err)
 	}
 
-	go m.startHeartbeatLoop()
+	// A replica recovers its state from its group, and a standby from its primary
+	if m.standby != nil {
+		go m.followPrimary()
+	} else if m.raft == nil {
+		if err := m.recoverInodes(); err != nil {
+			log.Fatalf("Failed to recover metadata: %v", err)
+		}
+
+		if err := m.journal.start(m.seq + 1); err != nil {
+			log.Fatalf("Failed to start journal: %v", err)
+		}
+	}
+
+	go m.startLivenessLoop()
+	go m.startReconcileLoop()
+	go m.startLeaseLoop()
+	go m.startCheckpointLoop()
 	return m
 }
 
+// newMetadataService returns a service over store that serves no namespace yet.
+func newMetadataService(cfg Config, store MetadataStore) *MetadataService {
+	return &MetadataService{
+		store:              store,
+		chunkSize:          cfg.ChunkSize,
+		events:             newWatchHub(),
+		locks:              make(map[string]*FileLock),
+		handles:            make(map[string]*fileHandle),
+		writers:            make(map[string]string),
+		openCount:          make(map[string]int),
+		writeLocks:         newInodeLocks(),
+		shutdownChan:       make(chan struct{}),
+		nodes:              newNodeSet(),
+		legacyNodes:        cfg.LegacyDataNodes,
+		suspectTimeout:     cfg.SuspectTimeout,
+		deadTimeout:        cfg.DeadTimeout,
+		reconcileInterval:  cfg.ReconcileInterval,
+		checkpointNow:      make(chan struct{}, 1),
+		checkpointInterval: cfg.CheckpointInterval,
+		checkpointRetain:   cfg.CheckpointRetain,
+		corruptChunks:      make(map[string]string),
+	}
+}
+
+// openMetadataService restores the namespace kept in the working directory
+// from its checkpoint and journal, without starting to serve it.
+func openMetadataService(cfg Config) (*MetadataService, error) {
+	cfg = cfg.withDefaults()
+
+	store, err := openStore(cfg.Store)
+	if err != nil {
+		return nil, fmt.Errorf("opening metadata store: %w", err)
+	}
+
+	m := newMetadataService(cfg, store)
+
+	err = m.LoadFromDisk()
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No previous metadata found, starting with empty state")
+	} else if err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+
+	m.journal, err = openJournal(journalDir)
+	if err != nil {
+		_ = store.Close()
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+
+	// Transactions committed after the checkpoint was taken are redone from the journal
+	loadedSeq := m.seq
+	if _, err := m.journal.replay(loadedSeq, m.applyEntry); err != nil {
+		_ = store.Close()
+		return nil, fmt.Errorf("replaying journal: %w", err)
+	}
+	if m.seq > loadedSeq {
+		log.Printf("Replayed %d journal entries", m.seq-loadedSeq)
+	}
+
+	if err := m.initializeRootDirectory(); err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
 // RootID is the ID of the root directory
 const RootID = "root"
 
-func (m *MetadataService) initializeRootDirectory() {
-	if _, ok := m.inodes[RootID]; !ok {
-		m.inodes[RootID] = &Inode{
-			ID:               RootID,
-			Name:             "/",
-			IsDir:            true,
-			DirectoryEntries: map[string]string{},
-		}
+func (m *MetadataService) initializeRootDirectory() error {
+	_, err := m.store.Get(RootID)
+	if err != ErrFileNotFound {
+		return err
 	}
+
+	m.store.Apply([]*Inode{{
+		ID:               RootID,
+		Name:             "/",
+		IsDir:            true,
+		DirectoryEntries: map[string]string{},
+		Generation:       1,
+	}}, nil)
+	return nil
 }
 
+// LoadFromDisk loads the newest intact checkpoint, or the snapshot saved
+// before checkpoints were introduced if there is none yet.
 func (m *MetadataService) LoadFromDisk() error {
-	file, err := os.Open(".storage/metadata.gob")
+	err := m.loadCheckpoint()
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	file, err := os.Open(legacySnapshotPath)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("Failed to close metadata file: %v", err)
+		}
+	}()
 
+	inodes := make(map[string]*Inode)
 	dec := gob.NewDecoder(file)
-	err = dec.Decode(&m.inodes)
+	err = dec.Decode(&inodes)
 	if err != nil {
 		return err
 	}
+	m.loadInodes(inodes)
+
+	// Lock state follows the inodes, but is missing from older saves
+	err = dec.Decode(&m.locks)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	// Saves made before the journal existed have no sequence number
+	err = dec.Decode(&m.seq)
+	if err != nil && err != io.EOF {
+		return err
+	}
 
 	return nil
 }
 
+// loadInodes replaces the namespace with inodes read from a checkpoint.
+func (m *MetadataService) loadInodes(inodes map[string]*Inode) {
+	if store, ok := m.store.(*memStore); ok {
+		store.inodes = inodes
+		return
+	}
+
+	// A persistent store imports them once, they are flushed by the next checkpoint
+	puts := make([]*Inode, 0, len(inodes))
+	for _, inode := range inodes {
+		puts = append(puts, inode)
+	}
+	m.store.Apply(puts, nil)
+	if store, ok := m.store.(PersistentStore); ok {
+		store.SetMigrated(false)
+	}
+}
+
+// recoverInodes brings the loaded state up to date with the running service.
+// A persistent store is only read in full until it records that it was, as
+// it may hold tens of millions of inodes.
+func (m *MetadataService) recoverInodes() error {
+	m.expireLocks(time.Now())
+
+	store, persistent := m.store.(PersistentStore)
+	if persistent && store.Migrated() {
+		for _, id := range store.Unlinked() {
+			inode, err := m.store.Get(id)
+			if err == ErrFileNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			m.dropInode(inode)
+		}
+		return nil
+	}
+
+	var puts, dropped []*Inode
+	err := m.store.ForEach(func(inode *Inode) error {
+		// Handles do not survive a restart, so files removed while open are gone
+		if inode.Unlinked {
+			dropped = append(dropped, inode)
+			return nil
+		}
+
+		// Inodes saved before generations were recorded start at the first one,
+		// and files saved before chunk sizes were recorded were split at legacyChunkSize
+		if inode.Generation == 0 || (!inode.IsDir && inode.ChunkSize == 0) {
+			inode = inode.Clone()
+			if inode.Generation == 0 {
+				inode.Generation = 1
+			}
+			if !inode.IsDir && inode.ChunkSize == 0 {
+				inode.UpdateChunkSize(legacyChunkSize)
+			}
+			puts = append(puts, inode)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.store.Apply(puts, nil)
+	for _, inode := range dropped {
+		m.dropInode(inode)
+	}
+	if persistent {
+		store.SetMigrated(true)
+	}
+	return nil
+}
+
+// SaveToDisk writes a checkpoint of the namespace, then removes the
+// checkpoints and journal segments that are no longer needed.
 func (m *MetadataService) SaveToDisk() error {
+	m.checkpointMu.Lock()
+	defer m.checkpointMu.Unlock()
+
+	// A replica keeps its namespace in its raft snapshot instead, and a
+	// standby checkpoints on behalf of its primary
+	if m.raft != nil {
+		return m.saveSnapshot()
+	}
+	if m.following() {
+		return m.sendCheckpoint()
+	}
+
+	var state bytes.Buffer
 	m.mu.RLock()
-	defer m.mu.RUnlock()
-	file, err := os.Create(".storage/metadata.gob")
+	seq := m.seq
+	err := m.encodeState(&state)
+	if err == nil && m.journal != nil {
+		// Entries from here on are not covered by this checkpoint
+		err = m.journal.rotate()
+	}
+	m.mu.RUnlock()
 	if err != nil {
 		return err
 	}
 
-	enc := gob.NewEncoder(file)
-	err = enc.Encode(m.inodes)
+	if err := writeCheckpoint(seq, state.Bytes()); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.checkpointSeq = seq
+	m.mu.Unlock()
+
+	return m.compact()
+}
+
+// compact removes the checkpoints and journal segments that are no longer
+// needed once a checkpoint was written.
+func (m *MetadataService) compact() error {
+	// The checkpoint supersedes the snapshot it may have been loaded from
+	if err := os.Remove(legacySnapshotPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	oldest, err := pruneCheckpoints(m.checkpointRetain)
 	if err != nil {
 		return err
 	}
 
+	// Falling back to the oldest checkpoint needs every entry after it
+	if m.journal != nil {
+		return m.journal.compact(oldest)
+	}
 	return nil
 }
 
 func (m *MetadataService) Shutdown() {
+	close(m.shutdownChan)
+
 	err := m.SaveToDisk()
 	if err != nil {
 		log.Printf("Error saving metadata to disk: %v", err)
 	}
-}
-
-func (m *MetadataService) SendHeartbeat() {
-	for _, dataNode := range m.dataNodes {
-		client := dc.NewClient(dataNode)
-		err := client.SendHeartbeat()
 
-		if err != nil {
-			log.Printf("Error sending heartbeat to %v: %v. Consider replacing this node", dataNode, err)
+	if m.standby != nil {
+		if err := m.standby.close(); err != nil {
+			log.Printf("Error closing connection to primary: %v", err)
 		}
-
-		log.Println("Heartbeat successfully sent to", dataNode)
 	}
-}
 
-func (m *MetadataService) startHeartbeatLoop() {
-	ticker := time.NewTicker(5 * time.Second)
-
-	for {
-		select {
-		case <-ticker.C:
-			m.SendHeartbeat()
-		case <-m.shutdownChan:
-			log.Println("Shutting down heartbeat loop")
-			ticker.Stop()
-			return
+	if m.raft != nil {
+		if err := m.raft.Close(); err != nil {
+			log.Printf("Error closing raft log: %v", err)
+		}
+	} else if m.journal != nil {
+		if err := m.journal.close(); err != nil {
+			log.Printf("Error closing journal: %v", err)
 		}
 	}
+
+	if err := m.store.Close(); err != nil {
+		log.Printf("Error closing metadata store: %v", err)
+	}
 }
@@ -0,0 +1,52 @@
+package metadata_service
+
+import (
+	"testing"
+)
+
+// TestRecoverInodesMigrated checks that a store recorded as migrated is not
+// read in full again, while files removed while open are still dropped.
+func TestRecoverInodesMigrated(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestDiskStore(t, dir)
+	store.Apply([]*Inode{{ID: "legacy", Name: "legacy"}}, nil)
+	if err := store.Flush(1); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	m := &MetadataService{store: store, locks: make(map[string]*FileLock)}
+	if err := m.recoverInodes(); err != nil {
+		t.Fatalf("recoverInodes: %v", err)
+	}
+	if inode, _ := store.Get("legacy"); inode.Generation != 1 {
+		t.Fatalf("Generation = %d after the first recovery, want 1", inode.Generation)
+	}
+	if !store.Migrated() {
+		t.Fatalf("Migrated = false after the first recovery, want true")
+	}
+
+	// An inode the migration would rewrite shows whether the store is read again
+	store.Apply([]*Inode{{ID: "stale", Name: "stale"}, {ID: "open", Name: "open", Generation: 1, Unlinked: true}}, nil)
+	if err := store.Flush(2); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	store = openTestDiskStore(t, dir)
+	defer store.Close()
+	m = &MetadataService{store: store, locks: make(map[string]*FileLock)}
+	if err := m.recoverInodes(); err != nil {
+		t.Fatalf("recoverInodes: %v", err)
+	}
+	if inode, _ := store.Get("stale"); inode.Generation != 0 {
+		t.Errorf("Generation = %d, want the store not to be read in full", inode.Generation)
+	}
+	if _, err := store.Get("open"); err != ErrFileNotFound {
+		t.Errorf("Get(open) = %v, want ErrFileNotFound", err)
+	}
+	if got := store.Unlinked(); len(got) != 0 {
+		t.Errorf("Unlinked = %v, want none", got)
+	}
+}
@@ -0,0 +1,286 @@
+package metadata_service
+
+import (
+	"context"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"log"
+	"time"
+)
+
+const (
+	// DefaultLockLease is how long a lock is held without being renewed.
+	DefaultLockLease = 30 * time.Second
+	// MaxLockLease is the longest lease a client may ask for.
+	MaxLockLease = 10 * time.Minute
+)
+
+// LockMode is the mode an advisory lock is held in.
+type LockMode int
+
+const (
+	LockShared LockMode = iota
+	LockExclusive
+)
+
+// FileLock is the advisory lock state of a single inode.
+// Mode: Shared or exclusive
+// Mandatory: True if WriteFile is rejected for clients not holding the lock exclusively
+// Holders: Map of lock owner to the time at which its lease expires
+type FileLock struct {
+	Mode      LockMode
+	Mandatory bool
+	Holders   map[string]time.Time
+}
+
+// Clone returns a copy of the lock that shares no state with it.
+func (l *FileLock) Clone() *FileLock {
+	clone := *l
+	clone.Holders = make(map[string]time.Time, len(l.Holders))
+	for owner, expiry := range l.Holders {
+		clone.Holders[owner] = expiry
+	}
+	return &clone
+}
+
+// expireLocks drops every expired lease. Locks are changed in place, so it
+// is only used on startup, before any transaction.
+func (m *MetadataService) expireLocks(now time.Time) {
+	for inodeID, lock := range m.locks {
+		for owner, expiry := range lock.Holders {
+			if !now.Before(expiry) {
+				delete(lock.Holders, owner)
+			}
+		}
+		if len(lock.Holders) == 0 {
+			delete(m.locks, inodeID)
+		}
+	}
+}
+
+func (t *txn) acquireLock(
+	inodeID string,
+	owner string,
+	mode LockMode,
+	lease time.Duration,
+	mandatory bool,
+) (*FileLock, time.Time, error) {
+	now := time.Now()
+	expiry := now.Add(lease)
+
+	lock := t.editLock(inodeID, now)
+	if lock == nil {
+		lock = &FileLock{
+			Mode:      mode,
+			Mandatory: mandatory,
+			Holders:   map[string]time.Time{owner: expiry},
+		}
+		t.putLock(inodeID, lock)
+		return lock, expiry, nil
+	}
+
+	_, held := lock.Holders[owner]
+	switch {
+	case held && len(lock.Holders) == 1:
+		// The sole holder may upgrade or downgrade its lock
+		lock.Mode = mode
+	case held && mode == lock.Mode:
+		// Re-acquiring a shared lock only extends the lease
+	case lock.Mode == LockExclusive || mode == LockExclusive:
+		return nil, time.Time{}, ErrLocked
+	}
+
+	lock.Holders[owner] = expiry
+	lock.Mandatory = lock.Mandatory || mandatory
+	return lock, expiry, nil
+}
+
+func (t *txn) releaseLock(inodeID string, owner string) error {
+	lock := t.editLock(inodeID, time.Now())
+	if lock == nil {
+		return ErrNotLockHolder
+	}
+	if _, held := lock.Holders[owner]; !held {
+		return ErrNotLockHolder
+	}
+	delete(lock.Holders, owner)
+	if len(lock.Holders) == 0 {
+		t.putLock(inodeID, nil)
+	}
+	return nil
+}
+
+func (t *txn) renewLock(
+	inodeID string,
+	owner string,
+	lease time.Duration,
+) (*FileLock, time.Time, error) {
+	lock := t.editLock(inodeID, time.Now())
+	if lock == nil {
+		return nil, time.Time{}, ErrNotLockHolder
+	}
+	if _, held := lock.Holders[owner]; !held {
+		return nil, time.Time{}, ErrNotLockHolder
+	}
+	expiry := time.Now().Add(lease)
+	lock.Holders[owner] = expiry
+	return lock, expiry, nil
+}
+
+// checkWriteLock returns ErrLocked if a mandatory lock on inodeID keeps owner
+// from writing it. Expired leases are ignored rather than dropped, so that
+// it may run with m.mu held for reading.
+func (m *MetadataService) checkWriteLock(inodeID string, owner string) error {
+	lock, ok := m.locks[inodeID]
+	if !ok || !lock.Mandatory {
+		return nil
+	}
+
+	// Only the holder of an exclusive lock may write
+	now := time.Now()
+	for holder, expiry := range lock.Holders {
+		if now.Before(expiry) && (holder != owner || lock.Mode != LockExclusive) {
+			return ErrLocked
+		}
+	}
+	return nil
+}
+
+func leaseDuration(leaseMs int64) time.Duration {
+	if leaseMs <= 0 {
+		return DefaultLockLease
+	}
+	lease := time.Duration(leaseMs) * time.Millisecond
+	if lease > MaxLockLease {
+		return MaxLockLease
+	}
+	return lease
+}
+
+func toLockMode(mode metadata.LockMode) (LockMode, error) {
+	switch mode {
+	case metadata.LockMode_LOCK_MODE_SHARED:
+		return LockShared, nil
+	case metadata.LockMode_LOCK_MODE_EXCLUSIVE:
+		return LockExclusive, nil
+	default:
+		return 0, ErrInvalidLockMode
+	}
+}
+
+func toProtoLockMode(mode LockMode) metadata.LockMode {
+	if mode == LockExclusive {
+		return metadata.LockMode_LOCK_MODE_EXCLUSIVE
+	}
+	return metadata.LockMode_LOCK_MODE_SHARED
+}
+
+func (m *MetadataService) Lock(
+	ctx context.Context,
+	req *metadata.LockRequest,
+) (
+	*metadata.LockResponse,
+	error,
+) {
+	log.Printf("LOCK\t%v", req)
+
+	if req.Owner == "" {
+		return nil, ErrInvalidOwner
+	}
+
+	mode, err := toLockMode(req.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *metadata.LockResponse
+	err = m.update(func(t *txn) error {
+		inode, err := t.lookup(req.CurrentDirectoryId, req.FileName)
+		if err != nil {
+			return err
+		}
+
+		lock, expiry, err := t.acquireLock(inode.ID, req.Owner, mode, leaseDuration(req.LeaseMs), req.Mandatory)
+		if err != nil {
+			return err
+		}
+
+		resp = &metadata.LockResponse{
+			Inode:     inode.ID,
+			Mode:      toProtoLockMode(lock.Mode),
+			ExpiresAt: expiry.UnixNano(),
+			Mandatory: lock.Mandatory,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (m *MetadataService) Unlock(
+	ctx context.Context,
+	req *metadata.UnlockRequest,
+) (
+	*metadata.UnlockResponse,
+	error,
+) {
+	log.Printf("UNLOCK\t%v", req)
+
+	var inode *Inode
+	err := m.update(func(t *txn) error {
+		var err error
+		if inode, err = t.lookup(req.CurrentDirectoryId, req.FileName); err != nil {
+			return err
+		}
+
+		if err := t.releaseLock(inode.ID, req.Owner); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata.UnlockResponse{
+		Inode: inode.ID,
+	}, nil
+}
+
+func (m *MetadataService) RenewLock(
+	ctx context.Context,
+	req *metadata.RenewLockRequest,
+) (
+	*metadata.LockResponse,
+	error,
+) {
+	log.Printf("RENEWLOCK\t%v", req)
+
+	var resp *metadata.LockResponse
+	err := m.update(func(t *txn) error {
+		inode, err := t.lookup(req.CurrentDirectoryId, req.FileName)
+		if err != nil {
+			return err
+		}
+
+		lock, expiry, err := t.renewLock(inode.ID, req.Owner, leaseDuration(req.LeaseMs))
+		if err != nil {
+			return err
+		}
+
+		resp = &metadata.LockResponse{
+			Inode:     inode.ID,
+			Mode:      toProtoLockMode(lock.Mode),
+			ExpiresAt: expiry.UnixNano(),
+			Mandatory: lock.Mandatory,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
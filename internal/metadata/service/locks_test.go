@@ -0,0 +1,66 @@
+package metadata_service
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestLockAbort checks that lock changes made by a transaction that fails
+// are not applied, while those of a committed one are.
+func TestLockAbort(t *testing.T) {
+	m := newTestService(t, nil)
+	errAbort := errors.New("abort")
+
+	err := m.update(func(t *txn) error {
+		if _, _, err := t.acquireLock("file", "a", LockExclusive, time.Minute, false); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("update = %v, want %v", err, errAbort)
+	}
+	if _, ok := m.locks["file"]; ok {
+		t.Fatalf("Lock acquired by an aborted transaction was applied")
+	}
+
+	err = m.update(func(t *txn) error {
+		_, _, err := t.acquireLock("file", "a", LockShared, time.Minute, false)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("acquireLock: %v", err)
+	}
+	committed := m.locks["file"]
+
+	err = m.update(func(t *txn) error {
+		if _, _, err := t.acquireLock("file", "b", LockShared, time.Minute, true); err != nil {
+			return err
+		}
+		if err := t.releaseLock("file", "a"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("update = %v, want %v", err, errAbort)
+	}
+	lock := m.locks["file"]
+	if lock != committed || len(lock.Holders) != 1 || lock.Mandatory {
+		t.Fatalf("Lock = %+v after an aborted transaction, want %+v", lock, committed)
+	}
+	if _, held := lock.Holders["a"]; !held {
+		t.Fatalf("Holders = %v, want a", lock.Holders)
+	}
+
+	err = m.update(func(t *txn) error {
+		return t.releaseLock("file", "a")
+	})
+	if err != nil {
+		t.Fatalf("releaseLock: %v", err)
+	}
+	if _, ok := m.locks["file"]; ok {
+		t.Fatalf("Lock released by its last holder was kept")
+	}
+}
@@ -0,0 +1,279 @@
+package metadata_service
+
+import (
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"strings"
+)
+
+// create adds a new file or directory named name to the directory parentID,
+// or to the root directory if parentID is empty.
+func (t *txn) create(parentID string, name string, isDir bool, chunkSize int64) (*Inode, error) {
+	if parentID == "" {
+		parentID = RootID
+	}
+
+	parentInode, ok := t.get(parentID)
+	if !ok {
+		return nil, ErrDirNotFound
+	}
+
+	if !parentInode.IsDir {
+		return nil, ErrNotDir
+	}
+
+	if !validName(name) {
+		return nil, ErrInvalidName
+	}
+
+	if _, exists := parentInode.DirectoryEntries[name]; exists {
+		return nil, ErrExists
+	}
+
+	if chunkSize != 0 && !validChunkSize(chunkSize) {
+		return nil, ErrInvalidSize
+	}
+
+	inode := NewInode(name, isDir)
+
+	// Directories only keep an explicitly requested chunk size, so they follow
+	// their ancestors otherwise. Files always record the size they are split at.
+	if isDir || chunkSize != 0 {
+		inode.UpdateChunkSize(chunkSize)
+	} else {
+		inode.UpdateChunkSize(t.inheritedChunkSize(parentInode))
+	}
+
+	inode.UpdateParentID(parentID)
+	t.put(inode)
+
+	parentInode, _ = t.edit(parentID)
+	parentInode.DirectoryEntries[name] = inode.ID
+	parentInode.Touch()
+
+	t.notify(metadata.EventType_EVENT_TYPE_CREATE, inode, parentID, name, "", "")
+
+	return inode, nil
+}
+
+// remove removes inode from its directory. Directories must be empty.
+// Files that are still open stay readable through their handles until the
+// last one is closed.
+func (t *txn) remove(inode *Inode, owner string, expectedGeneration uint64) (*Inode, error) {
+	if inode.ID == RootID {
+		return nil, ErrInvalidPath
+	}
+
+	if inode.IsDir && len(inode.DirectoryEntries) > 0 {
+		return nil, ErrNotEmpty
+	}
+
+	if err := t.m.checkWriteLock(inode.ID, owner); err != nil {
+		return nil, err
+	}
+
+	if err := checkGeneration(inode, expectedGeneration); err != nil {
+		return nil, err
+	}
+
+	parentInode, ok := t.edit(inode.ParentID)
+	if !ok {
+		return nil, ErrDirNotFound
+	}
+	delete(parentInode.DirectoryEntries, inode.Name)
+	parentInode.Touch()
+
+	inode, _ = t.edit(inode.ID)
+	inode.Touch()
+
+	t.notify(metadata.EventType_EVENT_TYPE_DELETE, inode, parentInode.ID, inode.Name, "", "")
+
+	if t.openCount(inode.ID) > 0 {
+		inode.Unlinked = true
+	} else {
+		t.del(inode.ID)
+		t.onCommit(func() { t.m.releaseInode(inode) })
+	}
+
+	return inode, nil
+}
+
+// rename moves inode to newName in the directory targetDirID.
+// Existing entries are never replaced.
+func (t *txn) rename(
+	inode *Inode,
+	targetDirID string,
+	newName string,
+	owner string,
+	expectedGeneration uint64,
+) (*Inode, error) {
+	if inode.ID == RootID {
+		return nil, ErrInvalidPath
+	}
+
+	if err := t.m.checkWriteLock(inode.ID, owner); err != nil {
+		return nil, err
+	}
+
+	if err := checkGeneration(inode, expectedGeneration); err != nil {
+		return nil, err
+	}
+
+	if !validName(newName) {
+		return nil, ErrInvalidName
+	}
+
+	newParent, ok := t.get(targetDirID)
+	if !ok {
+		return nil, ErrDirNotFound
+	}
+	if !newParent.IsDir {
+		return nil, ErrNotDir
+	}
+
+	if _, exists := newParent.DirectoryEntries[newName]; exists {
+		return nil, ErrExists
+	}
+
+	// A directory cannot be moved below itself
+	if inode.IsDir {
+		ancestors := make(map[string]struct{})
+		t.addAncestors(ancestors, newParent.ID)
+		if _, below := ancestors[inode.ID]; below {
+			return nil, ErrInvalidPath
+		}
+	}
+
+	oldName := inode.Name
+	oldParent, ok := t.edit(inode.ParentID)
+	if !ok {
+		return nil, ErrDirNotFound
+	}
+	delete(oldParent.DirectoryEntries, oldName)
+	oldParent.Touch()
+
+	newParent, _ = t.edit(targetDirID)
+	newParent.DirectoryEntries[newName] = inode.ID
+	newParent.Touch()
+
+	inode, _ = t.edit(inode.ID)
+	inode.UpdateName(newName)
+	inode.UpdateParentID(newParent.ID)
+	inode.Touch()
+
+	t.notify(metadata.EventType_EVENT_TYPE_RENAME, inode, newParent.ID, newName, oldParent.ID, oldName)
+
+	return inode, nil
+}
+
+// setAttr changes the attributes of inode that are set in attrs.
+func (t *txn) setAttr(
+	inode *Inode,
+	attrs *metadata.Attributes,
+	owner string,
+	expectedGeneration uint64,
+) (*Inode, error) {
+	if err := t.m.checkWriteLock(inode.ID, owner); err != nil {
+		return nil, err
+	}
+
+	if err := checkGeneration(inode, expectedGeneration); err != nil {
+		return nil, err
+	}
+
+	if attrs == nil {
+		attrs = &metadata.Attributes{}
+	}
+
+	if attrs.Permissions != nil && !validPermissions(*attrs.Permissions) {
+		return nil, ErrInvalidPermissions
+	}
+
+	inode, _ = t.edit(inode.ID)
+	if attrs.Permissions != nil {
+		inode.UpdatePermissions(*attrs.Permissions)
+	}
+	if attrs.Uid != nil {
+		inode.Ownership.UID = int(*attrs.Uid)
+	}
+	if attrs.Gid != nil {
+		inode.Ownership.GID = int(*attrs.Gid)
+	}
+	inode.Touch()
+
+	t.notify(metadata.EventType_EVENT_TYPE_ATTRIBUTE, inode, inode.ParentID, inode.Name, "", "")
+
+	return inode, nil
+}
+
+// validPermissions reports whether permissions is in the rwxr-xr-x form.
+func validPermissions(permissions string) bool {
+	if len(permissions) != 9 {
+		return false
+	}
+	for i, c := range permissions {
+		if c != '-' && c != rune("rwx"[i%3]) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve returns the inode at path, relative to the directory dirID unless
+// it starts with "/".
+func (t *txn) resolve(dirID string, path string) (*Inode, error) {
+	if dirID == "" || strings.HasPrefix(path, "/") {
+		dirID = RootID
+	}
+
+	inode, ok := t.get(dirID)
+	if !ok {
+		return nil, ErrDirNotFound
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if inode.ID != RootID {
+				if inode, ok = t.get(inode.ParentID); !ok {
+					return nil, ErrDirNotFound
+				}
+			}
+			continue
+		}
+
+		var err error
+		if inode, err = t.lookup(inode.ID, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return inode, nil
+}
+
+// resolveParent returns the directory holding the entry at path, and the name
+// of the entry within it.
+func (t *txn) resolveParent(dirID string, path string) (*Inode, string, error) {
+	path = strings.TrimRight(path, "/")
+	i := strings.LastIndex(path, "/")
+
+	dirPath, name := "", path
+	if i >= 0 {
+		dirPath, name = path[:i+1], path[i+1:]
+	}
+
+	if !validName(name) {
+		return nil, "", ErrInvalidName
+	}
+
+	dir, err := t.resolve(dirID, dirPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.IsDir {
+		return nil, "", ErrNotDir
+	}
+
+	return dir, name, nil
+}
@@ -0,0 +1,361 @@
+package metadata_service
+
+import (
+	"context"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// nodeState is the health of a registered data node, following from the
+// time since it was last seen.
+type nodeState int
+
+const (
+	// nodeLive data nodes sent a heartbeat within the suspect timeout.
+	nodeLive nodeState = iota
+	// nodeSuspect data nodes missed heartbeats. No chunks are placed on them,
+	// but their chunks are still read.
+	nodeSuspect
+	// nodeDead data nodes sent no heartbeat within the dead timeout.
+	nodeDead
+)
+
+func (state nodeState) String() string {
+	switch state {
+	case nodeLive:
+		return "live"
+	case nodeSuspect:
+		return "suspect"
+	default:
+		return "dead"
+	}
+}
+
+func (state nodeState) proto() metadata.NodeState {
+	switch state {
+	case nodeLive:
+		return metadata.NodeState_NODE_STATE_LIVE
+	case nodeSuspect:
+		return metadata.NodeState_NODE_STATE_SUSPECT
+	default:
+		return metadata.NodeState_NODE_STATE_DEAD
+	}
+}
+
+// dataNode is a data node registered with the metadata service.
+// ID: ID the data node keeps across restarts
+// Address: Address the data node serves chunks on
+// Capacity: Bytes the data node may store, 0 if unlimited
+// Used: Bytes the data node stored when it last registered or sent a heartbeat
+// Labels: Labels the data node was started with, such as its rack
+// Registered: Last time the data node registered
+// LastSeen: Last time the data node registered or sent a heartbeat
+// State: Health of the data node as of the last liveness check
+type dataNode struct {
+	ID         string
+	Address    string
+	Capacity   int64
+	Used       int64
+	Labels     map[string]string
+	Registered time.Time
+	LastSeen   time.Time
+	State      nodeState
+}
+
+// nodeSet holds the data nodes that registered with the metadata service.
+// It is not persisted, data nodes register again when a heartbeat finds the
+// metadata service does not know them.
+// Used, LastSeen and State of the data nodes are guarded by mu, the other
+// fields are only set when a data node registers.
+// reports: last block reports of the data nodes since they registered
+// commands: commands queued for the data nodes, by data node ID
+// nextCommand: ID of the last command queued, starting from the time the
+// service started so that IDs are not reused after a restart
+// next: position of the data node the next chunk is placed on
+type nodeSet struct {
+	mu          sync.RWMutex
+	nodes       map[string]*dataNode
+	reports     map[string]*blockReport
+	commands    map[string][]*queuedCommand
+	nextCommand uint64
+	next        int
+}
+
+func newNodeSet() *nodeSet {
+	return &nodeSet{
+		nodes:       make(map[string]*dataNode),
+		reports:     make(map[string]*blockReport),
+		commands:    make(map[string][]*queuedCommand),
+		nextCommand: uint64(time.Now().UnixNano()),
+	}
+}
+
+// register adds a data node as live, or updates it if it registered before,
+// and reports whether it is new. Its block reports are dropped, as it sends
+// a full report after registering.
+func (s *nodeSet) register(node *dataNode) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reports, node.ID)
+	s.resend(node.ID)
+	old, ok := s.nodes[node.ID]
+	if ok && old.State != nodeLive {
+		log.Printf("Data node %s is live again after being %v", node.ID, old.State)
+	}
+	node.LastSeen = node.Registered
+	node.State = nodeLive
+	s.nodes[node.ID] = node
+	return !ok
+}
+
+// heartbeat marks the data node registered under id as seen at now, and
+// reports whether it is registered. It returns the commands to send to the
+// data node, after removing those it completed.
+func (s *nodeSet) heartbeat(
+	id string,
+	used int64,
+	completed []*metadata.CommandResult,
+	now time.Time,
+) (bool, []*metadata.DataNodeCommand) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.nodes[id]
+	if !ok {
+		return false, nil
+	}
+	if node.State != nodeLive {
+		log.Printf("Data node %s is live again after being %v", id, node.State)
+	}
+	node.Used = used
+	node.LastSeen = now
+	node.State = nodeLive
+	return true, s.acknowledge(id, completed, now)
+}
+
+// check moves the data nodes not seen within suspectTimeout of now to
+// suspect, and those not seen within deadTimeout to dead.
+func (s *nodeSet) check(now time.Time, suspectTimeout time.Duration, deadTimeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, node := range s.nodes {
+		state := nodeLive
+		switch since := now.Sub(node.LastSeen); {
+		case since >= deadTimeout:
+			state = nodeDead
+		case since >= suspectTimeout:
+			state = nodeSuspect
+		}
+		if state != node.State {
+			log.Printf("Data node %s at %s is %v, last seen %v ago", node.ID, node.Address, state, now.Sub(node.LastSeen).Round(time.Second))
+			node.State = state
+		}
+	}
+}
+
+// get returns the data node registered under id.
+func (s *nodeSet) get(id string) (*dataNode, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	node, ok := s.nodes[id]
+	return node, ok
+}
+
+// list returns copies of the registered data nodes ordered by ID.
+func (s *nodeSet) list() []*dataNode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	nodes := s.sorted()
+	for i, node := range nodes {
+		copied := *node
+		nodes[i] = &copied
+	}
+	return nodes
+}
+
+func (s *nodeSet) sorted() []*dataNode {
+	nodes := make([]*dataNode, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// place returns the data nodes to store n chunks on, taking turns over the
+// live data nodes, or nil if none registered.
+func (s *nodeSet) place(n int) ([]*dataNode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.nodes) == 0 {
+		return nil, nil
+	}
+	var nodes []*dataNode
+	for _, node := range s.sorted() {
+		if node.State == nodeLive {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, ErrNoLiveDataNodes
+	}
+
+	placed := make([]*dataNode, n)
+	for i := range placed {
+		placed[i] = nodes[(s.next+i)%len(nodes)]
+	}
+	s.next = (s.next + n) % len(nodes)
+	return placed, nil
+}
+
+// chunkAddress returns the address of the data node holding the chunk at
+// index of a file, given the IDs of the data nodes holding its chunks.
+// Chunks of files written before data nodes registered are placed on the
+// legacy data nodes by position instead.
+func (m *MetadataService) chunkAddress(chunkNodes []string, index int) (string, error) {
+	if len(chunkNodes) == 0 {
+		if len(m.legacyNodes) == 0 {
+			return "", ErrNoDataNodes
+		}
+		return m.legacyNodes[index%len(m.legacyNodes)], nil
+	}
+
+	node, ok := m.nodes.get(chunkNodes[index])
+	if !ok {
+		return "", ErrDataNodeUnknown
+	}
+	return node.Address, nil
+}
+
+// dataNodeAddresses returns the address of every registered data node, and
+// of the legacy data nodes if withLegacy is set.
+func (m *MetadataService) dataNodeAddresses(withLegacy bool) []string {
+	seen := make(map[string]bool)
+	var addresses []string
+	add := func(address string) {
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+
+	for _, node := range m.nodes.list() {
+		add(node.Address)
+	}
+	if withLegacy {
+		for _, address := range m.legacyNodes {
+			add(address)
+		}
+	}
+	return addresses
+}
+
+// Register adds a data node to the ones chunks are placed on, or updates
+// its address, capacity and labels if it registered before.
+func (m *MetadataService) Register(
+	ctx context.Context,
+	req *metadata.RegisterRequest,
+) (
+	*metadata.RegisterResponse,
+	error,
+) {
+	log.Printf("REGISTER\t%v", req)
+
+	if req.NodeId == "" || req.Address == "" {
+		return nil, ErrInvalidDataNode
+	}
+
+	labels := make(map[string]string, len(req.Labels))
+	for k, v := range req.Labels {
+		labels[k] = v
+	}
+
+	isNew := m.nodes.register(&dataNode{
+		ID:         req.NodeId,
+		Address:    req.Address,
+		Capacity:   req.Capacity,
+		Used:       req.Used,
+		Labels:     labels,
+		Registered: time.Now(),
+	})
+	if isNew {
+		log.Printf("Data node %s registered at %s", req.NodeId, req.Address)
+	}
+
+	return &metadata.RegisterResponse{}, nil
+}
+
+// Heartbeat marks a registered data node as live, and hands it the commands
+// queued for it. A data node the metadata service does not know, such as
+// after a restart, is told to register.
+func (m *MetadataService) Heartbeat(
+	ctx context.Context,
+	req *metadata.HeartbeatRequest,
+) (
+	*metadata.HeartbeatResponse,
+	error,
+) {
+	log.Printf("HEARTBEAT\t%v", req)
+
+	if req.NodeId == "" {
+		return nil, ErrInvalidDataNode
+	}
+
+	registered, commands := m.nodes.heartbeat(req.NodeId, req.Used, req.Completed, time.Now())
+	return &metadata.HeartbeatResponse{
+		NodeId:   req.NodeId,
+		Register: !registered,
+		Commands: commands,
+	}, nil
+}
+
+// ListNodes reports the registered data nodes and their health.
+func (m *MetadataService) ListNodes(
+	ctx context.Context,
+	req *metadata.ListNodesRequest,
+) (
+	*metadata.ListNodesResponse,
+	error,
+) {
+	log.Printf("LISTNODES\t%v", req)
+
+	nodes := m.nodes.list()
+	res := &metadata.ListNodesResponse{
+		Nodes: make([]*metadata.DataNodeInfo, 0, len(nodes)),
+	}
+	for _, node := range nodes {
+		lastReport, chunks := m.nodes.reportStats(node.ID)
+		res.Nodes = append(res.Nodes, &metadata.DataNodeInfo{
+			NodeId:          node.ID,
+			Address:         node.Address,
+			State:           node.State.proto(),
+			LastSeen:        node.LastSeen.UnixNano(),
+			Capacity:        node.Capacity,
+			Used:            node.Used,
+			Labels:          node.Labels,
+			LastBlockReport: lastReport,
+			Chunks:          chunks,
+			PendingCommands: m.nodes.pendingCommands(node.ID),
+		})
+	}
+	return res, nil
+}
+
+// startLivenessLoop moves the data nodes that stopped sending heartbeats to
+// suspect and then dead, until the service shuts down.
+func (m *MetadataService) startLivenessLoop() {
+	ticker := time.NewTicker(livenessCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.nodes.check(now, m.suspectTimeout, m.deadTimeout)
+		case <-m.shutdownChan:
+			return
+		}
+	}
+}
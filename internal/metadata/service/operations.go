@@ -2,80 +2,292 @@ package metadata_service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	dc "github.com/apolyeti/godfs/internal/data_node/client"
 	pb "github.com/apolyeti/godfs/internal/data_node/genproto"
 	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"github.com/google/uuid"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"io"
 	"log"
+	"sync"
 )
 
-func (m *MetadataService) WriteFile(
-	ctx context.Context,
-	req *metadata.WriteFileRequest,
-) (
-	*metadata.WriteFileResponse,
-	error,
-) {
-	log.Printf("WRITEFILE\t%v", req)
+// readRetries is the number of times a read starts over when the file is
+// rewritten while it is read.
+const readRetries = 3
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// inodeLocks serializes the data node I/O of writes to the same file,
+// which runs without m.mu held.
+type inodeLocks struct {
+	mu    sync.Mutex
+	locks map[string]*inodeLock
+}
+
+// inodeLock is the write lock of one file, kept while anyone holds or waits
+// for it.
+type inodeLock struct {
+	mu   sync.Mutex
+	refs int
+}
 
-	currDir := req.CurrentDirectoryId
+func newInodeLocks() *inodeLocks {
+	return &inodeLocks{locks: make(map[string]*inodeLock)}
+}
 
-	if currDir == "" {
-		currDir = RootID
+// lock takes the write lock of inodeID and returns the function releasing it.
+func (l *inodeLocks) lock(inodeID string) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[inodeID]
+	if !ok {
+		lock = &inodeLock{}
+		l.locks[inodeID] = lock
 	}
+	lock.refs++
+	l.mu.Unlock()
 
-	inodeId, exists := m.inodes[currDir].DirectoryEntries[req.FileName]
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
 
-	if !exists {
-		return nil, ErrFileNotFound
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(l.locks, inodeID)
+		}
 	}
+}
 
-	inode, ok := m.inodes[inodeId]
-
-	if !ok {
-		return nil, ErrFileNotFound
+// WriteFile replaces the content of a file with the content streamed by the
+// client. Chunks are sent to the data nodes as they fill up, without m.mu
+// held, so that a large write does not stall the rest of the namespace: the
+// file is resolved and checked with m.mu held for reading, and the new chunk
+// list committed under a short write lock. Writes to the same file are
+// serialized by its write lock instead.
+func (m *MetadataService) WriteFile(stream metadata.MetadataService_WriteFileServer) error {
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return ErrEmptyWrite
+	}
+	if err != nil {
+		return err
 	}
+	log.Printf("WRITEFILE\tcurrent_directory_id:%q file_name:%q handle:%q",
+		req.CurrentDirectoryId, req.FileName, req.Handle)
 
-	if inode.IsDir {
-		return nil, ErrIsDir
+	inode, err := m.resolveWrite(req)
+	if err != nil {
+		return err
 	}
+	inodeID := inode.ID
 
-	chunks := chunkFile(req.Data, 1024)
+	unlock := m.writeLocks.lock(inodeID)
+	defer unlock()
 
-	for i, chunk := range chunks {
-		chunkId := fmt.Sprintf("%s-%d", inode.ID, i)
-		dataNode := m.dataNodes[i%len(m.dataNodes)]
+	// The file may have changed while waiting for its write lock
+	if inode, err = m.resolveWrite(req); err != nil {
+		return err
+	}
+	if inode.ID != inodeID {
+		return ErrFileNotFound
+	}
+	chunkSize := inode.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = m.chunkSize
+	}
 
-		err := storeChunkOnDataNode(chunkId, chunk, dataNode)
-		inode.AddChunk(chunkId)
+	// Every write stores new chunks, so readers of the previous content
+	// never see a mix of both
+	w := m.newChunkWriter(inodeID, chunkSize)
+	for piece := req; ; {
+		if err := w.write(piece.Data); err != nil {
+			w.abort()
+			return err
+		}
+		piece, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.abort()
+			return err
+		}
+	}
+	if err := w.close(); err != nil {
+		w.abort()
+		return err
+	}
 
+	err = m.update(func(t *txn) error {
+		current, err := m.checkWrite(t, req)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if current.ID != inodeID {
+			return ErrFileNotFound
+		}
+
+		inode, _ = t.edit(inodeID)
+		replaced, replacedNodes := inode.ChunkIDs, inode.ChunkNodes
+		inode.UpdateChunkSize(chunkSize)
+		inode.UpdateChunkIDs(w.chunkIDs)
+		inode.UpdateChunkNodes(w.chunkNodes)
+		inode.UpdateSize(w.size)
+		inode.Touch()
+
+		if len(replaced) > 0 {
+			t.onCommit(func() { m.deleteChunks(replaced, replacedNodes) })
+		}
+		if !inode.Unlinked {
+			t.notify(metadata.EventType_EVENT_TYPE_WRITE, inode, inode.ParentID, inode.Name, "", "")
+		}
+		return nil
+	})
+	if err != nil {
+		// Once applied, the file may already point at the new chunks
+		if !errors.Is(err, ErrNotDurable) {
+			w.abort()
 		}
+		return err
+	}
+
+	return stream.SendAndClose(&metadata.WriteFileResponse{
+		FileName:   inode.Name,
+		Inode:      inode.ID,
+		Generation: inode.Generation,
+	})
+}
+
+// resolveWrite checks a write request against the current namespace with
+// m.mu held for reading, and returns the file it is for.
+func (m *MetadataService) resolveWrite(req *metadata.WriteFileRequest) (*Inode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if err := m.checkLeader(); err != nil {
+		return nil, err
 	}
+	return m.checkWrite(m.view(), req)
+}
 
-	inode.UpdateSize(int64(len(req.Data)))
+// checkWrite resolves the file a write request is for, and checks that the
+// request may write it.
+func (m *MetadataService) checkWrite(t *txn, req *metadata.WriteFileRequest) (*Inode, error) {
+	inode, err := t.resolveFile(req.CurrentDirectoryId, req.FileName, req.Handle, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkWriteLease(inode, req.Handle); err != nil {
+		return nil, err
+	}
+	if err := m.checkWriteLock(inode.ID, req.Owner); err != nil {
+		return nil, err
+	}
+	if err := checkGeneration(inode, req.ExpectedGeneration); err != nil {
+		return nil, err
+	}
+	return inode, nil
+}
+
+// chunkWriter stores the content of a write of a file on the data nodes
+// under new chunk IDs, one chunk at a time as the content arrives. Until
+// data nodes register, chunks are placed on the legacy data nodes by
+// position if any are configured, and no data node IDs are recorded.
+// Without them, the write fails with ErrNoDataNodes.
+// buf: content not stored yet, less than a chunk
+// size: length of the content written so far
+// legacy: True once the first chunk was placed on the legacy data nodes
+type chunkWriter struct {
+	m          *MetadataService
+	inodeID    string
+	writeID    string
+	chunkSize  int64
+	buf        []byte
+	size       int64
+	legacy     bool
+	chunkIDs   []string
+	chunkNodes []string
+}
+
+func (m *MetadataService) newChunkWriter(inodeID string, chunkSize int64) *chunkWriter {
+	return &chunkWriter{
+		m:         m,
+		inodeID:   inodeID,
+		writeID:   uuid.New().String(),
+		chunkSize: chunkSize,
+	}
+}
+
+// write adds data to the content, storing every chunk it fills.
+func (w *chunkWriter) write(data []byte) error {
+	w.size += int64(len(data))
+	for len(data) > 0 {
+		n := min(int(w.chunkSize)-len(w.buf), len(data))
+		w.buf = append(w.buf, data[:n]...)
+		data = data[n:]
+
+		if int64(len(w.buf)) == w.chunkSize {
+			if err := w.store(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close stores the rest of the content as the last chunk.
+func (w *chunkWriter) close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	return w.store()
+}
 
-	return &metadata.WriteFileResponse{
-		FileName: req.FileName,
-	}, nil
+// abort removes the chunks stored so far.
+func (w *chunkWriter) abort() {
+	w.m.deleteChunks(w.chunkIDs, w.chunkNodes)
 }
 
-func chunkFile(data []byte, chunkSize int) [][]byte {
-	var chunks [][]byte
+// store stores the buffered content as the next chunk of the file.
+func (w *chunkWriter) store() error {
+	index := len(w.chunkIDs)
+	chunkId := fmt.Sprintf("%s-%s-%d", w.inodeID, w.writeID, index)
 
-	for i := 0; i < len(data); i += chunkSize {
-		end := i + chunkSize
-		if end > len(data) {
-			end = len(data)
+	var dataNode, nodeID string
+	if !w.legacy {
+		placed, err := w.m.nodes.place(1)
+		if err != nil {
+			return err
+		}
+		switch {
+		case placed != nil:
+			dataNode, nodeID = placed[0].Address, placed[0].ID
+		case index == 0:
+			w.legacy = true
+		default:
+			return ErrNoDataNodes
+		}
+	}
+	if w.legacy {
+		if len(w.m.legacyNodes) == 0 {
+			return ErrNoDataNodes
 		}
-		chunks = append(chunks, data[i:end])
+		dataNode = w.m.legacyNodes[index%len(w.m.legacyNodes)]
+	}
+
+	if err := storeChunkOnDataNode(chunkId, w.buf, dataNode); err != nil {
+		return err
 	}
-	return chunks
+	w.chunkIDs = append(w.chunkIDs, chunkId)
+	if !w.legacy {
+		w.chunkNodes = append(w.chunkNodes, nodeID)
+	}
+
+	// The chunk was sent, so its buffer can be reused
+	w.buf = w.buf[:0]
+	return nil
 }
 
 func storeChunkOnDataNode(chunkId string, chunkData []byte, dataNode string) error {
@@ -114,59 +326,106 @@ func storeChunkOnDataNode(chunkId string, chunkData []byte, dataNode string) err
 	return nil
 }
 
+// ReadFile streams the content of a file, read from the data nodes chunk by
+// chunk without m.mu held. A read starts over if the file was rewritten
+// before any of its content was sent.
 func (m *MetadataService) ReadFile(
-	ctx context.Context,
 	req *metadata.ReadFileRequest,
-) (
-	*metadata.ReadFileResponse,
-	error,
-) {
+	stream metadata.MetadataService_ReadFileServer,
+) error {
 	log.Printf("READFILE\t%v", req)
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	currDir := req.CurrentDirectoryId
-
-	if currDir == "" {
-		currDir = RootID
-	}
-
-	inodeId, exists := m.inodes[currDir].DirectoryEntries[req.FileName]
+	for attempt := 1; ; attempt++ {
+		inode, err := m.resolveRead(req)
+		if err != nil {
+			return err
+		}
 
-	if !exists {
-		return nil, ErrFileNotFound
+		sent := false
+		err = m.readChunks(inode, func(data []byte) error {
+			sent = true
+			return stream.Send(&metadata.ReadFileResponse{
+				FileName:   inode.Name,
+				Data:       data,
+				Generation: inode.Generation,
+			})
+		})
+		if err != nil {
+			// Retry only if the file was rewritten while it was read
+			current, resolveErr := m.resolveRead(req)
+			if !sent && attempt < readRetries && resolveErr == nil && current.Generation != inode.Generation {
+				continue
+			}
+			return err
+		}
+		return nil
 	}
+}
 
-	inode, ok := m.inodes[inodeId]
-
-	if !ok {
-		return nil, ErrFileNotFound
+// resolveRead resolves the file a read request is for. Committed inodes are
+// never modified, so the inode can be used once m.mu is released.
+func (m *MetadataService) resolveRead(req *metadata.ReadFileRequest) (*Inode, error) {
+	// Reading through a handle renews it
+	if req.Handle != "" {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.begin().resolveFile(req.CurrentDirectoryId, req.FileName, req.Handle, false)
 	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.view().resolveFile(req.CurrentDirectoryId, req.FileName, req.Handle, false)
+}
 
-	if inode.IsDir {
-		return nil, ErrIsDir
+// readChunks reads the content of inode from the data nodes, and passes it
+// to send in pieces of at most FilePieceSize bytes. An empty file is sent as
+// one empty piece. A chunk that its data node lost or found corrupt is read
+// from another copy if there is one.
+func (m *MetadataService) readChunks(inode *Inode, send func(data []byte) error) error {
+	if len(inode.ChunkIDs) == 0 {
+		if inode.Size != 0 {
+			return ErrInvalidSize
+		}
+		return send(nil)
 	}
 
-	var data []byte
-
 	// Loop through stored chunks for the file
+	var size int64
 	for i, chunkId := range inode.ChunkIDs {
-		dataNode := m.dataNodes[i%len(m.dataNodes)]
+		dataNode, err := m.chunkAddress(inode.ChunkNodes, i)
+		if err != nil {
+			return err
+		}
 
 		chunkData, err := retrieveChunkFromDataNode(chunkId, dataNode)
-
+		if dc.ChunkLost(err) {
+			// Another data node may still hold an intact copy
+			log.Printf("Chunk %s is lost on %s: %v", chunkId, dataNode, err)
+			if copyData, _, ok := m.findChunkCopy(chunkId, dataNode); ok {
+				chunkData, err = copyData, nil
+			}
+		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		data = append(data, chunkData...)
-	}
+		// Every chunk but the last one must be exactly the size the file was split at
+		last := i == len(inode.ChunkIDs)-1
+		if int64(len(chunkData)) > inode.ChunkSize || (!last && int64(len(chunkData)) != inode.ChunkSize) {
+			return ErrInvalidChunk
+		}
+		size += int64(len(chunkData))
+		if size > inode.Size || (last && size != inode.Size) {
+			return ErrInvalidSize
+		}
 
-	return &metadata.ReadFileResponse{
-		FileName: req.FileName,
-		Data:     data,
-	}, nil
+		for offset := 0; offset < len(chunkData); offset += FilePieceSize {
+			end := min(offset+FilePieceSize, len(chunkData))
+			if err := send(chunkData[offset:end]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func retrieveChunkFromDataNode(chunkId string, dataNode string) ([]byte, error) {
@@ -176,6 +435,7 @@ func retrieveChunkFromDataNode(chunkId string, dataNode string) ([]byte, error)
 	conn, err := grpc.NewClient(
 		dataNode,
 		grpc.WithTransportCredentials(insecure.NewCredentials()), // or WithInsecure()
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(MaxMsgSize)),
 	)
 
 	if err != nil {
@@ -204,3 +464,59 @@ func retrieveChunkFromDataNode(chunkId string, dataNode string) ([]byte, error)
 
 	return resp.Data, nil
 }
+
+// deleteChunks removes the chunks of a dropped file from the data nodes in the
+// background, given the IDs of the data nodes holding them. The data nodes
+// are sent commands to delete them with their next heartbeat. Chunks on the
+// legacy data nodes are deleted directly, and failures, which only leave
+// garbage behind, logged.
+func (m *MetadataService) deleteChunks(chunkIDs []string, chunkNodes []string) {
+	if len(chunkNodes) > 0 {
+		byNode := make(map[string][]string)
+		for i, chunkId := range chunkIDs {
+			byNode[chunkNodes[i]] = append(byNode[chunkNodes[i]], chunkId)
+		}
+		for node, ids := range byNode {
+			m.queueChunkCommand(node, metadata.CommandKind_COMMAND_KIND_DELETE, ids, "")
+		}
+		return
+	}
+
+	go func() {
+		for i, chunkId := range chunkIDs {
+			dataNode, err := m.chunkAddress(chunkNodes, i)
+			if err != nil {
+				log.Printf("Error deleting chunk %v: %v", chunkId, err)
+				continue
+			}
+			if err := deleteChunkFromDataNode(chunkId, dataNode); err != nil {
+				log.Printf("Error deleting chunk %v from %v: %v", chunkId, dataNode, err)
+			}
+		}
+	}()
+}
+
+func deleteChunkFromDataNode(chunkId string, dataNode string) error {
+	conn, err := grpc.NewClient(
+		dataNode,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close connection: %v", err)
+		}
+	}()
+
+	client := pb.NewDataNodeServiceClient(conn)
+
+	_, err = client.DeleteChunk(context.Background(), &pb.DeleteChunkRequest{
+		ChunkId: chunkId,
+	})
+
+	return err
+}
@@ -0,0 +1,192 @@
+package metadata_service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	pb "github.com/apolyeti/godfs/internal/data_node/genproto"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+)
+
+// testDataNode is a data node keeping its chunks in memory.
+type testDataNode struct {
+	pb.UnimplementedDataNodeServiceServer
+	mu     sync.Mutex
+	chunks map[string][]byte
+}
+
+func newTestDataNode() *testDataNode {
+	return &testDataNode{chunks: make(map[string][]byte)}
+}
+
+func (d *testDataNode) WriteChunk(ctx context.Context, req *pb.WriteChunkRequest) (*pb.WriteChunkResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.chunks[req.ChunkId] = req.Data
+	return &pb.WriteChunkResponse{ChunkId: req.ChunkId}, nil
+}
+
+func (d *testDataNode) ReadChunk(ctx context.Context, req *pb.ReadChunkRequest) (*pb.ReadChunkResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, ok := d.chunks[req.ChunkId]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "chunk not found")
+	}
+	return &pb.ReadChunkResponse{ChunkId: req.ChunkId, Data: data}, nil
+}
+
+func (d *testDataNode) DeleteChunk(ctx context.Context, req *pb.DeleteChunkRequest) (*pb.DeleteChunkResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.chunks, req.ChunkId)
+	return &pb.DeleteChunkResponse{ChunkId: req.ChunkId}, nil
+}
+
+// serveTest serves the services register adds on a port of 127.0.0.1 until
+// the test ends, and returns the address.
+func serveTest(t *testing.T, register func(s *grpc.Server)) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	srv := grpc.NewServer()
+	register(srv)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+// newTestService returns a metadata service placing chunks on dataNodes,
+// which are registered with it.
+func newTestService(t *testing.T, dataNodes []string) *MetadataService {
+	t.Helper()
+	cfg := DefaultConfig()
+	m := newMetadataService(cfg, newMemStore(make(map[string]*Inode)))
+	if err := m.initializeRootDirectory(); err != nil {
+		t.Fatalf("initializeRootDirectory: %v", err)
+	}
+	for i, address := range dataNodes {
+		req := &metadata.RegisterRequest{NodeId: fmt.Sprintf("node-%d", i), Address: address}
+		if _, err := m.Register(context.Background(), req); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+	}
+	return m
+}
+
+// TestFileStreaming writes files through the gRPC API and reads them back,
+// with servers keeping the default message size limits.
+func TestFileStreaming(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "one piece", size: FilePieceSize},
+		{name: "several pieces and chunks", size: 3*FilePieceSize + 100},
+	}
+
+	dataNode := serveTest(t, func(s *grpc.Server) {
+		pb.RegisterDataNodeServiceServer(s, newTestDataNode())
+	})
+	m := newTestService(t, []string{dataNode})
+	address := serveTest(t, func(s *grpc.Server) {
+		metadata.RegisterMetadataServiceServer(s, m)
+	})
+
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer conn.Close()
+	client := metadata.NewMetadataServiceClient(conn)
+	ctx := context.Background()
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("file-%d", i)
+			// Chunks do not line up with the pieces they are streamed in
+			_, err := m.CreateFile(ctx, &metadata.CreateFileRequest{Name: name, ChunkSize: FilePieceSize * 3 / 2})
+			if err != nil {
+				t.Fatalf("CreateFile: %v", err)
+			}
+
+			data := make([]byte, tt.size)
+			rand.New(rand.NewSource(int64(i))).Read(data)
+
+			write, err := client.WriteFile(ctx)
+			if err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			req := &metadata.WriteFileRequest{FileName: name}
+			for offset := 0; ; offset += FilePieceSize {
+				req.Data = data[offset:min(offset+FilePieceSize, len(data))]
+				if err := write.Send(req); err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+				if offset+FilePieceSize >= len(data) {
+					break
+				}
+				req = &metadata.WriteFileRequest{}
+			}
+			written, err := write.CloseAndRecv()
+			if err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			if written.FileName != name {
+				t.Errorf("WriteFile wrote %q, want %q", written.FileName, name)
+			}
+
+			read, err := client.ReadFile(ctx, &metadata.ReadFileRequest{FileName: name})
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			var got []byte
+			pieces := 0
+			for {
+				piece, err := read.Recv()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Recv: %v", err)
+				}
+				if len(piece.Data) > FilePieceSize {
+					t.Errorf("piece of %d bytes, want at most %d", len(piece.Data), FilePieceSize)
+				}
+				pieces++
+				got = append(got, piece.Data...)
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes that differ from the %d written", len(got), len(data))
+			}
+			if pieces == 0 || (tt.size > FilePieceSize && pieces == 1) {
+				t.Errorf("read in %d pieces", pieces)
+			}
+		})
+	}
+
+	// A stream without a request does not name a file
+	write, err := client.WriteFile(ctx)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := write.CloseAndRecv(); status.Convert(err).Message() != ErrEmptyWrite.Error() {
+		t.Errorf("empty WriteFile = %v, want %v", err, ErrEmptyWrite)
+	}
+}
@@ -0,0 +1,80 @@
+package metadata_service
+
+import (
+	"context"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"log"
+)
+
+// ReportCorruptChunks is called by data nodes whose scrubber moved chunks
+// to quarantine. Every chunk is restored on the data node from a healthy
+// copy on another data node if there is one. The others are recorded, and
+// reported by fsck while a file still references them.
+func (m *MetadataService) ReportCorruptChunks(
+	ctx context.Context,
+	req *metadata.ReportCorruptChunksRequest,
+) (
+	*metadata.ReportCorruptChunksResponse,
+	error,
+) {
+	log.Printf("REPORTCORRUPTCHUNKS\t%v", req)
+
+	var repaired []string
+	for _, chunkId := range req.ChunkIds {
+		if node, ok := m.nodes.get(req.DataNode); ok && m.repairChunk(chunkId, node.Address) {
+			repaired = append(repaired, chunkId)
+			continue
+		}
+		log.Printf("No healthy copy of corrupt chunk %s on %s", chunkId, req.DataNode)
+
+		m.corruptMu.Lock()
+		m.corruptChunks[chunkId] = req.DataNode
+		m.corruptMu.Unlock()
+	}
+
+	return &metadata.ReportCorruptChunksResponse{Repaired: repaired}, nil
+}
+
+// repairChunk copies chunkId from the first other data node that serves it
+// intact to the data node at dataNode, and reports whether it did.
+func (m *MetadataService) repairChunk(chunkId string, dataNode string) bool {
+	data, source, ok := m.findChunkCopy(chunkId, dataNode)
+	if !ok {
+		return false
+	}
+	if err := storeChunkOnDataNode(chunkId, data, dataNode); err != nil {
+		log.Printf("Error restoring chunk %s on %s: %v", chunkId, dataNode, err)
+		return false
+	}
+
+	log.Printf("Restored corrupt chunk %s on %s from %s", chunkId, dataNode, source)
+	m.corruptMu.Lock()
+	delete(m.corruptChunks, chunkId)
+	m.corruptMu.Unlock()
+	return true
+}
+
+// findChunkCopy reads chunkId from the first data node other than dataNode
+// that serves it intact, and returns it with the address of that data node.
+func (m *MetadataService) findChunkCopy(chunkId string, dataNode string) ([]byte, string, bool) {
+	for _, source := range m.dataNodeAddresses(true) {
+		if source == dataNode {
+			continue
+		}
+
+		data, err := retrieveChunkFromDataNode(chunkId, source)
+		if err != nil {
+			continue
+		}
+		return data, source, true
+	}
+	return nil, "", false
+}
+
+// corruptChunk returns the data node that reported chunkId corrupt, if one did.
+func (m *MetadataService) corruptChunk(chunkId string) (string, bool) {
+	m.corruptMu.Lock()
+	defer m.corruptMu.Unlock()
+	dataNode, ok := m.corruptChunks[chunkId]
+	return dataNode, ok
+}
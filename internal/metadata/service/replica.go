@@ -0,0 +1,155 @@
+package metadata_service
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/apolyeti/godfs/internal/raft"
+	"log"
+	"time"
+)
+
+// snapshotCommitTimeout bounds how long a snapshot waits for the
+// transactions it includes to be committed.
+const snapshotCommitTimeout = 5 * time.Second
+
+// openReplica starts a replica of the namespace kept by a raft group. Its
+// state is restored from its raft snapshot and log, the journal and
+// checkpoints of a single service are not used.
+func openReplica(cfg Config) (*MetadataService, error) {
+	cfg = cfg.withDefaults()
+
+	// The raft log is the only durable copy, so the namespace is rebuilt from it
+	if cfg.Store != StoreMemory {
+		return nil, fmt.Errorf("%w: replicas use the %s store", ErrReplicaStore, StoreMemory)
+	}
+
+	m := newMetadataService(cfg, newMemStore(make(map[string]*Inode)))
+	if err := m.initializeRootDirectory(); err != nil {
+		return nil, err
+	}
+
+	node, err := raft.NewNode(raft.Config{
+		ID:      cfg.RaftID,
+		Dir:     cfg.RaftDir,
+		Servers: cfg.RaftServers,
+	}, replica{m})
+	if err != nil {
+		return nil, fmt.Errorf("starting raft: %w", err)
+	}
+	m.raft = node
+	return m, nil
+}
+
+// RaftNode returns the raft server of a replica, to be registered with the
+// gRPC server of the service, or nil if the service is not replicated.
+func (m *MetadataService) RaftNode() *raft.Node {
+	return m.raft
+}
+
+// checkLeader returns nil if the service may change the namespace, which a
+// replica may only while it leads its group, and a standby once promoted.
+// Others fail with the address of the leader, for clients to retry there.
+func (m *MetadataService) checkLeader() error {
+	if m.following() {
+		return m.standby.notLeader()
+	}
+	if m.raft == nil {
+		return nil
+	}
+	return m.raft.CheckLeader()
+}
+
+// propose replicates the journal entry of a transaction about to be applied.
+// The returned channel receives nil once a majority of the group has it.
+// Must be called with m.mu held.
+func (m *MetadataService) propose(entry *journalEntry) (<-chan error, error) {
+	var buf bytes.Buffer
+	if err := writeJournalRecord(&buf, entry); err != nil {
+		return nil, err
+	}
+
+	seq, committed, err := m.raft.Propose(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// Sequence numbers of a replica are the indexes of its raft log
+	m.seq = seq
+	entry.Seq = seq
+	return committed, nil
+}
+
+// saveSnapshot hands the namespace to raft as a snapshot, which replaces
+// the part of the raft log it includes. Must be called with
+// m.checkpointMu held.
+func (m *MetadataService) saveSnapshot() error {
+	var state bytes.Buffer
+
+	m.mu.RLock()
+	seq := m.seq
+	// The leader applies transactions before they are committed
+	if !m.raft.WaitCommitted(seq, snapshotCommitTimeout) {
+		m.mu.RUnlock()
+		return raft.ErrCommitTimeout
+	}
+	err := m.encodeState(&state)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := m.raft.Snapshot(seq, state.Bytes()); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.checkpointSeq = seq
+	m.mu.Unlock()
+	return nil
+}
+
+// replica applies the entries committed by the raft group of a replica to
+// its namespace. Kept apart so that raft.StateMachine is not part of the
+// gRPC API of the service.
+type replica struct {
+	m *MetadataService
+}
+
+func (r replica) Apply(index uint64, data []byte) {
+	entry, _, err := readJournalRecord(bytes.NewReader(data))
+	if err != nil {
+		// Applying later entries without it would diverge from the group
+		log.Fatalf("Failed to decode raft entry %d: %v", index, err)
+	}
+	entry.Seq = index
+
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.m.applyEntry(entry)
+}
+
+func (r replica) Restore(index uint64, data []byte) error {
+	m := r.m
+
+	state := &checkpointState{
+		Inodes: make(map[string]*Inode),
+		Locks:  make(map[string]*FileLock),
+	}
+	if data != nil {
+		var err error
+		if state, err = decodeState(bytes.NewReader(data)); err != nil {
+			return err
+		}
+		if state.External {
+			return ErrStoreMismatch
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loadInodes(state.Inodes)
+	m.locks = state.Locks
+	m.seq = index
+	m.checkpointSeq = index
+	return m.initializeRootDirectory()
+}
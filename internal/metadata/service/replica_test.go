@@ -0,0 +1,231 @@
+package metadata_service
+
+import (
+	"context"
+	"fmt"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"github.com/apolyeti/godfs/internal/raft"
+	pb "github.com/apolyeti/godfs/internal/raft/genproto"
+	"google.golang.org/grpc"
+	"net"
+	"testing"
+	"time"
+)
+
+// replicaWait bounds how long a test waits for the replicas to settle.
+const replicaWait = 15 * time.Second
+
+// testReplica is a running replica of a test group.
+type testReplica struct {
+	m   *MetadataService
+	srv *grpc.Server
+}
+
+// testReplicas runs a group of replicas in process, each serving raft on
+// its own port of 127.0.0.1 and with its own raft directory.
+type testReplicas struct {
+	t       *testing.T
+	cfg     map[string]Config
+	running map[string]*testReplica
+}
+
+func newTestReplicas(t *testing.T, size int) *testReplicas {
+	r := &testReplicas{
+		t:       t,
+		cfg:     make(map[string]Config),
+		running: make(map[string]*testReplica),
+	}
+	t.Cleanup(r.stopAll)
+
+	var servers []raft.Server
+	listeners := make(map[string]net.Listener)
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprintf("r%d", i)
+		listeners[id] = r.listen("127.0.0.1:0")
+		servers = append(servers, raft.Server{ID: id, Address: listeners[id].Addr().String()})
+	}
+	for _, server := range servers {
+		r.cfg[server.ID] = Config{
+			Store:       StoreMemory,
+			RaftID:      server.ID,
+			RaftDir:     t.TempDir(),
+			RaftServers: servers,
+		}
+		r.start(server.ID, listeners[server.ID])
+	}
+	return r
+}
+
+func (r *testReplicas) listen(address string) net.Listener {
+	r.t.Helper()
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		r.t.Fatalf("Listen: %v", err)
+	}
+	return lis
+}
+
+func (r *testReplicas) start(id string, lis net.Listener) {
+	r.t.Helper()
+	m, err := openReplica(r.cfg[id])
+	if err != nil {
+		_ = lis.Close()
+		r.t.Fatalf("openReplica(%s): %v", id, err)
+	}
+
+	srv := grpc.NewServer()
+	pb.RegisterRaftServiceServer(srv, m.RaftNode())
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	r.running[id] = &testReplica{m: m, srv: srv}
+}
+
+// restart starts a stopped replica again, on its address and raft directory.
+func (r *testReplicas) restart(id string) {
+	r.t.Helper()
+	var address string
+	for _, server := range r.cfg[id].RaftServers {
+		if server.ID == id {
+			address = server.Address
+		}
+	}
+	r.start(id, r.listen(address))
+}
+
+func (r *testReplicas) stop(id string) {
+	r.t.Helper()
+	replica, ok := r.running[id]
+	if !ok {
+		return
+	}
+	delete(r.running, id)
+	replica.srv.Stop()
+	if err := replica.m.raft.Close(); err != nil {
+		r.t.Errorf("Close(%s): %v", id, err)
+	}
+}
+
+func (r *testReplicas) stopAll() {
+	for id := range r.running {
+		r.stop(id)
+	}
+}
+
+// leader waits until a replica may change the namespace, and returns its ID.
+func (r *testReplicas) leader() string {
+	r.t.Helper()
+	var found string
+	waitForReplicas(r.t, "a leader", func() bool {
+		for id, replica := range r.running {
+			if replica.m.checkLeader() == nil {
+				found = id
+				return true
+			}
+		}
+		return false
+	})
+	return found
+}
+
+// create creates an inode named name on the leader, trying again on the
+// next one should the leader change meanwhile.
+func (r *testReplicas) create(name string) {
+	r.t.Helper()
+	waitForReplicas(r.t, "creating "+name, func() bool {
+		leader := r.running[r.leader()]
+		_, err := leader.m.CreateInode(context.Background(), &metadata.CreateFileRequest{Name: name})
+		return err == nil || err == ErrExists
+	})
+}
+
+// waitInodes waits until every running replica has the inodes named names.
+func (r *testReplicas) waitInodes(names ...string) {
+	r.t.Helper()
+	for id, replica := range r.running {
+		for _, name := range names {
+			waitForReplicas(r.t, id+" to have "+name, func() bool {
+				_, err := replica.m.getInode(name)
+				return err == nil
+			})
+		}
+	}
+}
+
+func waitForReplicas(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(replicaWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestReplicas checks that changes made on the leader reach every replica,
+// that followers send clients to the leader, and that a replica that missed
+// changes compacted away catches up from the snapshot of the namespace.
+func TestReplicas(t *testing.T) {
+	r := newTestReplicas(t, 3)
+	r.create("a")
+	r.waitInodes("a")
+
+	leader := r.leader()
+	var address string
+	for _, server := range r.cfg[leader].RaftServers {
+		if server.ID == leader {
+			address = server.Address
+		}
+	}
+	for id, replica := range r.running {
+		if id == leader {
+			continue
+		}
+		waitForReplicas(t, id+" to follow "+leader, func() bool {
+			_, err := replica.m.CreateInode(context.Background(), &metadata.CreateFileRequest{Name: "b"})
+			notLeader, ok := raft.LeaderFromError(err)
+			return ok && notLeader.LeaderID == leader && notLeader.LeaderAddress == address
+		})
+	}
+
+	var lagging string
+	for id := range r.running {
+		if id != leader {
+			lagging = id
+			break
+		}
+	}
+	r.stop(lagging)
+
+	names := []string{"a"}
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		r.create(name)
+		names = append(names, name)
+	}
+	r.waitInodes(names...)
+
+	// Whichever replica leads once the lagging one is back only has the snapshot
+	for id, replica := range r.running {
+		if err := replica.m.SaveToDisk(); err != nil {
+			t.Fatalf("SaveToDisk(%s): %v", id, err)
+		}
+	}
+
+	r.restart(lagging)
+	r.waitInodes(names...)
+	restored := r.running[lagging].m
+	restored.mu.RLock()
+	checkpointSeq := restored.checkpointSeq
+	restored.mu.RUnlock()
+	if checkpointSeq == 0 {
+		t.Errorf("lagging replica caught up without a snapshot")
+	}
+	if _, err := restored.getInode(RootID); err != nil {
+		t.Errorf("restored replica lost the root directory: %v", err)
+	}
+
+	r.create("after")
+	r.waitInodes(append(names, "after")...)
+}
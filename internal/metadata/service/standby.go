@@ -0,0 +1,494 @@
+package metadata_service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"github.com/apolyeti/godfs/internal/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// standbyRetryInterval is the time a standby waits before reconnecting
+	// to its primary.
+	standbyRetryInterval = time.Second
+	// standbyCheckpointTimeout bounds sending a checkpoint to the primary.
+	standbyCheckpointTimeout = time.Minute
+	// checkpointChunkSize is the size of the chunks checkpoints are sent in.
+	checkpointChunkSize = 1024 * 1024
+)
+
+// standby follows the journal of a primary to take over from it.
+// primary: address of the primary
+// ctx: canceled to stop following the primary
+// done: closed once the standby stopped following
+// connected: True while the journal of the primary is streamed
+// promoted: True once the standby changes the namespace itself
+type standby struct {
+	primary   string
+	conn      *grpc.ClientConn
+	client    metadata.MetadataServiceClient
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	connected atomic.Bool
+	promoted  atomic.Bool
+}
+
+// openStandby starts a warm standby of the primary at cfg.Standby. Its
+// namespace is loaded from the primary and kept up to date from its
+// journal, and only changes on its own once promoted.
+func openStandby(cfg Config) (*MetadataService, error) {
+	cfg = cfg.withDefaults()
+
+	// The namespace is loaded from the primary on every start
+	if cfg.Store != StoreMemory {
+		return nil, fmt.Errorf("%w: standbys use the %s store", ErrReplicaStore, StoreMemory)
+	}
+
+	conn, err := grpc.NewClient(
+		cfg.Standby,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(MaxMsgSize)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to primary: %w", err)
+	}
+
+	m := newMetadataService(cfg, newMemStore(make(map[string]*Inode)))
+	if err := m.initializeRootDirectory(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.standby = &standby{
+		primary: cfg.Standby,
+		conn:    conn,
+		client:  metadata.NewMetadataServiceClient(conn),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	return m, nil
+}
+
+// following reports whether the service is a standby that was not promoted.
+func (m *MetadataService) following() bool {
+	return m.standby != nil && !m.standby.promoted.Load()
+}
+
+// close stops following the primary and closes the connection to it.
+func (s *standby) close() error {
+	s.cancel()
+	<-s.done
+	return s.conn.Close()
+}
+
+// followPrimary loads the namespace from the primary and applies its
+// journal as it is written, reconnecting until the standby is promoted.
+// The namespace is loaded again when the journal no longer holds the
+// entries it needs.
+func (m *MetadataService) followPrimary() {
+	s := m.standby
+	defer close(s.done)
+
+	loaded := false
+	for {
+		if !loaded {
+			err := m.loadFromPrimary()
+			if err != nil && s.ctx.Err() == nil {
+				log.Printf("Failed to load namespace from primary %s: %v", s.primary, err)
+			}
+			loaded = err == nil
+		}
+
+		if loaded {
+			err := m.followJournal()
+			if status.Code(err) == codes.OutOfRange || errors.Is(err, ErrJournalGap) {
+				loaded = false
+			}
+			if s.ctx.Err() == nil {
+				log.Printf("Lost journal of primary %s: %v", s.primary, err)
+			}
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(standbyRetryInterval):
+		}
+	}
+}
+
+// loadFromPrimary replaces the namespace with the current one of the primary.
+func (m *MetadataService) loadFromPrimary() error {
+	s := m.standby
+
+	stream, err := s.client.GetCheckpoint(s.ctx, &metadata.GetCheckpointRequest{})
+	if err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	var seq uint64
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		seq = chunk.Seq
+		data.Write(chunk.Data)
+	}
+
+	state, err := decodeState(&data)
+	if err != nil {
+		return err
+	}
+	if state.External {
+		return ErrStoreMismatch
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loadInodes(state.Inodes)
+	m.locks = state.Locks
+	m.seq = seq
+	m.checkpointSeq = seq
+	log.Printf("Loaded namespace from primary %s at entry %d", s.primary, seq)
+	return m.initializeRootDirectory()
+}
+
+// followJournal applies the journal of the primary from the entry after the
+// last one applied, until the stream fails.
+func (m *MetadataService) followJournal() error {
+	s := m.standby
+
+	m.mu.RLock()
+	from := m.seq
+	m.mu.RUnlock()
+
+	stream, err := s.client.StreamJournal(s.ctx, &metadata.StreamJournalRequest{FromSeq: from})
+	if err != nil {
+		return err
+	}
+	s.connected.Store(true)
+	defer s.connected.Store(false)
+
+	for {
+		record, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		entry, _, err := readJournalRecord(bytes.NewReader(record.Entry))
+		if err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		seq := m.seq
+		if entry.Seq == seq+1 {
+			m.applyEntry(entry)
+		}
+		m.mu.Unlock()
+
+		if entry.Seq > seq+1 {
+			return fmt.Errorf("%w: expected entry %d, received %d", ErrJournalGap, seq+1, entry.Seq)
+		}
+	}
+}
+
+// sendCheckpoint sends a checkpoint of the namespace to the primary, which
+// keeps it in place of one of its own. Must be called with m.checkpointMu
+// held.
+func (m *MetadataService) sendCheckpoint() error {
+	s := m.standby
+
+	var state bytes.Buffer
+	m.mu.RLock()
+	seq := m.seq
+	err := m.encodeFullState(&state)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, standbyCheckpointTimeout)
+	defer cancel()
+	stream, err := s.client.PutCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	data := state.Bytes()
+	for offset := 0; ; offset += checkpointChunkSize {
+		end := min(offset+checkpointChunkSize, len(data))
+		if err := stream.Send(&metadata.CheckpointChunk{Seq: seq, Data: data[offset:end]}); err != nil {
+			return err
+		}
+		if end == len(data) {
+			break
+		}
+	}
+	if _, err := stream.CloseAndRecv(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.checkpointSeq = seq
+	m.mu.Unlock()
+	return nil
+}
+
+// takeOver makes the namespace of a standby durable in its own working
+// directory and starts its journal. Checkpoints and journal segments found
+// there are left from an earlier run and superseded. Must be called with
+// m.mu held.
+func (m *MetadataService) takeOver() error {
+	for _, path := range []string{checkpointDir, journalDir, legacySnapshotPath} {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	if err := m.recoverInodes(); err != nil {
+		return err
+	}
+
+	var state bytes.Buffer
+	if err := m.encodeState(&state); err != nil {
+		return err
+	}
+	if err := writeCheckpoint(m.seq, state.Bytes()); err != nil {
+		return err
+	}
+	m.checkpointSeq = m.seq
+
+	journal, err := openJournal(journalDir)
+	if err != nil {
+		return fmt.Errorf("opening journal: %w", err)
+	}
+	if err := journal.start(m.seq + 1); err != nil {
+		return fmt.Errorf("starting journal: %w", err)
+	}
+	m.journal = journal
+	return nil
+}
+
+// Promote makes a standby take over from its primary. Unless forced, it
+// refuses while the primary still streams its journal.
+func (m *MetadataService) Promote(
+	ctx context.Context,
+	req *metadata.PromoteRequest,
+) (
+	*metadata.PromoteResponse,
+	error,
+) {
+	log.Printf("PROMOTE\t%v", req)
+
+	s := m.standby
+	if !m.following() {
+		return nil, ErrNotStandby
+	}
+	if s.connected.Load() && !req.Force {
+		return nil, ErrPrimaryConnected
+	}
+
+	// No checkpoint is sent to the primary from here on
+	m.checkpointMu.Lock()
+	defer m.checkpointMu.Unlock()
+
+	s.cancel()
+	<-s.done
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.promoted.Load() {
+		return nil, ErrNotStandby
+	}
+	if err := m.takeOver(); err != nil {
+		return nil, err
+	}
+	s.promoted.Store(true)
+
+	log.Printf("Promoted to primary at entry %d, replacing %s", m.seq, s.primary)
+	return &metadata.PromoteResponse{Seq: m.seq}, nil
+}
+
+// StreamJournal sends a standby the entries of the journal after the one it
+// has, then every entry once it is durable.
+func (m *MetadataService) StreamJournal(
+	req *metadata.StreamJournalRequest,
+	stream metadata.MetadataService_StreamJournalServer,
+) error {
+	log.Printf("STREAMJOURNAL\t%v", req)
+
+	m.mu.RLock()
+	journal := m.journal
+	err := m.checkLeader()
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if journal == nil {
+		return ErrNotPrimary
+	}
+
+	// Entries written while the backlog is read are queued for the subscriber
+	sub, last, err := journal.subscribe()
+	if err != nil {
+		return err
+	}
+	defer journal.unsubscribe(sub)
+
+	if req.FromSeq > last {
+		return status.Errorf(codes.OutOfRange, "standby is at entry %d, ahead of the journal at %d", req.FromSeq, last)
+	}
+
+	sent := req.FromSeq
+	send := func(entry *journalEntry) error {
+		var buf bytes.Buffer
+		if err := writeJournalRecord(&buf, entry); err != nil {
+			return err
+		}
+		if err := stream.Send(&metadata.JournalRecord{Seq: entry.Seq, Entry: buf.Bytes()}); err != nil {
+			return err
+		}
+		sent = entry.Seq
+		return nil
+	}
+
+	err = journal.read(req.FromSeq, last, send)
+	if errors.Is(err, ErrJournalTruncated) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case entry, ok := <-sub.entries:
+			if !ok {
+				return ErrStandbyBehind
+			}
+			if entry.Seq <= sent {
+				continue
+			}
+			if err := send(entry); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// GetCheckpoint sends a standby the current namespace, with every inode
+// whichever store keeps them.
+func (m *MetadataService) GetCheckpoint(
+	req *metadata.GetCheckpointRequest,
+	stream metadata.MetadataService_GetCheckpointServer,
+) error {
+	log.Printf("GETCHECKPOINT\t%v", req)
+
+	var state bytes.Buffer
+	m.mu.RLock()
+	seq := m.seq
+	err := m.encodeFullState(&state)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	data := state.Bytes()
+	for offset := 0; ; offset += checkpointChunkSize {
+		end := min(offset+checkpointChunkSize, len(data))
+		if err := stream.Send(&metadata.CheckpointChunk{Seq: seq, Data: data[offset:end]}); err != nil {
+			return err
+		}
+		if end == len(data) {
+			return nil
+		}
+	}
+}
+
+// PutCheckpoint keeps a checkpoint taken by a standby as if the primary had
+// taken it, which spares the primary encoding its namespace. A primary with
+// a persistent store takes its own, as it flushes the store with them.
+func (m *MetadataService) PutCheckpoint(stream metadata.MetadataService_PutCheckpointServer) error {
+	log.Printf("PUTCHECKPOINT")
+
+	var data bytes.Buffer
+	var seq uint64
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		seq = chunk.Seq
+		data.Write(chunk.Data)
+	}
+
+	if _, ok := m.store.(PersistentStore); ok {
+		return ErrStoreMismatch
+	}
+	if m.raft != nil || m.following() {
+		return ErrNotPrimary
+	}
+	if _, err := decodeState(bytes.NewReader(data.Bytes())); err != nil {
+		return err
+	}
+
+	m.checkpointMu.Lock()
+	defer m.checkpointMu.Unlock()
+
+	m.mu.RLock()
+	current := m.seq
+	m.mu.RUnlock()
+	if seq > current {
+		return fmt.Errorf("%w: checkpoint at entry %d, journal at %d", ErrCheckpointAhead, seq, current)
+	}
+
+	// Segments are only compacted once closed
+	if err := m.journal.rotate(); err != nil {
+		return err
+	}
+	if err := writeCheckpoint(seq, data.Bytes()); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if seq > m.checkpointSeq {
+		m.checkpointSeq = seq
+	}
+	m.standbyCheckpoint = time.Now()
+	m.mu.Unlock()
+
+	if err := m.compact(); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&metadata.PutCheckpointResponse{})
+}
+
+// notLeader returns the error a standby rejects changes with, pointing
+// clients at its primary.
+func (s *standby) notLeader() error {
+	return &raft.NotLeaderError{LeaderID: "primary", LeaderAddress: s.primary}
+}
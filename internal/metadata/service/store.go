@@ -0,0 +1,162 @@
+package metadata_service
+
+import (
+	"fmt"
+)
+
+const (
+	// StoreMemory keeps the whole namespace in memory and in checkpoints.
+	StoreMemory = "memory"
+	// StoreDisk keeps inodes in an on-disk key-value store and pages them in on demand.
+	StoreDisk = "disk"
+)
+
+// MetadataStore holds the inodes of the namespace. Inodes returned by a store
+// are shared and must not be modified, changes are made through Apply.
+// Stores are not safe for concurrent Apply calls, the service serializes
+// them with m.mu.
+type MetadataStore interface {
+	// Get returns the inode with the given ID, or ErrFileNotFound.
+	Get(id string) (*Inode, error)
+	// Children returns the inodes listed in the directory dir.
+	Children(dir *Inode) ([]*Inode, error)
+	// Apply stores puts and removes deletes as a single change.
+	Apply(puts []*Inode, deletes []string)
+	// ForEach calls fn for every inode until fn returns an error.
+	ForEach(fn func(*Inode) error) error
+	// Snapshot returns the inodes as they are now, to be read without m.mu
+	// held since changes applied later do not affect it. It must be called
+	// with m.mu held, and the snapshot released once read.
+	Snapshot() StoreSnapshot
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// StoreSnapshot is the inodes of a store at one point in time.
+type StoreSnapshot interface {
+	// ForEach calls fn for every inode until fn returns an error.
+	ForEach(fn func(*Inode) error) error
+	// Release frees what the snapshot holds on to.
+	Release()
+}
+
+// PersistentStore is a MetadataStore that keeps inodes on disk itself, so
+// checkpoints flush it rather than copy the namespace.
+type PersistentStore interface {
+	MetadataStore
+	// Flush makes every applied change durable and records seq as the last
+	// journal entry they cover.
+	Flush(seq uint64) error
+	// Seq returns the sequence number recorded by the last flush.
+	Seq() uint64
+	// Pending returns the number of changes applied since the last flush.
+	Pending() int
+	// Migrated reports whether every inode was brought up to date with the
+	// service, as recorded by SetMigrated.
+	Migrated() bool
+	// SetMigrated records whether every inode is up to date. It is made
+	// durable by the next flush, along with the changes that brought them
+	// up to date.
+	SetMigrated(migrated bool)
+	// Unlinked returns the IDs of the inodes removed while open.
+	Unlinked() []string
+}
+
+// openStore returns the store of the given kind.
+func openStore(kind string) (MetadataStore, error) {
+	switch kind {
+	case "", StoreMemory:
+		return newMemStore(nil), nil
+	case StoreDisk:
+		return openDiskStore(diskStoreDir)
+	default:
+		return nil, fmt.Errorf("unknown metadata store %q", kind)
+	}
+}
+
+// memStore is the in-memory MetadataStore, a map of inodes by ID.
+type memStore struct {
+	inodes map[string]*Inode
+}
+
+func newMemStore(inodes map[string]*Inode) *memStore {
+	if inodes == nil {
+		inodes = make(map[string]*Inode)
+	}
+	return &memStore{inodes: inodes}
+}
+
+func (s *memStore) Get(id string) (*Inode, error) {
+	inode, ok := s.inodes[id]
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	return inode, nil
+}
+
+func (s *memStore) Children(dir *Inode) ([]*Inode, error) {
+	return children(s, dir)
+}
+
+func (s *memStore) Apply(puts []*Inode, deletes []string) {
+	for _, id := range deletes {
+		delete(s.inodes, id)
+	}
+	for _, inode := range puts {
+		s.inodes[inode.ID] = inode
+	}
+}
+
+func (s *memStore) ForEach(fn func(*Inode) error) error {
+	for _, inode := range s.inodes {
+		if err := fn(inode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot copies the inodes out of the map, as committed inodes are never
+// modified.
+func (s *memStore) Snapshot() StoreSnapshot {
+	inodes := make(memSnapshot, 0, len(s.inodes))
+	for _, inode := range s.inodes {
+		inodes = append(inodes, inode)
+	}
+	return inodes
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// memSnapshot is a snapshot of a memStore.
+type memSnapshot []*Inode
+
+func (snap memSnapshot) ForEach(fn func(*Inode) error) error {
+	for _, inode := range snap {
+		if err := fn(inode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (snap memSnapshot) Release() {}
+
+// children looks up the entries of dir one by one.
+func children(s MetadataStore, dir *Inode) ([]*Inode, error) {
+	if !dir.IsDir {
+		return nil, ErrNotDir
+	}
+
+	inodes := make([]*Inode, 0, len(dir.DirectoryEntries))
+	for _, id := range dir.DirectoryEntries {
+		inode, err := s.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		inodes = append(inodes, inode)
+	}
+	return inodes, nil
+}
@@ -0,0 +1,335 @@
+package metadata_service
+
+import (
+	"fmt"
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"log"
+	"time"
+)
+
+// txn is a set of namespace changes applied to m.store all at once.
+// Changed inodes are copied on first write, so a transaction that is not
+// committed leaves no trace, and committed inodes are never modified again.
+// A txn with no changes is a read-only view of the namespace.
+// Must be used with m.mu held.
+// inodes: copies of the inodes changed or created by the transaction
+// deleted: IDs of the inodes removed by the transaction
+// locks: new lock state of the inodes whose locks the transaction changed, nil if dropped
+// closed: handles the transaction closes, released once it commits
+// events: Watch events published once the transaction is durable
+// published: True once the events were published
+// after: side effects run once the transaction is durable
+// err: first error reading from the store, which aborts the transaction
+type txn struct {
+	m         *MetadataService
+	inodes    map[string]*Inode
+	deleted   map[string]struct{}
+	locks     map[string]*FileLock
+	closed    map[string]*fileHandle
+	events    []*watchEvent
+	published bool
+	after     []func()
+	err       error
+}
+
+func (m *MetadataService) begin() *txn {
+	return &txn{
+		m:       m,
+		inodes:  make(map[string]*Inode),
+		deleted: make(map[string]struct{}),
+		locks:   make(map[string]*FileLock),
+		closed:  make(map[string]*fileHandle),
+	}
+}
+
+// update runs fn in a transaction and commits it unless fn fails. It returns
+// once the changes are durable in the journal, or committed by the raft group
+// of a replica, without holding m.mu while waiting so that concurrent commits
+// are synced together. The side effects of the transaction run only then.
+// It fails with ErrNotDurable if the changes were applied, but writing them
+// failed.
+func (m *MetadataService) update(fn func(t *txn) error) error {
+	m.mu.Lock()
+
+	if err := m.checkLeader(); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+
+	if m.journal != nil {
+		if err := m.journal.failed(); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+	}
+
+	t := m.begin()
+	err := fn(t)
+	if t.err != nil {
+		err = t.err
+	}
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	durable, err := t.commit()
+
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := <-durable; err != nil {
+		// The changes are seen by later transactions, but may be lost
+		return fmt.Errorf("%w: %v", ErrNotDurable, err)
+	}
+	t.finish()
+	return nil
+}
+
+// view returns a read-only transaction over the current namespace.
+func (m *MetadataService) view() *txn {
+	return &txn{m: m}
+}
+
+// get returns the inode with the given ID as seen by the transaction.
+// The inode must not be modified, use edit for that.
+func (t *txn) get(id string) (*Inode, bool) {
+	if _, deleted := t.deleted[id]; deleted {
+		return nil, false
+	}
+	if inode, ok := t.inodes[id]; ok {
+		return inode, true
+	}
+	inode, err := t.m.store.Get(id)
+	if err != nil {
+		if err != ErrFileNotFound && t.err == nil {
+			log.Printf("Error reading inode %v: %v", id, err)
+			t.err = err
+		}
+		return nil, false
+	}
+	return inode, true
+}
+
+// edit returns a copy of the inode with the given ID that the transaction
+// may modify.
+func (t *txn) edit(id string) (*Inode, bool) {
+	if inode, ok := t.inodes[id]; ok {
+		return inode, true
+	}
+	inode, ok := t.get(id)
+	if !ok {
+		return nil, false
+	}
+	inode = inode.Clone()
+	t.inodes[id] = inode
+	return inode, true
+}
+
+// put adds a new inode.
+func (t *txn) put(inode *Inode) {
+	delete(t.deleted, inode.ID)
+	t.inodes[inode.ID] = inode
+}
+
+// del removes the inode with the given ID.
+func (t *txn) del(id string) {
+	delete(t.inodes, id)
+	t.deleted[id] = struct{}{}
+}
+
+// editLock returns a copy of the lock on inodeID that the transaction may
+// modify, without the holders whose lease ran out by now. It returns nil if
+// there is no lock, or no holder is left and the lock is dropped.
+func (t *txn) editLock(inodeID string, now time.Time) *FileLock {
+	lock, ok := t.locks[inodeID]
+	if !ok {
+		committed, ok := t.m.locks[inodeID]
+		if !ok {
+			return nil
+		}
+		lock = committed.Clone()
+		t.locks[inodeID] = lock
+	}
+	if lock == nil {
+		return nil
+	}
+
+	for owner, expiry := range lock.Holders {
+		if !now.Before(expiry) {
+			delete(lock.Holders, owner)
+		}
+	}
+	if len(lock.Holders) == 0 {
+		t.locks[inodeID] = nil
+		return nil
+	}
+	return lock
+}
+
+// putLock sets the lock on inodeID, or drops it if lock is nil.
+func (t *txn) putLock(inodeID string, lock *FileLock) {
+	t.locks[inodeID] = lock
+}
+
+// onCommit runs fn once the transaction is durable, without m.mu held.
+func (t *txn) onCommit(fn func()) {
+	t.after = append(t.after, fn)
+}
+
+// notify queues a Watch event, see MetadataService.notify.
+func (t *txn) notify(
+	eventType metadata.EventType,
+	inode *Inode,
+	dirID string,
+	name string,
+	oldDirID string,
+	oldName string,
+) {
+	ancestors := make(map[string]struct{})
+	t.addAncestors(ancestors, dirID)
+	if oldDirID != "" {
+		t.addAncestors(ancestors, oldDirID)
+	}
+
+	t.events = append(t.events, &watchEvent{
+		event: &metadata.WatchEvent{
+			Type:           eventType,
+			Inode:          toProtoInode(inode),
+			DirectoryId:    dirID,
+			Name:           name,
+			OldDirectoryId: oldDirID,
+			OldName:        oldName,
+			Timestamp:      time.Now().UnixNano(),
+		},
+		ancestors: ancestors,
+	})
+}
+
+// addAncestors adds dirID and the IDs of all directories above it to set.
+func (t *txn) addAncestors(set map[string]struct{}, dirID string) {
+	for dirID != "" {
+		if _, seen := set[dirID]; seen {
+			return
+		}
+		set[dirID] = struct{}{}
+		dir, ok := t.get(dirID)
+		if !ok {
+			return
+		}
+		dirID = dir.ParentID
+	}
+}
+
+// commit queues the journal entry of the transaction, then applies its
+// changes so that later transactions see them. The returned channel receives
+// the result of writing the entry, or it fails without applying anything.
+// Its events are published by the journal writer once the entry is durable,
+// in commit order, and its side effects are left to finish, so that nothing
+// outside the namespace sees a change that may still be lost. A replica
+// proposes the entry to its group before applying it instead, so a failed
+// proposal leaves no trace.
+func (t *txn) commit() (<-chan error, error) {
+	m := t.m
+	entry := t.entry()
+
+	var durable <-chan error
+	switch {
+	case entry.empty():
+		t.publish()
+		done := make(chan error, 1)
+		done <- nil
+		durable = done
+	case m.raft != nil:
+		committed, err := m.propose(entry)
+		if err != nil {
+			return nil, err
+		}
+		durable = committed
+	case m.journal != nil:
+		m.seq++
+		entry.Seq = m.seq
+		durable = m.journal.append(entry, t.publish)
+	default:
+		t.publish()
+		done := make(chan error, 1)
+		done <- nil
+		durable = done
+	}
+
+	m.store.Apply(entry.Inodes, entry.Deleted)
+	m.applyLocks(entry)
+	m.releaseHandles(t.closed)
+
+	// A persistent store holds its changes in memory until the next checkpoint
+	if store, ok := m.store.(PersistentStore); ok && store.Pending() >= diskStoreFlushSize {
+		m.requestCheckpoint()
+	}
+	return durable, nil
+}
+
+// publish sends the events of the transaction to the watchers.
+func (t *txn) publish() {
+	t.published = true
+	for _, e := range t.events {
+		t.m.events.publish(e)
+	}
+}
+
+// finish runs the side effects of a transaction once it is durable, and
+// publishes its events unless the journal already did.
+func (t *txn) finish() {
+	if !t.published {
+		t.publish()
+	}
+	for _, fn := range t.after {
+		fn()
+	}
+}
+
+// entry returns the journal entry of the transaction. Committed inodes and
+// locks are never modified, so they are shared with the entry and the store.
+func (t *txn) entry() *journalEntry {
+	entry := &journalEntry{}
+	for _, inode := range t.inodes {
+		entry.Inodes = append(entry.Inodes, inode)
+	}
+	for id := range t.deleted {
+		entry.Deleted = append(entry.Deleted, id)
+	}
+	for id, lock := range t.locks {
+		if _, deleted := t.deleted[id]; deleted {
+			continue
+		}
+		if lock == nil {
+			entry.LocksDeleted = append(entry.LocksDeleted, id)
+			continue
+		}
+		if entry.Locks == nil {
+			entry.Locks = make(map[string]*FileLock)
+		}
+		entry.Locks[id] = lock
+	}
+	return entry
+}
+
+// applyEntry replays a journal entry on top of the current state.
+func (m *MetadataService) applyEntry(entry *journalEntry) {
+	m.store.Apply(entry.Inodes, entry.Deleted)
+	m.applyLocks(entry)
+	m.seq = entry.Seq
+}
+
+// applyLocks applies the lock changes of a journal entry. Locks go with
+// their inodes when they are removed.
+func (m *MetadataService) applyLocks(entry *journalEntry) {
+	for _, id := range entry.Deleted {
+		delete(m.locks, id)
+	}
+	for _, id := range entry.LocksDeleted {
+		delete(m.locks, id)
+	}
+	for id, lock := range entry.Locks {
+		m.locks[id] = lock
+	}
+}
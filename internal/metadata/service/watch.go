@@ -0,0 +1,193 @@
+package metadata_service
+
+import (
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// watchHistorySize is the number of past events kept for resuming watchers.
+	watchHistorySize = 4096
+	// watchBufferSize is the number of events a watcher may fall behind by
+	// before it is disconnected and has to resume.
+	watchBufferSize = 256
+)
+
+// watchEvent is a published event together with the IDs of every directory
+// it happened under, so recursive watchers can be matched without the
+// metadata lock.
+type watchEvent struct {
+	event     *metadata.WatchEvent
+	ancestors map[string]struct{}
+}
+
+// watcher is a single Watch stream.
+// dirID: ID of the watched directory
+// recursive: True if events below subdirectories are delivered as well
+// events: Events waiting to be sent, closed when the watcher falls behind
+type watcher struct {
+	dirID     string
+	recursive bool
+	events    chan *metadata.WatchEvent
+}
+
+func (w *watcher) matches(e *watchEvent) bool {
+	if w.recursive {
+		_, ok := e.ancestors[w.dirID]
+		return ok
+	}
+	return e.event.DirectoryId == w.dirID || e.event.OldDirectoryId == w.dirID
+}
+
+// watchHub assigns sequence numbers to namespace events, keeps a bounded
+// history of them and fans them out to watchers. Neither outlives the
+// process, so sequence numbers are qualified by an epoch that differs on
+// every start, and watchers cannot resume across a restart.
+type watchHub struct {
+	mu       sync.Mutex
+	epoch    uint64
+	seq      uint64
+	history  []*watchEvent
+	watchers map[*watcher]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		epoch:    uint64(time.Now().UnixNano()),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+func (h *watchHub) publish(e *watchEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	e.event.Sequence = h.seq
+	e.event.Epoch = h.epoch
+
+	h.history = append(h.history, e)
+	if len(h.history) > watchHistorySize {
+		h.history = h.history[len(h.history)-watchHistorySize:]
+	}
+
+	for w := range h.watchers {
+		if !w.matches(e) {
+			continue
+		}
+		select {
+		case w.events <- e.event:
+		default:
+			// The watcher is too slow, drop it so it resumes from its last sequence
+			log.Printf("Watcher on %v fell behind at sequence %d", w.dirID, h.seq)
+			close(w.events)
+			delete(h.watchers, w)
+		}
+	}
+}
+
+// subscribe registers a watcher and returns the events after fromSeq of
+// fromEpoch it has already missed. A fromSeq of 0 only subscribes to new
+// events.
+func (h *watchHub) subscribe(
+	dirID string,
+	recursive bool,
+	fromEpoch uint64,
+	fromSeq uint64,
+) (
+	*watcher,
+	[]*metadata.WatchEvent,
+	error,
+) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := &watcher{
+		dirID:     dirID,
+		recursive: recursive,
+		events:    make(chan *metadata.WatchEvent, watchBufferSize),
+	}
+
+	var backlog []*metadata.WatchEvent
+	if fromSeq != 0 {
+		if fromEpoch != h.epoch || fromSeq > h.seq {
+			return nil, nil, ErrSequenceExpired
+		}
+		if len(h.history) > 0 && h.history[0].event.Sequence > fromSeq+1 {
+			return nil, nil, ErrSequenceExpired
+		}
+		for _, e := range h.history {
+			if e.event.Sequence > fromSeq && w.matches(e) {
+				backlog = append(backlog, e.event)
+			}
+		}
+	}
+
+	h.watchers[w] = struct{}{}
+	return w, backlog, nil
+}
+
+func (h *watchHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.events)
+	}
+}
+
+func (m *MetadataService) Watch(
+	req *metadata.WatchRequest,
+	stream metadata.MetadataService_WatchServer,
+) error {
+	log.Printf("WATCH\t%v", req)
+
+	dirID := req.DirectoryId
+	if dirID == "" {
+		dirID = RootID
+	}
+
+	m.mu.RLock()
+	dir, err := m.store.Get(dirID)
+	if err == ErrFileNotFound {
+		m.mu.RUnlock()
+		return ErrDirNotFound
+	}
+	if err != nil {
+		m.mu.RUnlock()
+		return err
+	}
+	if !dir.IsDir {
+		m.mu.RUnlock()
+		return ErrNotDir
+	}
+	m.mu.RUnlock()
+
+	w, backlog, err := m.events.subscribe(dirID, req.Recursive, req.FromEpoch, req.FromSequence)
+	if err != nil {
+		return err
+	}
+	defer m.events.unsubscribe(w)
+
+	for _, event := range backlog {
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case event, ok := <-w.events:
+			if !ok {
+				return ErrWatchOverflow
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
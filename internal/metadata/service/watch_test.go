@@ -0,0 +1,54 @@
+package metadata_service
+
+import (
+	metadata "github.com/apolyeti/godfs/internal/metadata/genproto"
+	"testing"
+)
+
+// TestWatchResume checks that watchers only resume from sequence numbers of
+// the epoch of the hub, so that they cannot resume across a restart.
+func TestWatchResume(t *testing.T) {
+	h := newWatchHub()
+	for i := 0; i < 3; i++ {
+		h.publish(&watchEvent{event: &metadata.WatchEvent{DirectoryId: RootID}})
+	}
+	restarted := newWatchHub()
+	restarted.epoch = h.epoch + 1
+	restarted.publish(&watchEvent{event: &metadata.WatchEvent{DirectoryId: RootID}})
+
+	tests := []struct {
+		name      string
+		hub       *watchHub
+		fromEpoch uint64
+		fromSeq   uint64
+		backlog   int
+		err       error
+	}{
+		{name: "new events only", hub: h, backlog: 0},
+		{name: "resume", hub: h, fromEpoch: h.epoch, fromSeq: 1, backlog: 2},
+		{name: "up to date", hub: h, fromEpoch: h.epoch, fromSeq: 3, backlog: 0},
+		{name: "ahead", hub: h, fromEpoch: h.epoch, fromSeq: 4, err: ErrSequenceExpired},
+		{name: "no epoch", hub: h, fromSeq: 1, err: ErrSequenceExpired},
+		{name: "after restart", hub: restarted, fromEpoch: h.epoch, fromSeq: 1, err: ErrSequenceExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, backlog, err := tt.hub.subscribe(RootID, false, tt.fromEpoch, tt.fromSeq)
+			if err != tt.err {
+				t.Fatalf("subscribe = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			defer tt.hub.unsubscribe(w)
+			if len(backlog) != tt.backlog {
+				t.Fatalf("backlog = %d events, want %d", len(backlog), tt.backlog)
+			}
+			for _, e := range backlog {
+				if e.Epoch != h.epoch || e.Sequence <= tt.fromSeq {
+					t.Errorf("backlog event %d of epoch %d, want after %d of epoch %d", e.Sequence, e.Epoch, tt.fromSeq, h.epoch)
+				}
+			}
+		})
+	}
+}
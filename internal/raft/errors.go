@@ -0,0 +1,81 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrClosed          = errors.New("raft server is closed")
+	ErrNotReady        = errors.New("leader has not applied its log yet")
+	ErrLeadershipLost  = errors.New("leadership lost before the entry was committed")
+	ErrCommitTimeout   = errors.New("timed out waiting for entries to commit")
+	ErrLogCorrupt      = errors.New("raft log is corrupt")
+	ErrSnapshotCorrupt = errors.New("raft snapshot is corrupt")
+
+	ErrConfigChangePending = errors.New("a membership change is already in progress")
+	ErrServerExists        = errors.New("server is already a member of the group")
+	ErrUnknownServer       = errors.New("server is not a member of the group")
+	ErrInvalidServers      = errors.New("invalid server list")
+)
+
+// notLeaderReason identifies a NotLeaderError in the status sent to clients.
+const notLeaderReason = "NOT_LEADER"
+
+// NotLeaderError is returned for requests only the leader can serve. The
+// leader is empty while the group has none, such as during an election.
+type NotLeaderError struct {
+	LeaderID      string
+	LeaderAddress string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderAddress == "" {
+		return "not the leader, no leader is known"
+	}
+	return fmt.Sprintf("not the leader, the leader is %s at %s", e.LeaderID, e.LeaderAddress)
+}
+
+// GRPCStatus lets clients find the leader in the status of a failed call.
+func (e *NotLeaderError) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, e.Error())
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: notLeaderReason,
+		Domain: "godfs",
+		Metadata: map[string]string{
+			"leader_id":      e.LeaderID,
+			"leader_address": e.LeaderAddress,
+		},
+	})
+	if err != nil {
+		return st
+	}
+	return detailed
+}
+
+// LeaderFromError reports whether err is a NotLeaderError, as returned by a
+// local call or received in the status of a remote one.
+func LeaderFromError(err error) (*NotLeaderError, bool) {
+	var notLeader *NotLeaderError
+	if errors.As(err, &notLeader) {
+		return notLeader, true
+	}
+
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.FailedPrecondition {
+		return nil, false
+	}
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if ok && info.Reason == notLeaderReason {
+			return &NotLeaderError{
+				LeaderID:      info.Metadata["leader_id"],
+				LeaderAddress: info.Metadata["leader_address"],
+			}, true
+		}
+	}
+	return nil, false
+}
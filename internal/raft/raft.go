@@ -0,0 +1,777 @@
+// Package raft replicates a log of commands across a group of servers with
+// the Raft consensus algorithm: leader election, log replication, log
+// compaction through snapshots and single-server membership changes.
+// Servers talk to each other over the RaftService gRPC service, which is
+// registered on the same gRPC server as the service being replicated.
+
+package raft
+
+import (
+	"fmt"
+	pb "github.com/apolyeti/godfs/internal/raft/genproto"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultElectionTimeout is the shortest time a follower waits to hear
+	// from a leader before standing for election.
+	DefaultElectionTimeout = 300 * time.Millisecond
+	// DefaultHeartbeatInterval is the time between appends from the leader
+	// when there is nothing to replicate.
+	DefaultHeartbeatInterval = 50 * time.Millisecond
+	// maxAppendBytes bounds the command data sent in a single append.
+	maxAppendBytes = 1024 * 1024
+	// snapshotChunkSize is the size of the chunks snapshots are sent in.
+	snapshotChunkSize = 1024 * 1024
+)
+
+// Server is a member of a raft group.
+// ID: Unique ID of the server within the group
+// Address: Address the server serves RaftService on
+type Server struct {
+	ID      string
+	Address string
+}
+
+// ParseServers parses a comma separated list of id=address pairs.
+func ParseServers(s string) ([]Server, error) {
+	var servers []Server
+	seen := make(map[string]struct{})
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, address, ok := strings.Cut(pair, "=")
+		if !ok || id == "" || address == "" {
+			return nil, fmt.Errorf("%w: %q is not id=address", ErrInvalidServers, pair)
+		}
+		if _, dup := seen[id]; dup {
+			return nil, fmt.Errorf("%w: %s listed twice", ErrInvalidServers, id)
+		}
+		seen[id] = struct{}{}
+		servers = append(servers, Server{ID: id, Address: address})
+	}
+	return servers, nil
+}
+
+// Config holds the settings of a raft server.
+// ID: ID of the server within its group
+// Dir: Directory the log, snapshot and vote of the server are kept in
+// Servers: Members of the group, bootstrapped when Dir holds no state yet. A
+// server started with none waits to be added to an existing group.
+// ElectionTimeout: Shortest time without a leader before an election, randomized up to twice as long
+// HeartbeatInterval: Time between appends from the leader when there is nothing to replicate
+type Config struct {
+	ID                string
+	Dir               string
+	Servers           []Server
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+}
+
+// StateMachine is the state a raft group replicates. Its methods are never
+// called concurrently.
+type StateMachine interface {
+	// Apply applies a committed command. It is not called for the commands
+	// the server proposed itself, which are applied when proposed.
+	Apply(index uint64, data []byte)
+	// Restore replaces the state with a snapshot taken at index. An index
+	// of 0 and no data stand for the empty state.
+	Restore(index uint64, data []byte) error
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case candidate:
+		return "candidate"
+	case leader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// proposal is a command proposed by the leader, waiting to be committed.
+type proposal struct {
+	term uint64
+	done chan error
+}
+
+// Node is a server of a raft group.
+//
+// The leader applies the commands it proposes to the state machine right
+// away, so that the state machine validates and applies changes in one go,
+// and only reports them done once they are committed. The log of the leader
+// always extends its state machine. Should it lose its leadership and have
+// such commands overwritten by the next leader, its state machine is
+// restored from the snapshot and the committed entries that follow it.
+//
+// mu: guards everything below it
+// role, term, votedFor, leaderID: election state
+// lastContact: last time the leader was heard from, or a leader last heard from a majority
+// electionDeadline: time at which a follower or candidate stands for election
+// commitIndex: index of the last entry known to be committed
+// lastApplied: index of the last entry applied to the state machine
+// readyIndex: entry appended by the leader when elected, it accepts proposals once it is applied
+// localIndex: last command applied to the state machine when proposed
+// restore: the state machine must be restored from the snapshot before applying more entries
+// servers, configIndex: configuration of the group and the index of its entry
+// peers: connections to the other servers, and their replication state while leading
+// selfMatch: last entry the leader synced to its own log
+// proposals: proposed commands waiting to be committed, by index
+// incoming: snapshot being received from the leader
+type Node struct {
+	pb.UnimplementedRaftServiceServer
+	id                string
+	sm                StateMachine
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	snapshotMu        sync.Mutex
+
+	mu               sync.Mutex
+	storage          *storage
+	role             role
+	term             uint64
+	votedFor         string
+	leaderID         string
+	lastContact      time.Time
+	electionDeadline time.Time
+	commitIndex      uint64
+	lastApplied      uint64
+	readyIndex       uint64
+	localIndex       uint64
+	restore          bool
+	servers          []Server
+	configIndex      uint64
+	peers            map[string]*peer
+	selfMatch        uint64
+	proposals        map[uint64]*proposal
+	incoming         *incomingSnapshot
+	closed           bool
+
+	applyNow chan struct{}
+	syncNow  chan struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewNode opens the state of the server kept in cfg.Dir, restores sm from
+// its snapshot and starts taking part in the group.
+func NewNode(cfg Config, sm StateMachine) (*Node, error) {
+	if cfg.ID == "" {
+		return nil, fmt.Errorf("%w: server ID missing", ErrInvalidServers)
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = DefaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+
+	s, state, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		id:                cfg.ID,
+		sm:                sm,
+		electionTimeout:   cfg.ElectionTimeout,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		storage:           s,
+		term:              state.Term,
+		votedFor:          state.VotedFor,
+		peers:             make(map[string]*peer),
+		proposals:         make(map[uint64]*proposal),
+		applyNow:          make(chan struct{}, 1),
+		syncNow:           make(chan struct{}, 1),
+		stop:              make(chan struct{}),
+	}
+
+	if s.lastIndex() == 0 && state.Term == 0 && len(cfg.Servers) > 0 {
+		if err := n.bootstrap(cfg.Servers); err != nil {
+			_ = s.close()
+			return nil, err
+		}
+	}
+	n.servers, n.configIndex = s.configuration(s.lastIndex())
+
+	if s.snapshot.Index > 0 {
+		_, data, err := readSnapshot(s.snapshotPath())
+		if err != nil {
+			_ = s.close()
+			return nil, err
+		}
+		if err := sm.Restore(s.snapshot.Index, data); err != nil {
+			_ = s.close()
+			return nil, fmt.Errorf("restoring snapshot: %w", err)
+		}
+		n.commitIndex = s.snapshot.Index
+		n.lastApplied = s.snapshot.Index
+	}
+
+	n.resetElectionDeadline()
+	n.signal(n.applyNow)
+
+	n.wg.Add(3)
+	go n.run()
+	go n.applyLoop()
+	go n.syncLoop()
+	return n, nil
+}
+
+// bootstrap starts a new group of servers. Every founding server writes
+// the same configuration as the first entry of its log, at term 0, so that
+// it is committed on all of them from the start.
+func (n *Node) bootstrap(servers []Server) error {
+	data, err := encodeConfiguration(servers)
+	if err != nil {
+		return err
+	}
+	err = n.storage.append(&pb.Entry{
+		Index: 1,
+		Term:  0,
+		Type:  pb.EntryType_ENTRY_TYPE_CONFIGURATION,
+		Data:  data,
+	})
+	if err != nil {
+		return err
+	}
+	if err := n.storage.sync(); err != nil {
+		return err
+	}
+	n.commitIndex = 1
+	log.Printf("Bootstrapped raft group with %d servers", len(servers))
+	return nil
+}
+
+// Close stops taking part in the group. Proposals still waiting fail.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.becomeFollower()
+	close(n.stop)
+	n.mu.Unlock()
+
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for id, p := range n.peers {
+		if err := p.conn.Close(); err != nil {
+			log.Printf("Failed to close connection to %s: %v", id, err)
+		}
+	}
+	return n.storage.close()
+}
+
+// ID returns the ID of the server.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// CheckLeader returns nil if the server leads the group and accepts
+// proposals, and a NotLeaderError naming the leader otherwise.
+func (n *Node) CheckLeader() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.checkLeader()
+}
+
+func (n *Node) checkLeader() error {
+	if n.closed {
+		return ErrClosed
+	}
+	if n.role != leader {
+		return n.notLeader()
+	}
+	if n.lastApplied < n.readyIndex {
+		return ErrNotReady
+	}
+	return nil
+}
+
+func (n *Node) notLeader() *NotLeaderError {
+	err := &NotLeaderError{LeaderID: n.leaderID}
+	if server, ok := n.server(n.leaderID); ok {
+		err.LeaderAddress = server.Address
+	}
+	return err
+}
+
+// Propose appends a command to the log of the leader. The caller must
+// already have applied it to the state machine, and must not apply other
+// changes in between, see Node. The returned channel receives nil once the
+// command is committed, or an error if it may not be.
+func (n *Node) Propose(data []byte) (uint64, <-chan error, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.checkLeader(); err != nil {
+		return 0, nil, err
+	}
+
+	entry := &pb.Entry{
+		Index: n.storage.lastIndex() + 1,
+		Term:  n.term,
+		Type:  pb.EntryType_ENTRY_TYPE_COMMAND,
+		Data:  data,
+	}
+	if err := n.storage.append(entry); err != nil {
+		return 0, nil, err
+	}
+	n.localIndex = entry.Index
+
+	done := make(chan error, 1)
+	n.proposals[entry.Index] = &proposal{term: n.term, done: done}
+	n.replicate()
+	return entry.Index, done, nil
+}
+
+// WaitCommitted waits until the entry at index is committed, and reports
+// whether it was before the timeout.
+func (n *Node) WaitCommitted(index uint64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		n.mu.Lock()
+		committed := n.commitIndex >= index
+		n.mu.Unlock()
+
+		if committed {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(n.heartbeatInterval / 10)
+	}
+}
+
+// Snapshot replaces the snapshot of the server with data, the state of the
+// state machine as of index, and drops the entries it includes from the
+// log. The entry at index must be committed.
+func (n *Node) Snapshot(index uint64, data []byte) error {
+	n.snapshotMu.Lock()
+	defer n.snapshotMu.Unlock()
+
+	n.mu.Lock()
+	if index <= n.storage.snapshot.Index {
+		n.mu.Unlock()
+		return nil
+	}
+	if index > n.commitIndex {
+		n.mu.Unlock()
+		return fmt.Errorf("snapshot at %d is ahead of commit index %d", index, n.commitIndex)
+	}
+	term, _ := n.storage.term(index)
+	servers, _ := n.storage.configuration(index)
+	meta := snapshotMeta{Index: index, Term: term, Servers: servers}
+	n.mu.Unlock()
+
+	// Written without holding mu, as the state may be large
+	if err := writeSnapshot(n.storage.dir, meta, data); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.storage.compact(meta); err != nil {
+		return err
+	}
+	log.Printf("Raft log compacted up to %d", index)
+	return nil
+}
+
+// status reports the state of the server.
+func (n *Node) status() *pb.StatusResponse {
+	resp := &pb.StatusResponse{
+		Id:            n.id,
+		State:         n.role.String(),
+		Term:          n.term,
+		LeaderId:      n.leaderID,
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		LastLogIndex:  n.storage.lastIndex(),
+		SnapshotIndex: n.storage.snapshot.Index,
+		Configuration: toProtoConfiguration(n.servers),
+	}
+	if server, ok := n.server(n.leaderID); ok {
+		resp.LeaderAddress = server.Address
+	}
+	return resp
+}
+
+func (n *Node) server(id string) (Server, bool) {
+	for _, server := range n.servers {
+		if server.ID == id {
+			return server, true
+		}
+	}
+	return Server{}, false
+}
+
+func (n *Node) isMember() bool {
+	_, ok := n.server(n.id)
+	return ok
+}
+
+func (n *Node) quorum() int {
+	return len(n.servers)/2 + 1
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// setTerm durably moves the server to a later term, or records its vote.
+func (n *Node) setTerm(term uint64, votedFor string) error {
+	if err := n.storage.saveState(hardState{Term: term, VotedFor: votedFor}); err != nil {
+		return err
+	}
+	n.term = term
+	n.votedFor = votedFor
+	return nil
+}
+
+// stepDown makes the server a follower in term, which is later than its own.
+func (n *Node) stepDown(term uint64) error {
+	if err := n.setTerm(term, ""); err != nil {
+		return err
+	}
+	n.leaderID = ""
+	n.becomeFollower()
+	return nil
+}
+
+// becomeFollower stops leading or standing for election, failing the
+// proposals that are still waiting.
+func (n *Node) becomeFollower() {
+	if n.role == leader {
+		log.Printf("Raft server %s stepping down in term %d", n.id, n.term)
+		for _, p := range n.peers {
+			p.stopReplicating()
+		}
+		n.failProposals(0)
+	}
+	n.role = follower
+	n.resetElectionDeadline()
+}
+
+// failProposals fails the proposals from index from on.
+func (n *Node) failProposals(from uint64) {
+	for index, p := range n.proposals {
+		if index >= from {
+			p.done <- ErrLeadershipLost
+			delete(n.proposals, index)
+		}
+	}
+}
+
+// resolveProposals reports the proposals up to index committed.
+func (n *Node) resolveProposals(index uint64) {
+	for i, p := range n.proposals {
+		if i <= index {
+			p.done <- nil
+			delete(n.proposals, i)
+		}
+	}
+}
+
+// setConfiguration makes servers the configuration of the group, which
+// takes effect as soon as its entry at index is in the log.
+func (n *Node) setConfiguration(servers []Server, index uint64) {
+	n.servers = servers
+	n.configIndex = index
+	if n.role == leader {
+		n.startReplicating()
+	}
+}
+
+// truncate removes the entries from index from on, which were overwritten
+// by the leader.
+func (n *Node) truncate(from uint64) error {
+	if err := n.storage.truncate(from); err != nil {
+		return err
+	}
+	n.failProposals(from)
+
+	// The state machine holds commands this server applied when proposing
+	// them, which will now never be committed
+	if from <= n.localIndex {
+		n.requestRestore()
+	}
+
+	if n.configIndex >= from {
+		n.servers, n.configIndex = n.storage.configuration(n.storage.lastIndex())
+	}
+	return nil
+}
+
+// requestRestore has the apply loop restore the state machine from the
+// snapshot, then apply the committed entries after it again.
+func (n *Node) requestRestore() {
+	n.restore = true
+	n.localIndex = 0
+	n.lastApplied = n.storage.snapshot.Index
+	n.signal(n.applyNow)
+}
+
+// appendEntries appends entries to the log of a follower and syncs it,
+// switching to the latest configuration among them.
+func (n *Node) appendEntries(entries []*pb.Entry) error {
+	if err := n.storage.append(entries...); err != nil {
+		return err
+	}
+	if err := n.storage.sync(); err != nil {
+		return err
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Type != pb.EntryType_ENTRY_TYPE_CONFIGURATION {
+			continue
+		}
+		servers, err := decodeConfiguration(entries[i].Data)
+		if err != nil {
+			return err
+		}
+		n.setConfiguration(servers, entries[i].Index)
+		break
+	}
+	return nil
+}
+
+// setCommitIndex records that the entries up to index are committed.
+func (n *Node) setCommitIndex(index uint64) {
+	if index <= n.commitIndex {
+		return
+	}
+	n.commitIndex = index
+	n.signal(n.applyNow)
+
+	if n.role != leader || n.configIndex > index {
+		return
+	}
+
+	// A committed configuration no longer needs the servers it removed
+	for id, p := range n.peers {
+		if _, ok := n.server(id); !ok {
+			p.stopReplicating()
+		}
+	}
+	if !n.isMember() {
+		log.Printf("Raft server %s was removed from the group", n.id)
+		// Its own commands are applied already, the rest fail on stepping down
+		n.resolveProposals(index)
+		n.leaderID = ""
+		n.becomeFollower()
+	}
+}
+
+func (n *Node) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// run stands for election when no leader is heard from, and has the leader
+// step down once it stops hearing from a majority of the group.
+func (n *Node) run() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.heartbeatInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case now := <-ticker.C:
+			n.mu.Lock()
+			switch n.role {
+			case leader:
+				n.checkQuorum(now)
+			default:
+				// Servers outside the group wait to be added instead
+				if now.After(n.electionDeadline) && n.isMember() {
+					n.startElection()
+				}
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+// checkQuorum steps the leader down if it has not heard from a majority of
+// the group within the election timeout, as another leader may have been
+// elected by then.
+func (n *Node) checkQuorum(now time.Time) {
+	heard := 0
+	for _, server := range n.servers {
+		if server.ID == n.id {
+			heard++
+		} else if p, ok := n.peers[server.ID]; ok && now.Sub(p.lastContact) < n.electionTimeout {
+			heard++
+		}
+	}
+
+	if heard >= n.quorum() {
+		n.lastContact = now
+		return
+	}
+	log.Printf("Raft leader %s lost contact with a majority of the group", n.id)
+	n.leaderID = ""
+	n.becomeFollower()
+}
+
+// applyLoop applies committed entries to the state machine, without holding
+// mu so that the state machine may propose while an entry is applied.
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyNow:
+		}
+
+		for n.applyBatch() {
+		}
+	}
+}
+
+// applyBatch applies the committed entries not yet applied, and reports
+// whether there may be more.
+func (n *Node) applyBatch() bool {
+	n.mu.Lock()
+	if n.restore {
+		n.restore = false
+		n.mu.Unlock()
+		n.restoreSnapshot()
+		return true
+	}
+
+	// The state machine took the snapshot itself, so it already includes
+	// the entries dropped from the log
+	if n.lastApplied < n.storage.snapshot.Index {
+		n.lastApplied = n.storage.snapshot.Index
+		n.resolveProposals(n.lastApplied)
+		n.mu.Unlock()
+		return true
+	}
+
+	if n.lastApplied >= n.commitIndex || n.closed {
+		n.mu.Unlock()
+		return false
+	}
+	entries := n.storage.slice(n.lastApplied+1, n.commitIndex+1, maxAppendBytes)
+	localIndex := n.localIndex
+	n.mu.Unlock()
+
+	for _, entry := range entries {
+		if entry.Type == pb.EntryType_ENTRY_TYPE_COMMAND && entry.Index > localIndex {
+			n.sm.Apply(entry.Index, entry.Data)
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, entry := range entries {
+		if p, ok := n.proposals[entry.Index]; ok {
+			// Another leader committed a different entry at the index
+			if p.term != entry.Term {
+				p.done <- ErrLeadershipLost
+				delete(n.proposals, entry.Index)
+			}
+		}
+	}
+	n.resolveProposals(entries[len(entries)-1].Index)
+
+	// A restore requested meanwhile applies these entries again
+	if !n.restore {
+		n.lastApplied = entries[len(entries)-1].Index
+	}
+	return true
+}
+
+func (n *Node) restoreSnapshot() {
+	n.mu.Lock()
+	meta := n.storage.snapshot
+	n.mu.Unlock()
+
+	var data []byte
+	if meta.Index > 0 {
+		var err error
+		meta, data, err = readSnapshot(n.storage.snapshotPath())
+		if err != nil {
+			log.Fatalf("Failed to read raft snapshot: %v", err)
+		}
+	}
+	if err := n.sm.Restore(meta.Index, data); err != nil {
+		log.Fatalf("Failed to restore raft snapshot: %v", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.restore {
+		n.lastApplied = meta.Index
+	}
+	log.Printf("Raft server %s restored snapshot at %d", n.id, meta.Index)
+}
+
+// syncLoop syncs the log of the leader in the background, so that commands
+// proposed while a sync is under way are synced together by the next one.
+func (n *Node) syncLoop() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.syncNow:
+		}
+
+		n.mu.Lock()
+		if n.role != leader {
+			n.mu.Unlock()
+			continue
+		}
+		term := n.term
+		last := n.storage.lastIndex()
+		file := n.storage.file
+		n.mu.Unlock()
+
+		err := file.Sync()
+
+		n.mu.Lock()
+		// A compacted log was synced when it was rewritten
+		if err != nil && file == n.storage.file {
+			log.Printf("Failed to sync raft log: %v", err)
+			n.leaderID = ""
+			n.becomeFollower()
+		} else if n.role == leader && n.term == term && last > n.selfMatch {
+			n.selfMatch = last
+			n.advanceCommitIndex()
+		}
+		n.mu.Unlock()
+	}
+}
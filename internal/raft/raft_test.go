@@ -0,0 +1,443 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	pb "github.com/apolyeti/godfs/internal/raft/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testElectionTimeout   = 150 * time.Millisecond
+	testHeartbeatInterval = 30 * time.Millisecond
+	// testWait bounds how long a test waits for the group to settle.
+	testWait = 10 * time.Second
+)
+
+// testStateMachine records the commands applied to it in order.
+// restored: index of the last snapshot it was restored from
+type testStateMachine struct {
+	mu       sync.Mutex
+	commands []string
+	restored uint64
+}
+
+func (sm *testStateMachine) Apply(index uint64, data []byte) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.commands = append(sm.commands, string(data))
+}
+
+func (sm *testStateMachine) Restore(index uint64, data []byte) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.commands = nil
+	if len(data) > 0 {
+		sm.commands = strings.Split(string(data), "\n")
+	}
+	sm.restored = index
+	return nil
+}
+
+func (sm *testStateMachine) state() []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return append([]string(nil), sm.commands...)
+}
+
+func (sm *testStateMachine) encode() []byte {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return []byte(strings.Join(sm.commands, "\n"))
+}
+
+// testServer is a running server of a test group.
+type testServer struct {
+	node *Node
+	sm   *testStateMachine
+	srv  *grpc.Server
+}
+
+// testGroup runs a raft group in process, each server on its own port of
+// 127.0.0.1 and with its own directory.
+type testGroup struct {
+	t       *testing.T
+	servers []Server
+	address map[string]string
+	dir     map[string]string
+	running map[string]*testServer
+}
+
+// newTestGroup bootstraps a group of size servers.
+func newTestGroup(t *testing.T, size int) *testGroup {
+	g := &testGroup{
+		t:       t,
+		address: make(map[string]string),
+		dir:     make(map[string]string),
+		running: make(map[string]*testServer),
+	}
+	t.Cleanup(g.stopAll)
+
+	listeners := make(map[string]net.Listener)
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprintf("s%d", i)
+		lis := g.listen("127.0.0.1:0")
+		listeners[id] = lis
+		g.address[id] = lis.Addr().String()
+		g.dir[id] = t.TempDir()
+		g.servers = append(g.servers, Server{ID: id, Address: g.address[id]})
+	}
+	for _, server := range g.servers {
+		g.start(server.ID, listeners[server.ID], g.servers)
+	}
+	return g
+}
+
+func (g *testGroup) listen(address string) net.Listener {
+	g.t.Helper()
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		g.t.Fatalf("Listen: %v", err)
+	}
+	return lis
+}
+
+func (g *testGroup) start(id string, lis net.Listener, servers []Server) *testServer {
+	g.t.Helper()
+	sm := &testStateMachine{}
+	node, err := NewNode(Config{
+		ID:                id,
+		Dir:               g.dir[id],
+		Servers:           servers,
+		ElectionTimeout:   testElectionTimeout,
+		HeartbeatInterval: testHeartbeatInterval,
+	}, sm)
+	if err != nil {
+		_ = lis.Close()
+		g.t.Fatalf("NewNode(%s): %v", id, err)
+	}
+
+	srv := grpc.NewServer()
+	pb.RegisterRaftServiceServer(srv, node)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+
+	s := &testServer{node: node, sm: sm, srv: srv}
+	g.running[id] = s
+	return s
+}
+
+// add starts a server outside the group, which waits to be added to it.
+func (g *testGroup) add(id string) *testServer {
+	g.t.Helper()
+	lis := g.listen("127.0.0.1:0")
+	g.address[id] = lis.Addr().String()
+	g.dir[id] = g.t.TempDir()
+	return g.start(id, lis, nil)
+}
+
+// restart starts a stopped server again, on its address and directory.
+func (g *testGroup) restart(id string) *testServer {
+	g.t.Helper()
+	return g.start(id, g.listen(g.address[id]), nil)
+}
+
+func (g *testGroup) stop(id string) {
+	g.t.Helper()
+	s, ok := g.running[id]
+	if !ok {
+		return
+	}
+	delete(g.running, id)
+	s.srv.Stop()
+	if err := s.node.Close(); err != nil {
+		g.t.Errorf("Close(%s): %v", id, err)
+	}
+}
+
+func (g *testGroup) stopAll() {
+	for id := range g.running {
+		g.stop(id)
+	}
+}
+
+// leader waits until a single running server leads the group and accepts
+// proposals, and returns it.
+func (g *testGroup) leader() *testServer {
+	g.t.Helper()
+	var found *testServer
+	waitFor(g.t, "a leader", func() bool {
+		found = nil
+		for _, s := range g.running {
+			if s.node.CheckLeader() != nil {
+				continue
+			}
+			if found != nil {
+				return false
+			}
+			found = s
+		}
+		return found != nil
+	})
+	return found
+}
+
+// propose applies cmd to the state machine of the leader and proposes it,
+// and returns its index once it is committed.
+func (g *testGroup) propose(s *testServer, cmd string) uint64 {
+	g.t.Helper()
+	s.sm.Apply(0, []byte(cmd))
+	index, done, err := s.node.Propose([]byte(cmd))
+	if err != nil {
+		g.t.Fatalf("Propose(%q): %v", cmd, err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			g.t.Fatalf("Propose(%q): %v", cmd, err)
+		}
+	case <-time.After(testWait):
+		g.t.Fatalf("Propose(%q) was not committed", cmd)
+	}
+	return index
+}
+
+// waitState waits until every running server applied want.
+func (g *testGroup) waitState(want ...string) {
+	g.t.Helper()
+	for id, s := range g.running {
+		waitFor(g.t, id+" to apply "+strings.Join(want, ","), func() bool {
+			return reflect.DeepEqual(s.sm.state(), want)
+		})
+	}
+}
+
+func serverStatus(t *testing.T, s *testServer) *pb.StatusResponse {
+	t.Helper()
+	resp, err := s.node.Status(context.Background(), &pb.StatusRequest{})
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	return resp
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(testHeartbeatInterval / 3)
+	}
+}
+
+func TestParseServers(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []Server
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "a=host:1", want: []Server{{ID: "a", Address: "host:1"}}},
+		{
+			in:   " a=host:1, b=host:2 ,",
+			want: []Server{{ID: "a", Address: "host:1"}, {ID: "b", Address: "host:2"}},
+		},
+		{in: "a", wantErr: true},
+		{in: "=host:1", wantErr: true},
+		{in: "a=", wantErr: true},
+		{in: "a=host:1,a=host:2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseServers(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseServers(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseServers(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestElection checks that a single leader is elected, and that followers
+// name it to callers, locally and over gRPC.
+func TestElection(t *testing.T) {
+	g := newTestGroup(t, 3)
+	leader := g.leader()
+	g.propose(leader, "a")
+
+	for id, s := range g.running {
+		if s == leader {
+			continue
+		}
+
+		var notLeader *NotLeaderError
+		waitFor(t, id+" to follow "+leader.node.ID(), func() bool {
+			var ok bool
+			notLeader, ok = LeaderFromError(s.node.CheckLeader())
+			return ok && notLeader.LeaderID == leader.node.ID()
+		})
+		if notLeader.LeaderAddress != g.address[leader.node.ID()] {
+			t.Errorf("%s: leader address = %q, want %q", id, notLeader.LeaderAddress, g.address[leader.node.ID()])
+		}
+		if _, _, err := s.node.Propose([]byte("b")); err == nil {
+			t.Errorf("%s: Propose on a follower succeeded", id)
+		}
+
+		conn, err := grpc.NewClient(g.address[id], grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		_, err = pb.NewRaftServiceClient(conn).RemoveServer(context.Background(), &pb.RemoveServerRequest{Id: id})
+		_ = conn.Close()
+		remote, ok := LeaderFromError(err)
+		if !ok || remote.LeaderID != leader.node.ID() || remote.LeaderAddress != g.address[leader.node.ID()] {
+			t.Errorf("%s: RemoveServer over gRPC = %v, want the leader named", id, err)
+		}
+	}
+	g.waitState("a")
+}
+
+// TestLeaderFailure stops the leader, and checks that another one is elected
+// and that the old leader catches up once it is back.
+func TestLeaderFailure(t *testing.T) {
+	g := newTestGroup(t, 3)
+	leader := g.leader()
+	for _, cmd := range []string{"a", "b", "c"} {
+		g.propose(leader, cmd)
+	}
+	g.waitState("a", "b", "c")
+
+	old := leader.node.ID()
+	g.stop(old)
+	leader = g.leader()
+	if leader.node.ID() == old {
+		t.Fatalf("stopped server %s still leads", old)
+	}
+	g.propose(leader, "d")
+	g.waitState("a", "b", "c", "d")
+
+	g.restart(old)
+	g.waitState("a", "b", "c", "d")
+	g.propose(g.leader(), "e")
+	g.waitState("a", "b", "c", "d", "e")
+}
+
+// TestInstallSnapshot compacts the log of the leader while a follower is
+// down, so that the follower can only catch up from the snapshot.
+func TestInstallSnapshot(t *testing.T) {
+	g := newTestGroup(t, 3)
+	leader := g.leader()
+	g.propose(leader, "a")
+	g.waitState("a")
+
+	var lagging string
+	for id, s := range g.running {
+		if s != leader {
+			lagging = id
+			break
+		}
+	}
+	g.stop(lagging)
+
+	want := []string{"a"}
+	var index uint64
+	for i := 0; i < 10; i++ {
+		cmd := fmt.Sprintf("cmd-%d", i)
+		index = g.propose(leader, cmd)
+		want = append(want, cmd)
+	}
+	g.waitState(want...)
+
+	// Whichever server leads once the follower is back only has the snapshot
+	for id, s := range g.running {
+		if err := s.node.Snapshot(index, s.sm.encode()); err != nil {
+			t.Fatalf("Snapshot(%s): %v", id, err)
+		}
+		if got := serverStatus(t, s).SnapshotIndex; got != index {
+			t.Fatalf("%s: snapshot index = %d, want %d", id, got, index)
+		}
+	}
+
+	follower := g.restart(lagging)
+	g.waitState(want...)
+	follower.sm.mu.Lock()
+	restored := follower.sm.restored
+	follower.sm.mu.Unlock()
+	if restored != index {
+		t.Errorf("follower restored snapshot at %d, want %d", restored, index)
+	}
+	if got := serverStatus(t, follower).SnapshotIndex; got != index {
+		t.Errorf("follower snapshot index = %d, want %d", got, index)
+	}
+
+	// Entries after the snapshot are replicated as usual
+	g.propose(g.leader(), "after")
+	g.waitState(append(want, "after")...)
+}
+
+// TestMembershipChange adds a server to the group, then has the leader
+// remove itself.
+func TestMembershipChange(t *testing.T) {
+	g := newTestGroup(t, 3)
+	leader := g.leader()
+	g.propose(leader, "a")
+
+	added := g.add("s4")
+	ctx, cancel := context.WithTimeout(context.Background(), testWait)
+	defer cancel()
+	resp, err := leader.node.AddServer(ctx, &pb.AddServerRequest{
+		Server: &pb.Server{Id: "s4", Address: g.address["s4"]},
+	})
+	if err != nil {
+		t.Fatalf("AddServer: %v", err)
+	}
+	if got := len(resp.Configuration.GetServers()); got != 4 {
+		t.Fatalf("%d servers after AddServer, want 4", got)
+	}
+	_, err = leader.node.AddServer(ctx, &pb.AddServerRequest{
+		Server: &pb.Server{Id: "s4", Address: g.address["s4"]},
+	})
+	if err != ErrServerExists {
+		t.Errorf("AddServer of a member = %v, want ErrServerExists", err)
+	}
+
+	g.propose(leader, "b")
+	g.waitState("a", "b")
+	if got := len(serverStatus(t, added).Configuration.GetServers()); got != 4 {
+		t.Errorf("added server knows %d servers, want 4", got)
+	}
+
+	old := leader.node.ID()
+	if _, err := leader.node.RemoveServer(ctx, &pb.RemoveServerRequest{Id: old}); err != nil {
+		t.Fatalf("RemoveServer: %v", err)
+	}
+	waitFor(t, old+" to step down", func() bool {
+		_, ok := LeaderFromError(leader.node.CheckLeader())
+		return ok
+	})
+	g.stop(old)
+
+	leader = g.leader()
+	g.propose(leader, "c")
+	g.waitState("a", "b", "c")
+	for _, server := range serverStatus(t, leader).Configuration.GetServers() {
+		if server.Id == old {
+			t.Errorf("removed server %s is still a member", old)
+		}
+	}
+	if _, err := leader.node.RemoveServer(ctx, &pb.RemoveServerRequest{Id: old}); err != ErrUnknownServer {
+		t.Errorf("RemoveServer of a non-member = %v, want ErrUnknownServer", err)
+	}
+}
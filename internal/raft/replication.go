@@ -0,0 +1,387 @@
+package raft
+
+import (
+	"context"
+	pb "github.com/apolyeti/godfs/internal/raft/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"log"
+	"time"
+)
+
+// peer is the connection to another server of the group, and the state of
+// replicating to it while this server leads.
+// nextIndex: index of the next entry to send
+// matchIndex: index of the last entry known to be in the peer's log
+// lastContact: last time the peer answered the leader
+// trigger: wakes the replicator up to send new entries
+// stop: closed to stop the replicator
+type peer struct {
+	server      Server
+	conn        *grpc.ClientConn
+	client      pb.RaftServiceClient
+	nextIndex   uint64
+	matchIndex  uint64
+	lastContact time.Time
+	trigger     chan struct{}
+	stop        chan struct{}
+}
+
+func (p *peer) stopReplicating() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+		p.trigger = nil
+	}
+}
+
+// newPeer connects to another server of the group.
+func newPeer(server Server) (*peer, error) {
+	conn, err := grpc.NewClient(
+		server.Address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &peer{
+		server: server,
+		conn:   conn,
+		client: pb.NewRaftServiceClient(conn),
+	}, nil
+}
+
+// peer returns the connection to server, connecting on first use.
+func (n *Node) peer(server Server) (*peer, error) {
+	if p, ok := n.peers[server.ID]; ok && p.server.Address == server.Address {
+		return p, nil
+	} else if ok {
+		p.stopReplicating()
+		if err := p.conn.Close(); err != nil {
+			log.Printf("Failed to close connection to %s: %v", server.ID, err)
+		}
+		delete(n.peers, server.ID)
+	}
+
+	p, err := newPeer(server)
+	if err != nil {
+		return nil, err
+	}
+	n.peers[server.ID] = p
+	return p, nil
+}
+
+// startElection stands for leader in the next term, asking every other
+// server of the group for its vote.
+func (n *Node) startElection() {
+	if err := n.setTerm(n.term+1, n.id); err != nil {
+		log.Printf("Failed to start election: %v", err)
+		n.resetElectionDeadline()
+		return
+	}
+	n.role = candidate
+	n.leaderID = ""
+	n.resetElectionDeadline()
+	log.Printf("Raft server %s standing for election in term %d", n.id, n.term)
+
+	term := n.term
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	req := &pb.RequestVoteRequest{
+		Term:         term,
+		CandidateId:  n.id,
+		LastLogIndex: n.storage.lastIndex(),
+		LastLogTerm:  n.storage.lastTerm(),
+	}
+	for _, server := range n.servers {
+		if server.ID == n.id {
+			continue
+		}
+		p, err := n.peer(server)
+		if err != nil {
+			log.Printf("Failed to connect to %s: %v", server.ID, err)
+			continue
+		}
+
+		go func(client pb.RaftServiceClient) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+			defer cancel()
+			resp, err := client.RequestVote(ctx, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				if err := n.stepDown(resp.Term); err != nil {
+					log.Printf("Failed to step down: %v", err)
+				}
+				return
+			}
+			if n.role != candidate || n.term != term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(p.client)
+	}
+}
+
+// becomeLeader takes the lead of the group after winning an election. It
+// appends an entry of its own term, as entries of earlier terms can only be
+// committed along with one, and only accepts proposals once that entry is
+// applied.
+func (n *Node) becomeLeader() {
+	if n.closed {
+		return
+	}
+
+	entry := &pb.Entry{
+		Index: n.storage.lastIndex() + 1,
+		Term:  n.term,
+		Type:  pb.EntryType_ENTRY_TYPE_NOOP,
+	}
+	if err := n.storage.append(entry); err != nil {
+		log.Printf("Failed to append to raft log: %v", err)
+		n.becomeFollower()
+		return
+	}
+
+	n.role = leader
+	n.leaderID = n.id
+	n.readyIndex = entry.Index
+	n.selfMatch = 0
+	n.lastContact = time.Now()
+	log.Printf("Raft server %s elected leader in term %d", n.id, n.term)
+
+	n.startReplicating()
+	n.replicate()
+}
+
+// startReplicating starts a replicator for every other server of the group
+// that does not have one yet.
+func (n *Node) startReplicating() {
+	for _, server := range n.servers {
+		if server.ID == n.id {
+			continue
+		}
+		p, err := n.peer(server)
+		if err != nil {
+			log.Printf("Failed to connect to %s: %v", server.ID, err)
+			continue
+		}
+		if p.stop != nil {
+			continue
+		}
+
+		p.nextIndex = n.storage.lastIndex() + 1
+		p.matchIndex = 0
+		p.lastContact = time.Now()
+		p.trigger = make(chan struct{}, 1)
+		p.stop = make(chan struct{})
+
+		n.wg.Add(1)
+		go n.replicateTo(p, n.term, p.trigger, p.stop)
+	}
+}
+
+// replicate wakes up every replicator, and has the log of the leader synced.
+func (n *Node) replicate() {
+	for _, p := range n.peers {
+		if p.trigger != nil {
+			n.signal(p.trigger)
+		}
+	}
+	n.signal(n.syncNow)
+}
+
+// replicateTo sends entries to p for as long as this server leads in term,
+// and an empty append on every heartbeat interval.
+func (n *Node) replicateTo(p *peer, term uint64, trigger chan struct{}, stop chan struct{}) {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		more := n.sendAppend(p, term)
+		if more {
+			n.signal(trigger)
+		}
+
+		select {
+		case <-n.stop:
+			return
+		case <-stop:
+			return
+		case <-trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendAppend sends the entries p does not have yet, or the snapshot if they
+// were compacted away, and reports whether there are more to send.
+func (n *Node) sendAppend(p *peer, term uint64) bool {
+	n.mu.Lock()
+	if n.role != leader || n.term != term {
+		n.mu.Unlock()
+		return false
+	}
+	if p.nextIndex <= n.storage.snapshot.Index {
+		n.mu.Unlock()
+		return n.sendSnapshot(p, term)
+	}
+
+	prev := p.nextIndex - 1
+	prevTerm, _ := n.storage.term(prev)
+	last := n.storage.lastIndex()
+	req := &pb.AppendEntriesRequest{
+		Term:         term,
+		LeaderId:     n.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  prevTerm,
+		Entries:      n.storage.slice(p.nextIndex, last+1, maxAppendBytes),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+	defer cancel()
+	resp, err := p.client.AppendEntries(ctx, req)
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		if err := n.stepDown(resp.Term); err != nil {
+			log.Printf("Failed to step down: %v", err)
+		}
+		return false
+	}
+	if n.role != leader || n.term != term {
+		return false
+	}
+	p.lastContact = time.Now()
+
+	if !resp.Success {
+		// Skip back to the end of the peer's log at once when it is behind
+		next := p.nextIndex - 1
+		if resp.LastLogIndex+1 < next {
+			next = resp.LastLogIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		p.nextIndex = next
+		return true
+	}
+
+	match := prev + uint64(len(req.Entries))
+	if match > p.matchIndex {
+		p.matchIndex = match
+	}
+	p.nextIndex = match + 1
+	n.advanceCommitIndex()
+	return p.nextIndex <= n.storage.lastIndex()
+}
+
+// sendSnapshot sends the snapshot to p in chunks, and reports whether there
+// are entries to send after it.
+func (n *Node) sendSnapshot(p *peer, term uint64) bool {
+	meta, data, err := readSnapshot(n.storage.snapshotPath())
+	if err != nil {
+		log.Printf("Failed to read raft snapshot for %s: %v", p.server.ID, err)
+		return false
+	}
+	log.Printf("Sending raft snapshot at %d to %s", meta.Index, p.server.ID)
+
+	for offset := 0; ; offset += snapshotChunkSize {
+		end := offset + snapshotChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		req := &pb.InstallSnapshotRequest{
+			Term:              term,
+			LeaderId:          n.id,
+			LastIncludedIndex: meta.Index,
+			LastIncludedTerm:  meta.Term,
+			Configuration:     toProtoConfiguration(meta.Servers),
+			Offset:            uint64(offset),
+			Data:              data[offset:end],
+			Done:              end == len(data),
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+		resp, err := p.client.InstallSnapshot(ctx, req)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to send raft snapshot to %s: %v", p.server.ID, err)
+			return false
+		}
+
+		n.mu.Lock()
+		if resp.Term > n.term {
+			if err := n.stepDown(resp.Term); err != nil {
+				log.Printf("Failed to step down: %v", err)
+			}
+		}
+		leading := n.role == leader && n.term == term
+		if leading {
+			p.lastContact = time.Now()
+		}
+		n.mu.Unlock()
+
+		if !leading {
+			return false
+		}
+		if req.Done {
+			break
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if meta.Index > p.matchIndex {
+		p.matchIndex = meta.Index
+	}
+	p.nextIndex = meta.Index + 1
+	return true
+}
+
+// advanceCommitIndex commits the entries of the current term that a
+// majority of the group has in its log. Entries of earlier terms are
+// committed along with them.
+func (n *Node) advanceCommitIndex() {
+	for index := n.storage.lastIndex(); index > n.commitIndex; index-- {
+		term, _ := n.storage.term(index)
+		if term != n.term {
+			return
+		}
+
+		count := 0
+		for _, server := range n.servers {
+			if server.ID == n.id {
+				if n.selfMatch >= index {
+					count++
+				}
+			} else if p, ok := n.peers[server.ID]; ok && p.matchIndex >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.setCommitIndex(index)
+			n.replicate()
+			return
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	pb "github.com/apolyeti/godfs/internal/raft/genproto"
+	"log"
+	"time"
+)
+
+// incomingSnapshot is a snapshot being received from the leader in chunks.
+type incomingSnapshot struct {
+	term uint64
+	meta snapshotMeta
+	data bytes.Buffer
+}
+
+func (n *Node) RequestVote(
+	ctx context.Context,
+	req *pb.RequestVoteRequest,
+) (
+	*pb.RequestVoteResponse,
+	error,
+) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &pb.RequestVoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+
+	// While a leader is heard from, a server removed from the group cannot
+	// disrupt it by standing for election in later terms
+	if n.leaderID != "" && time.Since(n.lastContact) < n.electionTimeout {
+		return resp, nil
+	}
+
+	if req.Term > n.term {
+		if err := n.stepDown(req.Term); err != nil {
+			return nil, err
+		}
+		resp.Term = n.term
+	}
+
+	// Only a candidate whose log holds every committed entry may lead
+	lastTerm := n.storage.lastTerm()
+	upToDate := req.LastLogTerm > lastTerm ||
+		(req.LastLogTerm == lastTerm && req.LastLogIndex >= n.storage.lastIndex())
+	if !upToDate || (n.votedFor != "" && n.votedFor != req.CandidateId) {
+		return resp, nil
+	}
+
+	if err := n.setTerm(n.term, req.CandidateId); err != nil {
+		return nil, err
+	}
+	n.resetElectionDeadline()
+	resp.VoteGranted = true
+	return resp, nil
+}
+
+// follow makes the server a follower of leaderID in term, which is at least
+// its own.
+func (n *Node) follow(term uint64, leaderID string) error {
+	if term > n.term {
+		if err := n.stepDown(term); err != nil {
+			return err
+		}
+	} else if n.role != follower {
+		n.becomeFollower()
+	}
+	if n.leaderID != leaderID {
+		log.Printf("Raft server %s following %s in term %d", n.id, leaderID, term)
+	}
+	n.leaderID = leaderID
+	n.lastContact = time.Now()
+	n.resetElectionDeadline()
+	return nil
+}
+
+func (n *Node) AppendEntries(
+	ctx context.Context,
+	req *pb.AppendEntriesRequest,
+) (
+	*pb.AppendEntriesResponse,
+	error,
+) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &pb.AppendEntriesResponse{Term: n.term, LastLogIndex: n.storage.lastIndex()}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	if err := n.follow(req.Term, req.LeaderId); err != nil {
+		return nil, err
+	}
+	resp.Term = n.term
+
+	// The log must hold the entry the new ones follow. Entries included in
+	// the snapshot are committed, so they always match.
+	if req.PrevLogIndex > n.storage.lastIndex() {
+		return resp, nil
+	}
+	if req.PrevLogIndex >= n.storage.snapshot.Index {
+		if term, _ := n.storage.term(req.PrevLogIndex); term != req.PrevLogTerm {
+			resp.LastLogIndex = req.PrevLogIndex - 1
+			return resp, nil
+		}
+	}
+
+	for i, entry := range req.Entries {
+		if entry.Index <= n.storage.snapshot.Index {
+			continue
+		}
+		if entry.Index <= n.storage.lastIndex() {
+			if term, _ := n.storage.term(entry.Index); term == entry.Term {
+				continue
+			}
+			if err := n.truncate(entry.Index); err != nil {
+				return nil, err
+			}
+		}
+		if err := n.appendEntries(req.Entries[i:]); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	lastNew := req.PrevLogIndex + uint64(len(req.Entries))
+	if req.LeaderCommit < lastNew {
+		lastNew = req.LeaderCommit
+	}
+	n.setCommitIndex(lastNew)
+
+	resp.Success = true
+	resp.LastLogIndex = n.storage.lastIndex()
+	return resp, nil
+}
+
+func (n *Node) InstallSnapshot(
+	ctx context.Context,
+	req *pb.InstallSnapshotRequest,
+) (
+	*pb.InstallSnapshotResponse,
+	error,
+) {
+	n.mu.Lock()
+	resp := &pb.InstallSnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	if err := n.follow(req.Term, req.LeaderId); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	resp.Term = n.term
+
+	// Chunks are sent in order, a snapshot starts over at offset 0
+	if req.Offset == 0 {
+		n.incoming = &incomingSnapshot{
+			term: req.Term,
+			meta: snapshotMeta{
+				Index:   req.LastIncludedIndex,
+				Term:    req.LastIncludedTerm,
+				Servers: fromProtoServers(req.Configuration.GetServers()),
+			},
+		}
+	}
+	in := n.incoming
+	if in == nil || in.term != req.Term || in.meta.Index != req.LastIncludedIndex || uint64(in.data.Len()) != req.Offset {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	in.data.Write(req.Data)
+	if !req.Done {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	n.incoming = nil
+	n.mu.Unlock()
+
+	if err := n.installSnapshot(in.meta, in.data.Bytes()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// installSnapshot replaces the snapshot and log of a follower with a
+// snapshot received from the leader, and has the state machine restored
+// from it.
+func (n *Node) installSnapshot(meta snapshotMeta, data []byte) error {
+	n.snapshotMu.Lock()
+	defer n.snapshotMu.Unlock()
+
+	n.mu.Lock()
+	current := n.storage.snapshot.Index
+	n.mu.Unlock()
+	if meta.Index <= current {
+		return nil
+	}
+
+	if err := writeSnapshot(n.storage.dir, meta, data); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	kept, err := n.storage.compact(meta)
+	if err != nil {
+		return err
+	}
+	log.Printf("Raft server %s installed snapshot at %d", n.id, meta.Index)
+
+	n.servers, n.configIndex = n.storage.configuration(n.storage.lastIndex())
+	if !kept || n.lastApplied < meta.Index {
+		n.failProposals(0)
+		n.requestRestore()
+	}
+	n.setCommitIndex(meta.Index)
+	return nil
+}
+
+// AddServer adds a server to the group, once every membership change before
+// it is committed. It returns once the new configuration is committed.
+func (n *Node) AddServer(
+	ctx context.Context,
+	req *pb.AddServerRequest,
+) (
+	*pb.AddServerResponse,
+	error,
+) {
+	log.Printf("ADDSERVER\t%v", req)
+
+	server := Server{ID: req.Server.GetId(), Address: req.Server.GetAddress()}
+	if server.ID == "" || server.Address == "" {
+		return nil, ErrInvalidServers
+	}
+
+	servers, err := n.changeConfiguration(ctx, func(servers []Server) ([]Server, error) {
+		for _, s := range servers {
+			if s.ID == server.ID {
+				return nil, ErrServerExists
+			}
+		}
+		return append(servers, server), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AddServerResponse{Configuration: toProtoConfiguration(servers)}, nil
+}
+
+// RemoveServer removes a server from the group, once every membership change
+// before it is committed. A leader that removes itself steps down once the
+// new configuration is committed.
+func (n *Node) RemoveServer(
+	ctx context.Context,
+	req *pb.RemoveServerRequest,
+) (
+	*pb.RemoveServerResponse,
+	error,
+) {
+	log.Printf("REMOVESERVER\t%v", req)
+
+	servers, err := n.changeConfiguration(ctx, func(servers []Server) ([]Server, error) {
+		for i, s := range servers {
+			if s.ID == req.Id {
+				return append(servers[:i:i], servers[i+1:]...), nil
+			}
+		}
+		return nil, ErrUnknownServer
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RemoveServerResponse{Configuration: toProtoConfiguration(servers)}, nil
+}
+
+// changeConfiguration appends the configuration change returns, and waits
+// for it to be committed. Changing a single server at a time keeps any
+// majority of the old configuration overlapping any majority of the new one.
+func (n *Node) changeConfiguration(
+	ctx context.Context,
+	change func([]Server) ([]Server, error),
+) ([]Server, error) {
+	n.mu.Lock()
+	if err := n.checkLeader(); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	if n.configIndex > n.commitIndex {
+		n.mu.Unlock()
+		return nil, ErrConfigChangePending
+	}
+
+	servers, err := change(append([]Server(nil), n.servers...))
+	if err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	data, err := encodeConfiguration(servers)
+	if err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+
+	entry := &pb.Entry{
+		Index: n.storage.lastIndex() + 1,
+		Term:  n.term,
+		Type:  pb.EntryType_ENTRY_TYPE_CONFIGURATION,
+		Data:  data,
+	}
+	if err := n.storage.append(entry); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	done := make(chan error, 1)
+	n.proposals[entry.Index] = &proposal{term: n.term, done: done}
+	n.setConfiguration(servers, entry.Index)
+	n.replicate()
+	n.mu.Unlock()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+		return servers, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (n *Node) Status(
+	ctx context.Context,
+	req *pb.StatusRequest,
+) (
+	*pb.StatusResponse,
+	error,
+) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.status(), nil
+}
@@ -0,0 +1,498 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	pb "github.com/apolyeti/godfs/internal/raft/genproto"
+	"google.golang.org/protobuf/proto"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// stateFile holds the current term and vote of the server.
+	stateFile = "state.json"
+	// logFile holds the entries after the snapshot.
+	logFile = "log"
+	// snapshotFile holds the latest snapshot of the state machine.
+	snapshotFile = "snapshot"
+	// snapshotMagic identifies a snapshot file.
+	snapshotMagic = "GODFSRSN"
+	// maxRecord guards reading the log against a garbage length.
+	maxRecord = 256 * 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// hardState is what a server must not forget across restarts to keep its
+// promises to the rest of the group.
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// snapshotMeta describes a snapshot.
+// Index, Term: index and term of the last entry the snapshot includes
+// Servers: configuration of the group as of that entry
+type snapshotMeta struct {
+	Index   uint64
+	Term    uint64
+	Servers []Server
+}
+
+// snapshotHeader precedes the configuration and state in a snapshot file.
+type snapshotHeader struct {
+	Magic        [8]byte
+	Index        uint64
+	Term         uint64
+	ConfigLength uint32
+	Length       uint64
+	Checksum     uint32
+}
+
+// storage keeps the hard state, log and snapshot of a server in dir.
+// Log entries are framed as [length u32][CRC-32C u32][entry], and a torn
+// record at the end of the log is cut off when it is opened.
+// entries: log entries after the snapshot, in index order
+// offsets: offset in the log file of each entry in entries
+// size: length of the log file
+// snapshot: the snapshot the log continues from
+type storage struct {
+	dir      string
+	file     *os.File
+	entries  []*pb.Entry
+	offsets  []int64
+	size     int64
+	snapshot snapshotMeta
+}
+
+func openStorage(dir string) (*storage, hardState, error) {
+	var state hardState
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, state, err
+	}
+
+	s := &storage{dir: dir}
+
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, state, fmt.Errorf("reading %s: %w", stateFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, state, err
+	}
+
+	meta, err := readSnapshotMeta(s.snapshotPath())
+	if err == nil {
+		s.snapshot = meta
+	} else if !os.IsNotExist(err) {
+		return nil, state, err
+	}
+
+	s.file, err = os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, state, err
+	}
+	if err := s.readLog(); err != nil {
+		_ = s.file.Close()
+		return nil, state, err
+	}
+	return s, state, nil
+}
+
+func (s *storage) snapshotPath() string {
+	return filepath.Join(s.dir, snapshotFile)
+}
+
+// readLog loads the entries of the log file that follow the snapshot.
+// Entries the snapshot already includes are left from a crash between
+// writing the snapshot and compacting the log, and are skipped.
+func (s *storage) readLog() error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var offset int64
+	for {
+		entry, n, err := readRecord(s.file)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Cutting off raft log at offset %d: %v", offset, err)
+			break
+		}
+
+		if entry.Index > s.snapshot.Index {
+			if entry.Index != s.lastIndex()+1 {
+				return fmt.Errorf("%w: entry %d follows %d", ErrLogCorrupt, entry.Index, s.lastIndex())
+			}
+			s.entries = append(s.entries, entry)
+			s.offsets = append(s.offsets, offset)
+		}
+		offset += n
+	}
+
+	s.size = offset
+	if err := s.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func readRecord(r io.Reader) (*pb.Entry, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, fmt.Errorf("%w: torn header", ErrLogCorrupt)
+		}
+		return nil, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	if length > maxRecord {
+		return nil, 0, fmt.Errorf("%w: record of %d bytes", ErrLogCorrupt, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, fmt.Errorf("%w: torn record", ErrLogCorrupt)
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch", ErrLogCorrupt)
+	}
+
+	entry := &pb.Entry{}
+	if err := proto.Unmarshal(payload, entry); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrLogCorrupt, err)
+	}
+	return entry, int64(len(header)) + int64(length), nil
+}
+
+func appendRecord(buf *bytes.Buffer, entry *pb.Entry) error {
+	payload, err := proto.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(payload, crcTable))
+	buf.Write(header[:])
+	buf.Write(payload)
+	return nil
+}
+
+// saveState durably records the term and vote of the server.
+func (s *storage) saveState(state hardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.dir, stateFile, data)
+}
+
+func (s *storage) firstIndex() uint64 {
+	return s.snapshot.Index + 1
+}
+
+func (s *storage) lastIndex() uint64 {
+	return s.snapshot.Index + uint64(len(s.entries))
+}
+
+func (s *storage) lastTerm() uint64 {
+	if len(s.entries) == 0 {
+		return s.snapshot.Term
+	}
+	return s.entries[len(s.entries)-1].Term
+}
+
+// term returns the term of the entry at index, which must either be in the
+// log or be the last entry included in the snapshot.
+func (s *storage) term(index uint64) (uint64, bool) {
+	if index == s.snapshot.Index {
+		return s.snapshot.Term, true
+	}
+	if index < s.firstIndex() || index > s.lastIndex() {
+		return 0, false
+	}
+	return s.entries[index-s.firstIndex()].Term, true
+}
+
+// entry returns the entry at index, which must be in the log.
+func (s *storage) entry(index uint64) *pb.Entry {
+	return s.entries[index-s.firstIndex()]
+}
+
+// slice returns the entries from index from up to, but not including, to,
+// stopping early once maxBytes are exceeded. Entries are never modified once
+// appended, so they are shared with the caller.
+func (s *storage) slice(from uint64, to uint64, maxBytes int) []*pb.Entry {
+	var entries []*pb.Entry
+	size := 0
+	for index := from; index < to; index++ {
+		entry := s.entry(index)
+		size += len(entry.Data)
+		if len(entries) > 0 && size > maxBytes {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// append writes entries to the end of the log. They are only durable once
+// the log is synced.
+func (s *storage) append(entries ...*pb.Entry) error {
+	var buf bytes.Buffer
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		offsets = append(offsets, s.size+int64(buf.Len()))
+		if err := appendRecord(&buf, entry); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		// Cut off whatever part of the write made it, so the log stays whole
+		_ = s.file.Truncate(s.size)
+		_, _ = s.file.Seek(s.size, io.SeekStart)
+		return err
+	}
+
+	s.entries = append(s.entries, entries...)
+	s.offsets = append(s.offsets, offsets...)
+	s.size += int64(buf.Len())
+	return nil
+}
+
+func (s *storage) sync() error {
+	return s.file.Sync()
+}
+
+// truncate removes the entries from index from on.
+func (s *storage) truncate(from uint64) error {
+	i := from - s.firstIndex()
+	if err := s.file.Truncate(s.offsets[i]); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(s.offsets[i], io.SeekStart); err != nil {
+		return err
+	}
+	s.size = s.offsets[i]
+	s.entries = s.entries[:i]
+	s.offsets = s.offsets[:i]
+	return s.file.Sync()
+}
+
+// configuration returns the servers of the group as of the latest
+// configuration entry at or before index, and the index of that entry.
+func (s *storage) configuration(index uint64) ([]Server, uint64) {
+	if index > s.lastIndex() {
+		index = s.lastIndex()
+	}
+	for i := index; i >= s.firstIndex(); i-- {
+		entry := s.entry(i)
+		if entry.Type != pb.EntryType_ENTRY_TYPE_CONFIGURATION {
+			continue
+		}
+		servers, err := decodeConfiguration(entry.Data)
+		if err != nil {
+			log.Printf("Skipping raft configuration at %d: %v", i, err)
+			continue
+		}
+		return servers, i
+	}
+	return s.snapshot.Servers, s.snapshot.Index
+}
+
+// compact makes meta the snapshot the log continues from. Entries it
+// includes are dropped, and so is the whole log if it disagrees with the
+// snapshot about the term of its last entry. It reports whether the log
+// after the snapshot was kept.
+func (s *storage) compact(meta snapshotMeta) (bool, error) {
+	var kept []*pb.Entry
+	term, ok := s.term(meta.Index)
+	consistent := ok && term == meta.Term
+	if consistent && meta.Index < s.lastIndex() {
+		kept = s.entries[meta.Index+1-s.firstIndex():]
+	}
+
+	// The remaining entries are written to a new log that replaces the old one
+	var buf bytes.Buffer
+	offsets := make([]int64, 0, len(kept))
+	for _, entry := range kept {
+		offsets = append(offsets, int64(buf.Len()))
+		if err := appendRecord(&buf, entry); err != nil {
+			return false, err
+		}
+	}
+	if err := writeFileAtomic(s.dir, logFile, buf.Bytes()); err != nil {
+		return false, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(s.dir, logFile), os.O_RDWR, 0o644)
+	if err != nil {
+		return false, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		_ = file.Close()
+		return false, err
+	}
+	if err := s.file.Close(); err != nil {
+		log.Printf("Failed to close raft log: %v", err)
+	}
+
+	s.file = file
+	s.entries = append([]*pb.Entry(nil), kept...)
+	s.offsets = offsets
+	s.size = int64(buf.Len())
+	s.snapshot = meta
+	return consistent, nil
+}
+
+func (s *storage) close() error {
+	return s.file.Close()
+}
+
+// writeSnapshot durably replaces the snapshot file of dir.
+func writeSnapshot(dir string, meta snapshotMeta, data []byte) error {
+	config, err := encodeConfiguration(meta.Servers)
+	if err != nil {
+		return err
+	}
+
+	header := snapshotHeader{
+		Index:        meta.Index,
+		Term:         meta.Term,
+		ConfigLength: uint32(len(config)),
+		Length:       uint64(len(data)),
+	}
+	copy(header.Magic[:], snapshotMagic)
+	checksum := crc32.Update(0, crcTable, config)
+	header.Checksum = crc32.Update(checksum, crcTable, data)
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	buf.Write(config)
+	buf.Write(data)
+	return writeFileAtomic(dir, snapshotFile, buf.Bytes())
+}
+
+// readSnapshot returns the snapshot stored at path after checking its
+// checksum.
+func readSnapshot(path string) (snapshotMeta, []byte, error) {
+	var meta snapshotMeta
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return meta, nil, err
+	}
+
+	var header snapshotHeader
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return meta, nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+	if string(header.Magic[:]) != snapshotMagic {
+		return meta, nil, fmt.Errorf("%w: bad magic", ErrSnapshotCorrupt)
+	}
+	body := data[binary.Size(header):]
+	if uint64(len(body)) != uint64(header.ConfigLength)+header.Length {
+		return meta, nil, fmt.Errorf("%w: expected %d bytes", ErrSnapshotCorrupt, uint64(header.ConfigLength)+header.Length)
+	}
+	if crc32.Checksum(body, crcTable) != header.Checksum {
+		return meta, nil, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupt)
+	}
+
+	meta.Index = header.Index
+	meta.Term = header.Term
+	meta.Servers, err = decodeConfiguration(body[:header.ConfigLength])
+	if err != nil {
+		return meta, nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+	return meta, body[header.ConfigLength:], nil
+}
+
+func readSnapshotMeta(path string) (snapshotMeta, error) {
+	meta, _, err := readSnapshot(path)
+	return meta, err
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over name
+// once it is synced, so a crash leaves either the old or the new content.
+func writeFileAtomic(dir string, name string, data []byte) (err error) {
+	file, err := os.CreateTemp(dir, name+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
+
+func encodeConfiguration(servers []Server) ([]byte, error) {
+	return proto.Marshal(toProtoConfiguration(servers))
+}
+
+func decodeConfiguration(data []byte) ([]Server, error) {
+	config := &pb.Configuration{}
+	if err := proto.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return fromProtoServers(config.Servers), nil
+}
+
+func fromProtoServers(servers []*pb.Server) []Server {
+	result := make([]Server, 0, len(servers))
+	for _, server := range servers {
+		result = append(result, Server{ID: server.Id, Address: server.Address})
+	}
+	return result
+}
+
+func toProtoConfiguration(servers []Server) *pb.Configuration {
+	config := &pb.Configuration{}
+	for _, server := range servers {
+		config.Servers = append(config.Servers, &pb.Server{Id: server.ID, Address: server.Address})
+	}
+	return config
+}